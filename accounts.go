@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/hmac"   // For challenge responses
+	"crypto/pbkdf2" // For salted password hashing
+	"crypto/rand"   // For salts and nonces
+	"crypto/sha256" // Hash function for PBKDF2 and HMAC
+	"encoding/hex"  // For storing binary values in JSON
+	"encoding/json" // For the user store file format
+	"errors"        // For missing-file checks
+	"fmt"           // For error messages
+	"io"            // For reading passwords byte by byte
+	"os"            // For file and terminal access
+	"path/filepath" // For atomic saves next to the store
+	"strconv"       // For challenge parameters
+	"strings"       // For trimming input
+	"sync"          // For guarding the store
+	"time"          // For login timeouts
+)
+
+const (
+	defaultUserStore = "users.json"     // User store path, relative to the server's working directory
+	hashIterations   = 600000           // PBKDF2-SHA256 work factor for new passwords
+	saltSize         = 16               // Random salt per account
+	nonceSize        = 32               // Random challenge per login
+	loginTimeout     = 60 * time.Second // Unanswered challenges are dropped after this
+)
+
+// account is one registered user in the store
+type account struct {
+	Name       string `json:"name"`
+	Salt       string `json:"salt"`            // Hex-encoded random salt
+	Hash       string `json:"hash"`            // Hex-encoded PBKDF2-SHA256(password, salt)
+	Iterations int    `json:"iterations"`      // PBKDF2 work factor used for Hash
+	Role       string `json:"role"`            // Role granting permissions (see roles.go)
+	Admin      bool   `json:"admin,omitempty"` // Pre-roles stores: true means owner
+}
+
+// userStore is a JSON file of accounts, loaded once and rewritten on change
+type userStore struct {
+	mu    sync.RWMutex
+	path  string              // Backing file ("" keeps the store in memory only)
+	users map[string]*account // Accounts by name
+}
+
+// newUserStore creates an empty in-memory store
+func newUserStore() *userStore {
+	return &userStore{users: make(map[string]*account)}
+}
+
+// loadUserStore reads the store at path; a missing file yields an empty store
+func loadUserStore(path string) (*userStore, error) {
+	u := newUserStore()
+	u.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []*account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, a := range accounts {
+		if a.Role == "" { // Migrate stores written before roles existed
+			a.Role = roleMember
+			if a.Admin {
+				a.Role = roleOwner
+			}
+		}
+		a.Admin = false
+		u.users[a.Name] = a
+	}
+	return u, nil
+}
+
+// save writes the store atomically (caller holds u.mu)
+func (u *userStore) save() error {
+	if u.path == "" {
+		return nil
+	}
+	accounts := make([]*account, 0, len(u.users))
+	for _, a := range u.users {
+		accounts = append(accounts, a)
+	}
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(u.path), ".users-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after a successful rename
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), u.path)
+}
+
+// lookup returns a copy of the named account
+func (u *userStore) lookup(name string) (account, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	a, ok := u.users[name]
+	if !ok {
+		return account{}, false
+	}
+	return *a, true
+}
+
+// setPassword creates or updates an account with a freshly salted hash.
+// An empty role keeps the existing account's role (member for new accounts).
+func (u *userStore) setPassword(name, password, role string) error {
+	salt := make([]byte, saltSize)
+	rand.Read(salt)
+	key, err := passwordKey(password, salt, hashIterations)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if role == "" {
+		role = roleMember
+		if old, ok := u.users[name]; ok {
+			role = old.Role
+		}
+	}
+	u.users[name] = &account{
+		Name:       name,
+		Salt:       hex.EncodeToString(salt),
+		Hash:       hex.EncodeToString(key),
+		Iterations: hashIterations,
+		Role:       role,
+	}
+	return u.save()
+}
+
+// setRole changes an account's role and persists it
+func (u *userStore) setRole(name, role string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	a, ok := u.users[name]
+	if !ok {
+		return fmt.Errorf("%s has no account; roles can only be given to registered users", name)
+	}
+	old := a.Role
+	a.Role = role
+	if err := u.save(); err != nil {
+		a.Role = old
+		return err
+	}
+	return nil
+}
+
+// passwordKey derives the stored key for a password
+func passwordKey(password string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+}
+
+// newChallenge returns a random login nonce
+func newChallenge() []byte {
+	nonce := make([]byte, nonceSize)
+	rand.Read(nonce)
+	return nonce
+}
+
+// challengeResponse proves knowledge of a password key without revealing it
+func challengeResponse(key, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// verifyResponse checks a client's answer to nonce against the stored hash.
+// The stored hash is what the client derives from the password, so the
+// password itself never crosses the wire; note that a stolen store file is
+// enough to log in, so it must stay private to the server.
+func (a account) verifyResponse(nonce, response []byte) bool {
+	key, err := hex.DecodeString(a.Hash)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(challengeResponse(key, nonce), response)
+}
+
+// answerChallenge asks for the account password (or takes it from $GOCHAT_PASSWORD)
+// and builds the msgAuth response to a msgChallenge packet. The password is kept
+// in *remembered so logging in again after a reconnect doesn't ask twice.
+func answerChallenge(challenge Packet, username string, remembered *string) (Packet, error) {
+	if *remembered == "" {
+		*remembered = os.Getenv("GOCHAT_PASSWORD")
+	}
+	if *remembered == "" {
+		password, err := readPassword(fmt.Sprintf("Password for %s: ", username))
+		if err != nil {
+			return Packet{}, err
+		}
+		*remembered = password
+	}
+	return challengeAnswer(challenge, *remembered)
+}
+
+// challengeAnswer builds the msgAuth response to a msgChallenge packet from the password
+func challengeAnswer(challenge Packet, password string) (Packet, error) {
+	iterations, err := strconv.Atoi(challenge.field(2))
+	if err != nil || iterations <= 0 {
+		return Packet{}, fmt.Errorf("bad challenge from server")
+	}
+	key, err := passwordKey(password, challenge.fields[1], iterations)
+	if err != nil {
+		return Packet{}, err
+	}
+	return Packet{kind: msgAuth, fields: [][]byte{challengeResponse(key, challenge.fields[3])}}, nil
+}
+
+// readPassword prompts on stdout and reads a line from stdin with echo disabled
+// when stdin is a terminal. It reads byte by byte so no later input is buffered away.
+func readPassword(prompt string) (string, error) {
+	fmt.Print(prompt)
+	if setEcho(false) {
+		defer func() {
+			setEcho(true)
+			fmt.Println() // The user's Enter was not echoed
+		}()
+	}
+
+	var sb strings.Builder
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			sb.WriteByte(b[0])
+		}
+		if err == io.EOF {
+			if sb.Len() == 0 {
+				return "", err
+			}
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimRight(sb.String(), "\r"), nil
+}
+
+// setEcho turns terminal echo on or off, reporting whether it succeeded
+func setEcho(on bool) bool {
+	if !isTerminal(os.Stdin) {
+		return false
+	}
+	arg := "-echo"
+	if on {
+		arg = "echo"
+	}
+	_, err := stty(arg)
+	return err == nil
+}
+
+// runUserAdd implements "gochat useradd <name> [--role <role>]": create or reset an account
+func runUserAdd(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: go run . useradd <username> [--role owner|moderator|member]")
+		return
+	}
+	name := args[0]
+	role := ""
+	switch {
+	case len(args) > 2 && args[1] == "--role":
+		role = args[2]
+	case len(args) > 1 && args[1] == "--admin":
+		role = roleOwner // Shorthand kept from before roles existed
+	}
+	roles, err := loadRoles(defaultRolesFile)
+	if err != nil {
+		fmt.Println("Cannot load roles:", err)
+		os.Exit(1)
+	}
+	if role != "" && !roles.exists(role) {
+		fmt.Printf("Unknown role %q (defined: %s)\n", role, strings.Join(roles.names(), ", "))
+		os.Exit(1)
+	}
+
+	store, err := loadUserStore(defaultUserStore)
+	if err != nil {
+		fmt.Println("Cannot load user store:", err)
+		os.Exit(1)
+	}
+	password, err := readPassword(fmt.Sprintf("New password for %s: ", name))
+	if err != nil || password == "" {
+		fmt.Println("Password cannot be empty")
+		os.Exit(1)
+	}
+	confirm, _ := readPassword("Repeat password: ")
+	if confirm != password {
+		fmt.Println("Passwords do not match")
+		os.Exit(1)
+	}
+	if err := store.setPassword(name, password, role); err != nil {
+		fmt.Println("Cannot save account:", err)
+		os.Exit(1)
+	}
+	acct, _ := store.lookup(name)
+	fmt.Printf("Account %s saved to %s (role: %s)\n", name, defaultUserStore, acct.Role)
+}
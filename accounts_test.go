@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+)
+
+func TestUserStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	store, err := loadUserStore(path)
+	if err != nil {
+		t.Fatalf("load empty store: %v", err)
+	}
+	if err := store.setPassword("carol", "hunter2", roleOwner); err != nil {
+		t.Fatalf("setPassword: %v", err)
+	}
+
+	reloaded, err := loadUserStore(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	acct, ok := reloaded.lookup("carol")
+	if !ok || acct.Role != roleOwner || acct.Iterations != hashIterations {
+		t.Fatalf("reloaded account = %+v, %v", acct, ok)
+	}
+	if acct.Hash == "hunter2" || acct.Salt == "" {
+		t.Errorf("password stored without salted hashing: %+v", acct)
+	}
+}
+
+func TestChallengeResponse(t *testing.T) {
+	store := newUserStore()
+	store.setPassword("dave", "correct horse", "")
+	acct, _ := store.lookup("dave")
+	salt, _ := hex.DecodeString(acct.Salt)
+	nonce := newChallenge()
+
+	key, err := passwordKey("correct horse", salt, acct.Iterations)
+	if err != nil {
+		t.Fatalf("passwordKey: %v", err)
+	}
+	if !acct.verifyResponse(nonce, challengeResponse(key, nonce)) {
+		t.Error("correct password rejected")
+	}
+	if acct.verifyResponse(newChallenge(), challengeResponse(key, nonce)) {
+		t.Error("response replayed against a new challenge was accepted")
+	}
+
+	wrong, _ := passwordKey("wrong horse", salt, acct.Iterations)
+	if acct.verifyResponse(nonce, challengeResponse(wrong, nonce)) {
+		t.Error("wrong password accepted")
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"net"
 	"testing"
 	"time"
@@ -12,22 +11,45 @@ const (
 	message      = "test message for benchmarking"
 )
 
-func BenchmarkUDPPerformance(b *testing.B) {
-	// Start UDP server
-	udpServer := newServer()
-	go udpServer.start(":8080")
-	defer close(udpServer.shutdown)
-	time.Sleep(100 * time.Millisecond) // Wait for server to start
-
-	// Create client
-	client, err := net.Dial("udp", "localhost:8080")
+// testRegister runs the key exchange, registers name over client and
+// returns the session's secure channel
+func testRegister(tb testing.TB, client net.Conn, name string) *secureChannel {
+	channel, err := clientHandshake(client, "localhost", nil)
 	if err != nil {
-		b.Fatalf("Failed to create UDP client: %v", err)
+		tb.Fatalf("Key exchange failed: %v", err)
 	}
-	defer client.Close()
+	register := newPacket(msgRegister, name).withToken(channel.token)
+	register.flags |= flagReliable
+	register.seq = 1
+	data, _ := encodePacket(register)
+	sealed, _ := channel.seal(data)
+	client.Write(sealed)
+
+	buf := make([]byte, maxDatagramSize)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer client.SetReadDeadline(time.Time{})
+	for {
+		n, err := client.Read(buf)
+		if err != nil {
+			tb.Fatalf("No welcome from server: %v", err)
+		}
+		outer, err := decodePacket(buf[:n])
+		if err != nil || outer.kind != msgSealed {
+			continue
+		}
+		if inner, _, err := channel.open(outer); err == nil {
+			if pkt, err := decodePacket(inner); err == nil && pkt.kind == msgWelcome {
+				return channel
+			}
+		}
+	}
+}
 
-	// Register client
-	client.Write([]byte("REGISTER:bench_user"))
+// benchSend registers over client and measures sending testMessages sealed chat messages
+func benchSend(b *testing.B, client net.Conn) {
+	// Register client and stamp its session token on every message
+	channel := testRegister(b, client, "bench_user")
+	chat, _ := encodePacket(newPacket(msgChat, message).withToken(channel.token))
 
 	// Warm up
 	time.Sleep(50 * time.Millisecond)
@@ -36,9 +58,10 @@ func BenchmarkUDPPerformance(b *testing.B) {
 
 	startTime := time.Now()
 
-	// Send 1000 messages
+	// Send 1000 messages, each sealed with its own nonce
 	for i := 0; i < testMessages; i++ {
-		_, err := client.Write([]byte(message))
+		sealed, _ := channel.seal(chat)
+		_, err := client.Write(sealed)
 		if err != nil {
 			b.Errorf("Failed to send message: %v", err)
 		}
@@ -53,43 +76,44 @@ func BenchmarkUDPPerformance(b *testing.B) {
 	b.ReportMetric(float64(duration.Microseconds())/float64(testMessages), "μs/msg") // Latency per message
 }
 
-func BenchmarkTCPPerformance(b *testing.B) {
-	// Start TCP server
-	tcpServer := newServer()
-	go tcpServer.start(":8081")
-	defer close(tcpServer.shutdown)
+func BenchmarkUDPPerformance(b *testing.B) {
+	// Start UDP server
+	udpServer := newServer()
+	transports, err := listen(":8080", "")
+	if err != nil {
+		b.Fatalf("Failed to start UDP server: %v", err)
+	}
+	go udpServer.start(transports)
+	defer close(udpServer.shutdown)
 	time.Sleep(100 * time.Millisecond) // Wait for server to start
 
 	// Create client
-	client, err := net.Dial("tcp", "localhost:8081")
+	client, err := dialServer("localhost:8080", false)
 	if err != nil {
-		b.Fatalf("Failed to create TCP client: %v", err)
+		b.Fatalf("Failed to create UDP client: %v", err)
 	}
 	defer client.Close()
 
-	// Register client
-	fmt.Fprintf(client, "REGISTER:bench_user\n")
-
-	// Warm up
-	time.Sleep(50 * time.Millisecond)
-
-	b.ResetTimer() // Start measuring performance from here
-
-	startTime := time.Now()
+	benchSend(b, client)
+}
 
-	// Send 1000 messages
-	for i := 0; i < testMessages; i++ {
-		_, err := fmt.Fprintf(client, message+"\n")
-		if err != nil {
-			b.Errorf("Failed to send message: %v", err)
-		}
+func BenchmarkTCPPerformance(b *testing.B) {
+	// Start TCP server
+	tcpServer := newServer()
+	transports, err := listen("", ":8081")
+	if err != nil {
+		b.Fatalf("Failed to start TCP server: %v", err)
 	}
+	go tcpServer.start(transports)
+	defer close(tcpServer.shutdown)
+	time.Sleep(100 * time.Millisecond) // Wait for server to start
 
-	// Calculate metrics
-	duration := time.Since(startTime)
+	// Create client (framed, so the same packets go over the stream)
+	client, err := dialServer("localhost:8081", true)
+	if err != nil {
+		b.Fatalf("Failed to create TCP client: %v", err)
+	}
+	defer client.Close()
 
-	// Report metrics
-	b.ReportMetric(float64(testMessages), "msgs")                                    // Total messages
-	b.ReportMetric(float64(testMessages)/duration.Seconds(), "msg/s")                // Message rate
-	b.ReportMetric(float64(duration.Microseconds())/float64(testMessages), "μs/msg") // Latency per message
+	benchSend(b, client)
 }
@@ -1,14 +1,19 @@
 package main
 
 import (
-	"bufio"   // For reading input
-	"fmt"     // For formatted I/O
-	"log"     // For logging errors
-	"net"     // For network operations
-	"os"      // For OS operations
-	"strings" // For string manipulation
-	"sync"    // For synchronization
-	"time"    // For time operations
+	"bufio"         // For reading input
+	"encoding/json" // For JSON mode
+	"errors"        // For matching handshake errors
+	"fmt"           // For formatted I/O
+	"log"           // For logging errors
+	"net"           // For network operations
+	"os"            // For OS operations
+	"path/filepath" // For the whisper key file
+	"strconv"       // For the resumed session's last delivered packet
+	"strings"       // For string manipulation
+	"sync"          // For synchronization
+	"sync/atomic"   // For state shared between goroutines
+	"time"          // For time operations
 )
 
 // clearScreen clears the terminal screen using ANSI escape codes
@@ -16,13 +21,22 @@ func clearScreen() {
 	fmt.Print("\033[H\033[2J") // ANSI escape sequence for clear screen
 }
 
-// showInteractiveHelp displays an interactive help menu and returns the selected command
-func showInteractiveHelp(isAdmin bool) string {
-	clearScreen()
+// showInteractiveHelp displays an interactive help menu and returns the selected command packet.
+// In plain mode the screen is left alone and the menu has no colors.
+func showInteractiveHelp(privileged, plain bool) (Packet, bool) {
+	color := func(c, s string) string {
+		if plain {
+			return s
+		}
+		return paint(c, s)
+	}
+	if !plain {
+		clearScreen()
+	}
 	// Draw help menu box
-	fmt.Println("\033[1;36m┌──────────────────────────────────────┐")
-	fmt.Println("│           \033[1;35mGOCHAT HELP\033[1;36m           │")
-	fmt.Println("├──────────────────────────────────────┤")
+	fmt.Println(color("1;36", "┌──────────────────────────────────────┐"))
+	fmt.Println(color("1;36", "│"+strings.Repeat(" ", 13)) + color("1;35", "GOCHAT HELP") + color("1;36", strings.Repeat(" ", 14)+"│"))
+	fmt.Println(color("1;36", "├──────────────────────────────────────┤"))
 
 	// Standard commands
 	options := []struct {
@@ -36,12 +50,12 @@ func showInteractiveHelp(isAdmin bool) string {
 
 	// Print standard options
 	for _, opt := range options {
-		fmt.Printf("│ \033[32m%s\033[0m - %-25s \033[36m│\n", opt.key, opt.desc)
+		fmt.Printf("%s %s - %-32s %s\n", color("1;36", "│"), color("32", opt.key), opt.desc, color("1;36", "│"))
 	}
 
 	// Admin commands
-	if isAdmin {
-		fmt.Println("├──────────────────────────────────────┤")
+	if privileged {
+		fmt.Println(color("1;36", "├──────────────────────────────────────┤"))
 		adminOpts := []struct {
 			key, desc string
 		}{
@@ -51,11 +65,11 @@ func showInteractiveHelp(isAdmin bool) string {
 		}
 		// Print admin options
 		for _, opt := range adminOpts {
-			fmt.Printf("│ \033[31m%s\033[0m - %-25s \033[36m│\n", opt.key, opt.desc)
+			fmt.Printf("%s %s - %-32s %s\n", color("1;36", "│"), color("31", opt.key), opt.desc, color("1;36", "│"))
 		}
 	}
 
-	fmt.Println("└──────────────────────────────────────┘\033[0m")
+	fmt.Println(color("1;36", "└──────────────────────────────────────┘"))
 	fmt.Print("Select option (q to quit): ")
 
 	scanner := bufio.NewScanner(os.Stdin)
@@ -63,7 +77,7 @@ func showInteractiveHelp(isAdmin bool) string {
 		choice := scanner.Text()
 		switch choice {
 		case "1": // List users
-			return "/users"
+			return newPacket(msgUsers), true
 		case "2": // Private message
 			fmt.Print("Enter username: ")
 			scanner.Scan()
@@ -71,110 +85,469 @@ func showInteractiveHelp(isAdmin bool) string {
 			fmt.Print("Enter message: ")
 			scanner.Scan()
 			msg := scanner.Text()
-			return fmt.Sprintf("WHISPER:%s:%s", user, msg)
+			return newPacket(msgWhisper, user, msg), true
 		case "3": // Change username
 			fmt.Print("Enter new username: ")
 			scanner.Scan()
-			return fmt.Sprintf("RENAME:%s", scanner.Text())
+			return newPacket(msgRename, scanner.Text()), true
 		case "4": // Server stats
-			return "/stats"
-		case "5": // Kick user (admin)
-			if isAdmin {
+			return newPacket(msgStats), true
+		case "5": // Kick user (privileged)
+			if privileged {
 				fmt.Print("Enter username to kick: ")
 				scanner.Scan()
-				return fmt.Sprintf("KICK:%s", scanner.Text())
+				return newPacket(msgKick, scanner.Text()), true
 			}
-		case "6": // Broadcast (admin)
-			if isAdmin {
+		case "6": // Broadcast (privileged)
+			if privileged {
 				fmt.Print("Enter broadcast message: ")
 				scanner.Scan()
-				return fmt.Sprintf("BROADCAST:%s", scanner.Text())
+				return newPacket(msgBroadcast, scanner.Text()), true
 			}
-		case "7": // Admin menu (admin)
-			if isAdmin {
-				return "/menu"
+		case "7": // Admin menu (privileged)
+			if privileged {
+				return newPacket(msgMenu), true
 			}
 		case "q": // Quit help
-			return ""
+			return Packet{}, false
 		default: // Invalid choice
 			fmt.Print("Invalid choice, try again: ")
 		}
 	}
-	return ""
+	return Packet{}, false
 }
 
-// showPrompt displays the chat input prompt with username
-func showPrompt(username string) {
-	fmt.Printf("\033[35m[%s]\033[0m » ", username) // Purple username prompt
+// isPrivileged reports whether a permission list from the server unlocks admin commands
+func isPrivileged(perms string) bool {
+	for _, p := range strings.Split(perms, ",") {
+		if p != "" && p != string(permStats) {
+			return true
+		}
+	}
+	return false
 }
 
-// startClient initializes and starts the chat client
-func startClient(serverAddr, username string) {
-	// Resolve server address
-	addr, err := net.ResolveUDPAddr("udp", serverAddr)
-	if err != nil {
-		log.Fatal("Resolve address error:", err)
+// promptText is the chat input prompt with username and current room
+func promptText(t theme, username, room string) string {
+	if room == "" {
+		return fmt.Sprintf("%s » ", paint(t.prompt, "["+username+"]"))
 	}
+	return fmt.Sprintf("%s%s%s » ", paint(t.prompt, "["+username+" "), paint(t.promptRoom, "#"+room), paint(t.prompt, "]"))
+}
 
-	// Create UDP connection
-	conn, err := net.DialUDP("udp", nil, addr)
-	if err != nil {
-		log.Fatal("Connection error:", err)
+// mustJSON encodes an event, which cannot fail
+func mustJSON(ev event) []byte {
+	data, _ := json.Marshal(ev)
+	return data
+}
+
+// clientOptions are the command line options of the terminal client
+type clientOptions struct {
+	useTCP      bool      // Connect over TCP instead of UDP
+	jsonMode    bool      // Print events as JSON lines for scripts instead of rendering them
+	render      *renderer // Theme, time zone and clock events are shown with
+	plain       bool      // Write no escape codes at all, not even those in messages
+	interactive bool      // A person at a terminal: prompts, typing indicators, the /help menu
+	tui         bool      // Full-screen interface with a fixed input line (needs interactive)
+}
+
+// startClient initializes and starts the chat client. The server sends events,
+// which are rendered locally, or printed one JSON object per line in jsonMode
+// for scripts, without prompts or colors. Without a terminal (interactive
+// unset) there are no prompts either, so output can be piped or logged.
+func startClient(serverAddr, username string, opts clientOptions) {
+	th := opts.render.theme
+	// clean takes escape codes out of what is about to be printed in plain mode
+	clean := func(s string) string {
+		if opts.plain {
+			return ansiEscape.ReplaceAllString(s, "")
+		}
+		return s
+	}
+	// clearLine makes way for a line from the server where the prompt is
+	clearLine := func() {
+		switch {
+		case !opts.interactive: // No prompt to clear
+		case opts.plain:
+			fmt.Println()
+		default:
+			fmt.Print("\r\033[K")
+		}
 	}
-	defer conn.Close() // Ensure connection closes on exit
 
-	// Set initial read timeout
-	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	// The server's identity is checked on every connection, reconnects included
+	hosts := defaultKnownHosts()
+	hosts.announce = func(msg string) {
+		if opts.jsonMode {
+			fmt.Fprintln(os.Stderr, msg) // Keep stdout JSON only
+			return
+		}
+		fmt.Println(paint(th.notice, msg))
+	}
 
-	// Register with server
-	_, err = conn.Write([]byte("REGISTER:" + username))
+	// Long-term whisper keys for this username, published at registration
+	keys, err := loadUserKeys(filepath.Join(configDir(), identitiesFile), username)
 	if err != nil {
-		log.Fatal("Registration failed:", err)
+		log.Fatal("Whisper key error: ", err)
+	}
+	whispers := newWhisperer(keys, defaultKnownUsers())
+
+	var room atomic.Value // Current room name, set by msgRoom packets
+	room.Store("")
+	var self atomic.Value // Our name, which /rename changes; logging in again uses it
+	self.Store(username)
+	var state atomic.Value // Connection state for the status bar
+	state.Store("connected")
+	var online atomic.Value // Users from the last user list, for completion
+	online.Store([]userInfo(nil))
+	var ed *lineEditor         // Input line with history and completion, for people at a terminal
+	var ui *tui                // Full-screen interface, once logged in with opts.tui
+	var pe *promptEditor       // Or ed on the simple prompt
+	var autoUsers atomic.Int32 // User lists asked for by the client, not the user
+
+	prompt := func() {
+		switch {
+		case ui != nil || !opts.interactive || opts.jsonMode:
+		case pe != nil:
+			pe.draw(promptText(th, self.Load().(string), room.Load().(string)))
+		default:
+			fmt.Print(promptText(th, self.Load().(string), room.Load().(string)))
+		}
+	}
+	// out prints rendered output, into the message pane when full-screen
+	out := func(s string) {
+		switch {
+		case ui != nil:
+			ui.print(s)
+		case pe != nil:
+			pe.print(s)
+		default:
+			clearLine()
+			fmt.Println(clean(s))
+		}
+	}
+	session := &connection{} // Live once logged in, replaced after reconnecting
+	send := session.send
+	// refreshUsers asks for the user list behind the sidebar and completion
+	refreshUsers := func() {
+		if ed != nil {
+			autoUsers.Add(1)
+			send(newPacket(msgUsers))
+		}
+	}
+	// show prints an event from the server (or one made up here)
+	show := func(ev event) {
+		for _, ev := range whispers.openEvent(ev) {
+			if opts.jsonMode {
+				fmt.Println(string(mustJSON(ev)))
+				continue
+			}
+			switch ev.Type {
+			case eventTyping:
+				if ui != nil { // Shown in the status bar
+					ui.typingFrom(ev.Sender)
+					continue
+				}
+			case eventUserList:
+				online.Store(ev.Users)
+				if ui != nil {
+					ui.setUsers(ev.Users)
+				}
+				if autoUsers.Load() > 0 {
+					autoUsers.Add(-1)
+					continue
+				}
+			case eventRename:
+				if ev.Sender == self.Load().(string) {
+					self.Store(ev.Target)
+				}
+				if ui != nil {
+					ui.renamed(ev.Sender, ev.Target)
+				}
+				refreshUsers()
+			case eventJoin, eventLeave, eventPresence:
+				refreshUsers()
+			}
+			out(strings.TrimRight(opts.render.render(ev), "\n"))
+		}
+	}
+	notify := func(kind, text string) { show(event{Type: kind, Time: time.Now(), Text: text}) }
+
+	// watch reports on the delivery of what is sent over a new connection
+	watch := func(cc *clientConn) {
+		cc.link.onDelivered = func(pkt Packet) {
+			if opts.jsonMode || ui != nil { // The status bar shows what is still being sent
+				return
+			}
+			if pkt.kind == msgChat || pkt.kind == msgWhisper || (pkt.kind == msgFragment && cc.tracker.acked(pkt)) {
+				clearLine()
+				fmt.Println(paint(th.dim, "✓ delivered"))
+				prompt()
+			}
+		}
+		cc.link.onFailed = func(pkt Packet) {
+			what := pkt.field(len(pkt.fields) - 1)
+			if pkt.kind == msgWhisper || pkt.kind == msgKeyRequest {
+				what = "whisper to " + pkt.field(0) // Never print the ciphertext
+			}
+			if pkt.kind == msgFragment {
+				if !cc.tracker.failed(pkt) {
+					return // Already reported for this message
+				}
+				what = "long message"
+			}
+			notify(eventError, "✗ not delivered: "+what)
+			prompt()
+		}
+	}
+
+	var password string // Asked for once, then used again when reconnecting
+	// login connects over UDP (or framed TCP), checks the server's identity and
+	// registers, presenting the previous session's resume ticket when reconnecting
+	login := func(ticket []byte) (*clientConn, Packet, []Packet, error) {
+		conn, err := dialServer(serverAddr, opts.useTCP)
+		if err != nil {
+			return nil, Packet{}, nil, fmt.Errorf("connection error: %w", err)
+		}
+		channel, err := clientHandshake(conn, serverAddr, hosts)
+		if err != nil {
+			conn.Close()
+			return nil, Packet{}, nil, fmt.Errorf("secure connection failed: %w", err)
+		}
+		cc := newClientConn(conn, channel)
+		watch(cc)
+
+		// Register with server, asking for events rather than rendered text
+		name := self.Load().(string)
+		fields := [][]byte{[]byte(name), keys.encPublic(), keys.signPublic(), []byte(eventFormatJSON)}
+		if ticket != nil {
+			fields = append(fields, ticket)
+		}
+		if err := cc.send(Packet{kind: msgRegister, fields: fields}); err != nil {
+			conn.Close()
+			return nil, Packet{}, nil, fmt.Errorf("registration failed: %w", err)
+		}
+
+		// Wait for the welcome (answering a password challenge first for registered names)
+		welcome, backlog, err := cc.awaitWelcome(10*time.Second, func(challenge Packet) (Packet, error) {
+			return answerChallenge(challenge, name, &password)
+		})
+		if err != nil {
+			conn.Close()
+			return nil, Packet{}, nil, err
+		}
+		return cc, welcome, backlog, nil
+	}
+
+	cc, welcome, backlog, err := login(nil)
+	var refused *loginError
+	switch {
+	case errors.Is(err, errHostKeyChanged):
+		fmt.Println(paint(th.errors, fmt.Sprintf("WARNING: THE SERVER KEY HAS CHANGED!\n%v", err)))
+		os.Exit(1)
+	case errors.As(err, &refused):
+		notify(eventError, refused.text) // e.g. username taken or wrong password
+		return
+	case errors.Is(err, errNoWelcome):
+		log.Fatal("Registration failed: no response from server")
+	case err != nil:
+		log.Fatal("Login failed: ", err)
+	}
+	session.restore(cc, 0)
+	defer func() { // Ensure connection closes on exit
+		if cc := session.current(); cc != nil {
+			cc.conn.Close()
+		}
+	}()
+	ticket := []byte(welcome.field(5)) // Takes the session back after reconnecting
+
+	var privileged atomic.Bool                       // Role grants admin commands (can change at runtime)
+	privileged.Store(isPrivileged(welcome.field(3))) // Permissions come from the server
+
+	if opts.interactive && !opts.jsonMode && !opts.plain { // Editing draws with escape codes
+		ed = newLineEditor(defaultHistoryPath(), func() []string {
+			var names []string
+			for _, u := range online.Load().([]userInfo) {
+				names = append(names, u.Name)
+			}
+			return names
+		})
+	}
+	if ed != nil && opts.tui {
+		ui, err = startTUI(th, username, ed, func() tuiStatus {
+			st := tuiStatus{state: state.Load().(string), pending: session.queued()}
+			if cc := session.current(); cc != nil {
+				st.latency, st.pending = cc.link.latency(), st.pending+cc.link.pending()
+			}
+			return st
+		})
+		if err != nil {
+			log.Println("No full-screen interface:", err)
+		} else {
+			ui.onTyping = func() { session.sendUnreliable(newPacket(msgTyping)) } // Cheap to lose
+			log.SetOutput(ui)
+		}
+	}
+	if ed != nil && ui == nil {
+		if pe, err = startPromptEditor(ed); err != nil {
+			log.Println("No line editing:", err)
+			ed = nil
+		}
 	}
 
 	// Show connection message
-	fmt.Printf("\033[32mConnected to %s as %s\033[0m\n", serverAddr, username)
-	if username == "admin" {
-		fmt.Println("Type /menu for admin commands")
-	} else {
-		fmt.Println("Type /help for commands")
-		fmt.Println("You will be automatically disconnected after 10 minutes of inactivity")
+	if !opts.jsonMode { // Scripts have the join event
+		out(paint(th.join, fmt.Sprintf("Connected to %s as %s", serverAddr, username)))
+		if privileged.Load() {
+			out("Type /menu for admin commands")
+		} else {
+			out("Type /help for commands")
+		}
+		if ui != nil {
+			out(paint(th.dim, "PgUp/PgDn scroll, Ctrl-C quits"))
+		}
+	}
+
+	// handle acts on one packet from the server after login
+	handle := func(pkt Packet) {
+		switch pkt.kind {
+		case msgRole: // Granted or revoked a role
+			privileged.Store(isPrivileged(pkt.field(1)))
+			return
+		case msgRoom: // Joined a room: only the prompt changes, the server announces the join
+			room.Store(pkt.field(0))
+			if ui != nil {
+				ui.setRoom(pkt.field(0))
+				refreshUsers()
+			}
+			return
+		case msgKey: // A whisper recipient's key arrived: encrypt and send what was waiting
+			out, notice := whispers.keyArrived(pkt)
+			for _, w := range out {
+				send(w)
+			}
+			if notice == "" {
+				return
+			}
+			notify(eventError, notice)
+		case msgEvent:
+			ev, err := decodeEvent(pkt)
+			if err != nil {
+				log.Println("Dropped malformed event:", err)
+				return
+			}
+			show(ev)
+		default:
+			return
+		}
+		prompt()
 	}
 
 	var wg sync.WaitGroup           // For goroutine synchronization
-	wg.Add(2)                       // We'll launch 2 goroutines
+	wg.Add(3)                       // We'll launch 3 goroutines
 	shutdown := make(chan struct{}) // Channel for graceful shutdown
+	var stopOnce sync.Once
+	stop := func() { // Safe to call from any goroutine
+		stopOnce.Do(func() {
+			close(shutdown)
+			if cc := session.current(); cc != nil {
+				cc.conn.SetReadDeadline(time.Now()) // Wake the receiver rather than wait out its timeout
+			}
+		})
+	}
+
+	// reconnect replaces a lost connection, waiting longer between attempts
+	// until one works, the server turns the login down or the user quits
+	reconnect := func(old *clientConn, cause error) bool {
+		for _, pkt := range session.lost() {
+			if old.tracker.failed(pkt) {
+				notify(eventError, "✗ not delivered: long message")
+			}
+		}
+		notify(eventError, fmt.Sprintf("Connection lost (%v), reconnecting…", cause))
+		prompt()
+		state.Store("reconnecting…")
+		for attempt := 0; ; attempt++ {
+			select {
+			case <-shutdown:
+				return false
+			case <-time.After(backoff(attempt)):
+			}
+			cc, welcome, backlog, err := login(ticket)
+			var refused *loginError
+			if errors.As(err, &refused) || errors.Is(err, errHostKeyChanged) {
+				notify(eventError, fmt.Sprintf("Could not reconnect: %v", err))
+				return false
+			}
+			if err != nil {
+				state.Store(fmt.Sprintf("reconnecting… (%d)", attempt+1))
+				continue
+			}
+			ticket = []byte(welcome.field(5))
+			privileged.Store(isPrivileged(welcome.field(3)))
+			var rejoin []Packet // New sessions start in the lobby: go back first
+			if was := room.Load().(string); welcome.field(6) == "" && was != "" && was != defaultRoom {
+				rejoin = append(rejoin, newPacket(msgJoin, was))
+			}
+			delivered, _ := strconv.ParseUint(welcome.field(7), 10, 32)
+			queued := session.restore(cc, uint32(delivered), rejoin...)
+			state.Store("connected")
+			notice := "Reconnected"
+			if queued > 0 {
+				notice += fmt.Sprintf(", sent %d queued", queued)
+			}
+			notify(eventSystem, notice)
+			for _, pkt := range backlog {
+				handle(pkt)
+			}
+			return true
+		}
+	}
 
 	// Goroutine 1: Handle incoming messages
 	go func() {
 		defer wg.Done() // Notify when done
-		buf := make([]byte, 1024)
+		for _, pkt := range backlog {
+			handle(pkt)
+		}
+		buf := make([]byte, maxDatagramSize)
 		for {
+			cc := session.current()
+			// Wake up when the server has been quiet for too long
+			cc.conn.SetReadDeadline(cc.lastHeard().Add(cc.heartbeat() * missedHeartbeats))
 			select {
-			case <-shutdown:
+			case <-shutdown: // Checked after the deadline, which stop may have just cut short
 				return
 			default:
-				// Refresh read timeout
-				conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-				n, err := conn.Read(buf)
-				if err != nil {
-					if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-						continue // Timeout is normal
-					}
-					log.Println("Receive error:", err)
-					close(shutdown)
-					return
+			}
+			n, err := cc.conn.Read(buf)
+			if err == nil {
+				for _, pkt := range cc.receive(buf[:n]) {
+					handle(pkt)
+				}
+				continue
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if !cc.silent(time.Now()) {
+					continue // Heard from it while we were waking up
 				}
-				msg := string(buf[:n])
-				// Handle typing indicators differently
-				if strings.Contains(msg, "is typing...") {
-					fmt.Print("\r\033[K") // Clear line
-					fmt.Println(msg)
-				} else {
-					fmt.Print("\r\033[K") // Clear line
-					fmt.Printf("%s\n", msg)
+				err = errors.New("server not responding")
+			}
+			if cc.link.isStalled() {
+				err = errLinkStalled
+			}
+			select {
+			case <-shutdown: // Closed on purpose
+				return
+			default:
+			}
+			if !reconnect(cc, err) {
+				state.Store("disconnected")
+				if ui != nil {
+					out(paint(th.notice, "Disconnected from server. Press Enter to exit."))
 				}
-				showPrompt(username)
+				stop()
+				return
 			}
 		}
 	}()
@@ -183,96 +556,109 @@ func startClient(serverAddr, username string) {
 	go func() {
 		defer wg.Done()
 		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024) // Allow long pastes; the server enforces its own limit
+		readLine := func() (string, bool) {
+			ok := scanner.Scan()
+			return scanner.Text(), ok
+		}
+		switch {
+		case ui != nil:
+			readLine = ui.readLine
+		case pe != nil:
+			readLine = pe.readLine
+		}
 		for {
 			select {
 			case <-shutdown:
 				return
 			default:
-				showPrompt(username)
-				if !scanner.Scan() {
-					close(shutdown)
+				prompt()
+				text, ok := readLine()
+				if !ok {
+					stop()
 					return
 				}
 
-				text := scanner.Text()
-				// Send typing indicator for non-commands
-				if len(text) > 0 && !strings.HasPrefix(text, "/") {
-					conn.Write([]byte("TYPING:" + username))
+				// Send typing indicator for non-commands (people only; the full-screen
+				// interface sends it as they type)
+				if len(text) > 0 && !strings.HasPrefix(text, "/") && ui == nil && opts.interactive && !opts.jsonMode {
+					// Typing indicators are cheap to lose, so skip the reliable link
+					session.sendUnreliable(newPacket(msgTyping))
 					time.Sleep(100 * time.Millisecond) // Debounce
 				}
 
 				// Handle commands
 				switch {
-				case text == "/quit":
-					conn.Write([]byte("QUIT:" + username))
-					close(shutdown)
+				case text == "":
+				case text == "/quit" || text == "/shutdown":
+					pkt, _ := parseCommand(text)
+					send(pkt)
+					if cc := session.current(); cc != nil {
+						cc.link.flush(2 * time.Second) // Give the goodbye a chance to be acknowledged
+					}
+					stop()
 					return
-				case text == "/help":
-					cmd := showInteractiveHelp(username == "admin")
-					if cmd != "" {
-						conn.Write([]byte(cmd))
+				case text == "/help" && ui == nil && opts.interactive && !opts.jsonMode: // Scripts get the server's help instead
+					if pe != nil {
+						pe.suspend() // The menu reads whole lines
 					}
-				case text == "/menu" && username == "admin":
-					conn.Write([]byte("/menu"))
-				case strings.HasPrefix(text, "/rename "):
-					newName := strings.TrimPrefix(text, "/rename ")
-					conn.Write([]byte("RENAME:" + newName))
-				case text == "/users":
-					conn.Write([]byte("/users"))
-				case text == "/stats":
-					conn.Write([]byte("/stats"))
-				case strings.HasPrefix(text, "/whisper "):
-					parts := strings.SplitN(strings.TrimPrefix(text, "/whisper "), " ", 2)
-					if len(parts) == 2 {
-						conn.Write([]byte("WHISPER:" + parts[0] + ":" + parts[1]))
-					} else {
-						fmt.Println("\033[31mUsage: /whisper username message\033[0m")
+					pkt, ok := showInteractiveHelp(privileged.Load(), opts.plain)
+					if pe != nil {
+						pe.resume()
+					}
+					if ok {
+						if pkt.kind == msgWhisper {
+							pkt = whispers.queue(pkt.field(0), pkt.field(1)) // Encrypted once the key arrives
+						}
+						send(pkt)
 					}
-				case strings.HasPrefix(text, "/kick ") && username == "admin":
-					target := strings.TrimPrefix(text, "/kick ")
-					conn.Write([]byte("KICK:" + target))
-				case strings.HasPrefix(text, "/broadcast ") && username == "admin":
-					msg := strings.TrimPrefix(text, "/broadcast ")
-					conn.Write([]byte("BROADCAST:" + msg))
-				case text == "/shutdown" && username == "admin":
-					conn.Write([]byte("SHUTDOWN:"))
-					close(shutdown)
-					return
 				default:
-					if strings.HasPrefix(text, "/") {
-						fmt.Println("\033[31mInvalid command. Type /help for available commands\033[0m")
-					} else {
-						conn.Write([]byte(text))
+					pkt, err := parseCommand(text)
+					if err != nil {
+						notify(eventError, err.Error())
+						continue
+					}
+					if pkt.kind == msgWhisper {
+						pkt = whispers.queue(pkt.field(0), pkt.field(1)) // Encrypted once the key arrives
+					}
+					if err := send(pkt); err != nil {
+						notify(eventError, fmt.Sprintf("Message not sent: %v", err))
 					}
 				}
 			}
 		}
 	}()
 
-	wg.Wait() // Wait for both goroutines to finish
-	fmt.Println("\033[33mDisconnected from server\033[0m")
-}
+	// Goroutine 3: Retransmit unacknowledged packets and send heartbeats
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(retransmitTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-shutdown:
+				return
+			case now := <-ticker.C:
+				if cc := session.current(); cc != nil {
+					if cc.link.retransmit(now) > 0 {
+						cc.conn.Close() // Stalled: the reader reconnects with a fresh link
+						continue
+					}
+					cc.keepAlive(now)
+				}
+			}
+		}
+	}()
 
-// printHelp shows the static help message (fallback)
-func printHelp(isAdmin bool) {
-	help := `
-\033[1mAvailable Commands:\033[0m
-/help               - Show this help message
-/users              - List online users
-/stats              - Show server statistics
-/quit               - Exit the chat
-/rename <newname>   - Change your username
-/whisper <user> <msg> - Send private message
-`
-
-	if isAdmin {
-		help += `
-\033[1mAdmin Commands:\033[0m
-/menu               - Show admin menu
-/kick <username>    - Remove a user
-/broadcast <msg>    - Server announcement
-/shutdown           - Shutdown server
-`
+	wg.Wait() // Wait for all goroutines to finish
+	if ui != nil {
+		log.SetOutput(os.Stderr)
+		ui.close()
+	}
+	if pe != nil {
+		pe.close()
+	}
+	if !opts.jsonMode {
+		fmt.Println(paint(th.notice, "Disconnected from server"))
 	}
-	fmt.Println(help)
 }
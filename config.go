@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"         // For reading the config file strictly
+	"encoding/json" // For the config file format
+	"errors"        // For collecting validation errors
+	"flag"          // For command line overrides
+	"fmt"           // For error messages
+	"net"           // For checking listen addresses
+	"os"            // For reading the config file
+	"time"          // For durations
+)
+
+const (
+	defaultConfigFile    = "gochat.json" // Optional server settings, relative to the working directory
+	defaultMessageBuffer = 100           // Batches of events waiting to be sent before senders block
+	maxMOTDLength        = 4096          // Longest message of the day, in bytes
+)
+
+// serverConfig holds the server's settings. Built-in defaults are overridden
+// by the config file, which is overridden by command line flags.
+type serverConfig struct {
+	UDP string `json:"udp"` // Listen addresses; "" turns a listener off
+	TCP string `json:"tcp"`
+	WS  string `json:"ws"`
+	IRC string `json:"irc"`
+
+	Heartbeat       duration `json:"heartbeat"`        // How often clients send a heartbeat
+	HeartbeatMisses int      `json:"heartbeat_misses"` // Heartbeats missed before a client is dropped
+	AwayAfter       duration `json:"away_after"`       // Idle time before a user is marked away (0: never)
+	LoginTimeout    duration `json:"login_timeout"`    // Time to answer the password challenge
+
+	MessageBuffer  int `json:"message_buffer"`   // Batches of events queued for sending
+	FragmentBuffer int `json:"fragment_buffer"`  // Bytes of partial long messages kept per client
+	MaxUsers       int `json:"max_users"`        // Logged-in users at once (0: no limit)
+	MaxMessageSize int `json:"max_message_size"` // Largest message a client may send, in bytes
+
+	MOTD    string `json:"motd"`     // Message of the day, shown on login
+	LogFile string `json:"log_file"` // Where the log goes ("" for stderr)
+
+	ShutdownDrain duration `json:"shutdown_drain"` // Countdown before shutting down (0: stop at once)
+}
+
+// defaultServerConfig returns the settings used when nothing says otherwise
+func defaultServerConfig() serverConfig {
+	return serverConfig{
+		UDP:             ":8080",
+		Heartbeat:       duration(defaultHeartbeat),
+		HeartbeatMisses: missedHeartbeats,
+		AwayAfter:       duration(defaultAwayAfter),
+		LoginTimeout:    duration(loginTimeout),
+		MessageBuffer:   defaultMessageBuffer,
+		FragmentBuffer:  defaultMaxBuffered,
+		MaxMessageSize:  defaultMaxMessageSize,
+		ShutdownDrain:   duration(defaultShutdownDrain),
+	}
+}
+
+// duration is a time.Duration written like "5s" or "15m", in flags and JSON
+type duration time.Duration
+
+func (d duration) String() string { return time.Duration(d).String() }
+
+// Set parses a flag value
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) { return json.Marshal(d.String()) }
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations are strings like \"30s\" or \"15m\"")
+	}
+	return d.Set(s)
+}
+
+// parseServerConfig reads the config file named by -config (gochat.json by
+// default, which may be missing) and applies the flags in args on top
+func parseServerConfig(args []string) (serverConfig, error) {
+	cfg := defaultServerConfig()
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	path := fs.String("config", defaultConfigFile, "JSON file with server settings (flags override it)")
+	fs.StringVar(&cfg.UDP, "udp", cfg.UDP, "UDP listen address (\"\" to disable)")
+	fs.StringVar(&cfg.TCP, "tcp", cfg.TCP, "TCP listen address, e.g. :8081 (\"\" to disable)")
+	fs.StringVar(&cfg.WS, "ws", cfg.WS, "HTTP address for the web chat and its WebSocket, e.g. :8082 (\"\" to disable)")
+	fs.StringVar(&cfg.IRC, "irc", cfg.IRC, "TCP address for IRC clients, e.g. :6667 (\"\" to disable)")
+	fs.Var(&cfg.Heartbeat, "heartbeat", "how often clients send a heartbeat")
+	fs.IntVar(&cfg.HeartbeatMisses, "heartbeat-misses", cfg.HeartbeatMisses, "heartbeats a client may miss before it is dropped")
+	fs.Var(&cfg.AwayAfter, "away-after", "idle time before a user is marked away (0 to never)")
+	fs.Var(&cfg.LoginTimeout, "login-timeout", "time to answer the password challenge")
+	fs.IntVar(&cfg.MessageBuffer, "message-buffer", cfg.MessageBuffer, "batches of events queued for sending")
+	fs.IntVar(&cfg.FragmentBuffer, "fragment-buffer", cfg.FragmentBuffer, "bytes of partial long messages kept per client")
+	fs.IntVar(&cfg.MaxUsers, "max-users", cfg.MaxUsers, "users logged in at once (0 for no limit)")
+	fs.IntVar(&cfg.MaxMessageSize, "max-message-size", cfg.MaxMessageSize, "largest message a client may send, in bytes")
+	fs.StringVar(&cfg.MOTD, "motd", cfg.MOTD, "message of the day, shown on login")
+	fs.StringVar(&cfg.LogFile, "log", cfg.LogFile, "log file (default: stderr)")
+	fs.Var(&cfg.ShutdownDrain, "shutdown-drain", "countdown users get before a shutdown (0 to stop at once)")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	// The flags are parsed before the file they name is read: start again from
+	// the file and set the flags that were given once more
+	given := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = f.Value.String() })
+	cfg = defaultServerConfig()
+	if err := cfg.load(*path, given["config"] != ""); err != nil {
+		return cfg, err
+	}
+	for name, value := range given {
+		fs.Set(name, value) // Parsed fine the first time
+	}
+	return cfg, cfg.validate()
+}
+
+// load overrides settings with those in the JSON file at path. A missing file
+// is only an error when it was asked for by name.
+func (c *serverConfig) load(path string, required bool) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields() // Catch misspelled settings
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// validate reports every setting that is out of range
+func (c serverConfig) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.UDP != "" || c.TCP != "" || c.WS != "" || c.IRC != "", "nothing to listen on: set udp, tcp, ws and/or irc")
+	for _, l := range []struct{ name, addr string }{{"udp", c.UDP}, {"tcp", c.TCP}, {"ws", c.WS}, {"irc", c.IRC}} {
+		if l.addr != "" {
+			_, _, err := net.SplitHostPort(l.addr)
+			check(err == nil, "%s: %q is not a listen address like :8080", l.name, l.addr)
+		}
+	}
+	check(time.Duration(c.Heartbeat) >= 100*time.Millisecond, "heartbeat must be at least 100ms")
+	check(c.HeartbeatMisses >= 1, "heartbeat_misses must be at least 1")
+	check(c.AwayAfter >= 0, "away_after cannot be negative")
+	check(time.Duration(c.LoginTimeout) >= time.Second, "login_timeout must be at least 1s")
+	check(c.MessageBuffer >= 1, "message_buffer must be at least 1")
+	check(c.MaxUsers >= 0, "max_users cannot be negative")
+	check(c.MaxMessageSize >= 1024, "max_message_size must be at least 1024 bytes")
+	check(c.FragmentBuffer >= c.MaxMessageSize, "fragment_buffer must hold at least one message of max_message_size")
+	check(len(c.MOTD) <= maxMOTDLength, "motd is limited to %d bytes", maxMOTDLength)
+	check(c.ShutdownDrain >= 0, "shutdown_drain cannot be negative")
+	return errors.Join(errs...)
+}
+
+// configure applies cfg to a server that has not started yet
+func (s *Server) configure(cfg serverConfig) {
+	s.messages = make(chan outbatch, cfg.MessageBuffer)
+	s.apply(cfg)
+}
+
+// apply sets the limits and timeouts that may change while the server runs
+// (caller holds s.mu once it has started)
+func (s *Server) apply(cfg serverConfig) {
+	s.heartbeat, s.heartbeatMisses = time.Duration(cfg.Heartbeat), cfg.HeartbeatMisses
+	s.awayAfter, s.loginTimeout = time.Duration(cfg.AwayAfter), time.Duration(cfg.LoginTimeout)
+	s.maxBuffered, s.maxUsers, s.maxMessageSize = cfg.FragmentBuffer, cfg.MaxUsers, cfg.MaxMessageSize
+	s.motd, s.shutdownDrain = cfg.MOTD, time.Duration(cfg.ShutdownDrain)
+	s.config = cfg
+}
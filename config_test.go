@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerConfigFlagsOverrideFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gochat.json")
+	os.WriteFile(path, []byte(`{"tcp": ":9001", "max_users": 10, "heartbeat": "2s", "motd": "hi"}`), 0o600)
+
+	cfg, err := parseServerConfig([]string{"-config", path, "-max-users", "3", "-udp", ""})
+	if err != nil {
+		t.Fatalf("parseServerConfig: %v", err)
+	}
+	want := defaultServerConfig()
+	want.UDP, want.TCP, want.MaxUsers, want.Heartbeat, want.MOTD = "", ":9001", 3, duration(2*time.Second), "hi"
+	if cfg != want {
+		t.Errorf("config = %+v, want %+v", cfg, want)
+	}
+}
+
+func TestServerConfigRejectsBadSettings(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := parseServerConfig([]string{"-config", filepath.Join(dir, "missing.json")}); err == nil {
+		t.Error("missing config file accepted")
+	}
+
+	path := filepath.Join(dir, "gochat.json")
+	os.WriteFile(path, []byte(`{"max_user": 10}`), 0o600)
+	if _, err := parseServerConfig([]string{"-config", path}); err == nil || !strings.Contains(err.Error(), "max_user") {
+		t.Errorf("unknown key: err = %v", err)
+	}
+
+	os.WriteFile(path, []byte(`{"heartbeat": 5}`), 0o600)
+	if _, err := parseServerConfig([]string{"-config", path}); err == nil {
+		t.Error("numeric duration accepted")
+	}
+
+	// Every problem is reported at once
+	os.WriteFile(path, []byte(`{}`), 0o600)
+	_, err := parseServerConfig([]string{"-config", path, "-udp", "", "-heartbeat", "10ms", "-max-message-size", "999999"})
+	for _, want := range []string{"nothing to listen on", "heartbeat", "fragment_buffer"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want it to mention %q", err, want)
+		}
+	}
+}
+
+func TestMaxUsersAndMOTD(t *testing.T) {
+	cfg := defaultServerConfig()
+	cfg.MaxUsers, cfg.MOTD = 1, "Welcome to the test server"
+	s := newServer()
+	s.configure(cfg)
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	alice := mem.dial("alice")
+	waitForText(t, alice, testRegister(t, alice, "alice"), cfg.MOTD)
+
+	bob := mem.dial("bob")
+	channel, err := clientHandshake(bob, "localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register := Packet{kind: msgRegister, fields: [][]byte{[]byte("bob"), nil, nil, []byte(eventFormatJSON)}}
+	testSend(t, bob, channel, register, 1)
+	if ev := waitForEvent(t, bob, channel, eventError); !strings.HasPrefix(ev.Text, "Server is full") {
+		t.Errorf("error = %q, want server full", ev.Text)
+	}
+}
+
+func TestSmallestMessageBufferKeepsServing(t *testing.T) {
+	s := newServer()
+	cfg := defaultServerConfig()
+	cfg.MessageBuffer = 1 // Less than one /join queues
+	s.configure(cfg)
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	bob := mem.dial("bob")
+	testRegisterJSON(t, bob, "bob")
+	alice := mem.dial("alice")
+	channel := testRegisterJSON(t, alice, "alice")
+	seq := uint32(1)
+	for i := 0; i < 20; i++ {
+		seq++
+		testSend(t, alice, channel, newPacket(msgJoin, fmt.Sprintf("room%d", i%3)), seq)
+	}
+	// Every join was handled (alice never acknowledges, so her events stop
+	// once her send window is full)
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		room := "?"
+		if s.mu.TryRLock() { // Not RLock: a server stuck holding the lock must fail, not hang
+			room = s.findClient("alice").room
+			s.mu.RUnlock()
+		}
+		if room == "room1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("alice is in #%s after 20 joins, want #room1", room)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"      // For usage errors
+	"log"         // For logging dropped packets
+	"net"         // For the connection to the server
+	"strconv"     // For the heartbeat interval
+	"strings"     // For parsing commands
+	"sync/atomic" // For liveness state shared between goroutines
+	"time"        // For reassembly timeouts
+)
+
+// clientConn is the client end of a session with the server: the secure
+// channel plus the reliable link and fragmentation on top of it. The terminal
+// client and the gateways all talk to the server through one.
+type clientConn struct {
+	conn    net.Conn
+	channel *secureChannel
+	link    *reliableLink
+	frag    *fragmenter
+	tracker *fragmentTracker // Reports long messages once, not per fragment
+	reasm   *reassembler
+	heard   atomic.Int64 // When the server last sent anything authentic (Unix nanoseconds)
+	beat    atomic.Int64 // Heartbeat interval the server asked for (nanoseconds)
+	beaten  time.Time    // When keepAlive last sent a heartbeat
+}
+
+// newClientConn wraps conn, whose handshake produced channel
+func newClientConn(conn net.Conn, channel *secureChannel) *clientConn {
+	c := &clientConn{
+		conn:    conn,
+		channel: channel,
+		frag:    newFragmenter(defaultMTU - sealedOverhead),
+		tracker: newFragmentTracker(),
+		reasm:   newReassembler(defaultMaxMessageSize, defaultMaxBuffered),
+	}
+	// Reliable link to the server: everything except typing indicators is acknowledged
+	c.link = newReliableLink(func(data []byte) error {
+		sealed, err := channel.seal(data)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(sealed)
+		return err
+	})
+	c.link.setToken(channel.token)
+	c.heard.Store(time.Now().UnixNano())
+	c.beat.Store(int64(defaultHeartbeat))
+	return c
+}
+
+// lastHeard returns when the server last sent something
+func (c *clientConn) lastHeard() time.Time {
+	return time.Unix(0, c.heard.Load())
+}
+
+// heartbeat returns how often the server wants to hear from the client
+func (c *clientConn) heartbeat() time.Duration {
+	return time.Duration(c.beat.Load())
+}
+
+// silent reports whether the server has missed so many heartbeats that it is
+// presumably gone (each one is echoed, so a live server is never quiet for long)
+func (c *clientConn) silent(now time.Time) bool {
+	return now.Sub(c.lastHeard()) >= c.heartbeat()*missedHeartbeats
+}
+
+// keepAlive sends a heartbeat when one is due, telling the server the client
+// is still there even when its user is only reading. Call it regularly from one
+// goroutine, e.g. alongside retransmit.
+func (c *clientConn) keepAlive(now time.Time) {
+	if now.Sub(c.beaten) < c.heartbeat() {
+		return
+	}
+	c.beaten = now
+	c.sendUnreliable(newPacket(msgHeartbeat)) // Cheap to lose: another follows
+}
+
+// send reliably sends a packet to the server, fragmenting it if it exceeds the MTU
+func (c *clientConn) send(pkt Packet) error {
+	frags, err := c.frag.split(pkt)
+	if err != nil {
+		return err
+	}
+	c.tracker.track(frags)
+	for _, f := range frags {
+		if _, err := c.link.send(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendUnreliable seals and sends a packet that is cheap to lose (e.g. typing)
+func (c *clientConn) sendUnreliable(pkt Packet) error {
+	data, err := encodePacket(pkt.withToken(c.channel.token))
+	if err != nil {
+		return err
+	}
+	sealed, err := c.channel.seal(data)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(sealed)
+	return err
+}
+
+// receive turns one datagram from the server into zero or more in-order application packets
+func (c *clientConn) receive(data []byte) []Packet {
+	outer, err := decodePacket(data)
+	if err != nil {
+		log.Println("Dropped malformed packet:", err)
+		return nil
+	}
+	if outer.kind != msgSealed {
+		return nil // Unencrypted packets could come from anyone
+	}
+	inner, _, err := c.channel.open(outer) // Decrypts into a fresh buffer, so fields outlive data
+	if err != nil {
+		return nil // Forged or replayed
+	}
+	c.heard.Store(time.Now().UnixNano()) // Only the server can seal for us
+	pkt, err := decodePacket(inner)
+	if err != nil {
+		log.Println("Dropped malformed packet:", err)
+		return nil
+	}
+	if pkt.kind == msgAck {
+		c.link.handleAck(pkt)
+		return nil
+	}
+	if pkt.kind == msgHeartbeat {
+		return nil // Its arrival was all it had to say
+	}
+	ready := []Packet{pkt}
+	if pkt.flags&flagReliable != 0 {
+		ready = c.link.receive(pkt) // Acknowledge and restore order
+	}
+	var out []Packet
+	for _, pkt := range ready {
+		if pkt.kind == msgFragment {
+			data, err := c.reasm.add(pkt, time.Now())
+			if err != nil {
+				log.Println("Dropped fragment:", err)
+			}
+			if data == nil {
+				continue // Waiting for more fragments
+			}
+			if pkt, err = decodePacket(data); err != nil {
+				log.Println("Dropped reassembled packet:", err)
+				continue
+			}
+		}
+		if pkt.kind == msgWelcome {
+			if ms, err := strconv.Atoi(pkt.field(4)); err == nil && ms > 0 {
+				c.beat.Store(int64(time.Duration(ms) * time.Millisecond))
+			}
+		}
+		out = append(out, pkt)
+	}
+	return out
+}
+
+// loginError is an error message from the server that ended a login
+// (e.g. the name is taken or the password was wrong)
+type loginError struct {
+	text string
+}
+
+func (e *loginError) Error() string { return e.text }
+
+var errNoWelcome = errors.New("no response from server")
+
+// awaitWelcome reads from the server until the registration already sent is
+// welcomed, answering a password challenge with answer, and returns the welcome
+// plus any packets that arrived before it. If answer fails, the login is
+// abandoned and its error returned.
+func (c *clientConn) awaitWelcome(timeout time.Duration, answer func(challenge Packet) (Packet, error)) (Packet, []Packet, error) {
+	defer c.conn.SetReadDeadline(time.Time{})
+	var backlog []Packet
+	buf := make([]byte, maxDatagramSize)
+	deadline := time.Now().Add(timeout)
+	for {
+		if time.Now().After(deadline) {
+			return Packet{}, nil, errNoWelcome
+		}
+		c.conn.SetReadDeadline(time.Now().Add(retransmitTick))
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				c.link.retransmit(time.Now())
+				continue
+			}
+			return Packet{}, nil, err
+		}
+		var welcome *Packet
+		for _, pkt := range c.receive(buf[:n]) {
+			switch {
+			case welcome != nil:
+				backlog = append(backlog, pkt) // Arrived with the welcome
+			case pkt.kind == msgChallenge && len(pkt.fields) == 4 && len(pkt.fields[0]) == tokenSize:
+				auth, err := answer(pkt)
+				if err != nil {
+					c.send(newPacket(msgQuit))
+					c.link.flush(time.Second)
+					return Packet{}, nil, err
+				}
+				c.send(auth)
+				deadline = time.Now().Add(timeout) // Typing the password took a while
+			case pkt.kind == msgWelcome && len(pkt.fields) >= 4 && len(pkt.fields[0]) == tokenSize:
+				welcome = &pkt
+			case pkt.kind == msgError:
+				return Packet{}, nil, &loginError{pkt.field(0)}
+			case pkt.kind == msgEvent:
+				if ev, err := decodeEvent(pkt); err == nil && ev.Type == eventError {
+					return Packet{}, nil, &loginError{ev.Text} // The same in JSON mode
+				}
+				backlog = append(backlog, pkt)
+			default:
+				backlog = append(backlog, pkt)
+			}
+		}
+		if welcome != nil {
+			return *welcome, backlog, nil
+		}
+	}
+}
+
+// commandNames are the commands parseCommand understands, for tab completion
+var commandNames = []string{
+	"/away", "/back", "/broadcast", "/busy", "/grant", "/help", "/history", "/join", "/kick", "/leave", "/menu",
+	"/mute", "/quit", "/reload", "/rename", "/revoke", "/rooms", "/shutdown", "/stats", "/status", "/topic",
+	"/unmute", "/users", "/whisper",
+}
+
+// userCommands are the commands whose first argument is a username
+var userCommands = []string{"/whisper", "/kick", "/mute", "/unmute", "/grant", "/revoke"}
+
+// parseCommand turns a non-empty line typed by a user into the packet to send;
+// lines without a leading slash are chat. A whisper comes back as a msgWhisper
+// packet holding the plaintext, for the caller to encrypt once the key arrives.
+func parseCommand(text string) (Packet, error) {
+	switch {
+	case !strings.HasPrefix(text, "/"):
+		return newPacket(msgChat, text), nil
+	case text == "/quit":
+		return newPacket(msgQuit), nil
+	case text == "/help":
+		return newPacket(msgHelp), nil
+	case text == "/menu":
+		return newPacket(msgMenu), nil
+	case strings.HasPrefix(text, "/rename "):
+		return newPacket(msgRename, strings.TrimPrefix(text, "/rename ")), nil
+	case text == "/users":
+		return newPacket(msgUsers), nil
+	case strings.HasPrefix(text, "/join "):
+		return newPacket(msgJoin, strings.TrimPrefix(text, "/join ")), nil
+	case text == "/leave":
+		return newPacket(msgLeave), nil
+	case text == "/rooms":
+		return newPacket(msgRooms), nil
+	case text == "/topic" || strings.HasPrefix(text, "/topic "):
+		return newPacket(msgTopic, strings.TrimSpace(strings.TrimPrefix(text, "/topic"))), nil
+	case text == "/history" || strings.HasPrefix(text, "/history "):
+		n := strings.TrimSpace(strings.TrimPrefix(text, "/history"))
+		if n == "" {
+			n = "50"
+		}
+		return newPacket(msgHistory, n), nil
+	case text == "/stats":
+		return newPacket(msgStats), nil
+	case text == "/away" || strings.HasPrefix(text, "/away "):
+		return newPacket(msgPresence, presenceAway, strings.TrimSpace(strings.TrimPrefix(text, "/away"))), nil
+	case text == "/busy" || strings.HasPrefix(text, "/busy "):
+		return newPacket(msgPresence, presenceBusy, strings.TrimSpace(strings.TrimPrefix(text, "/busy"))), nil
+	case text == "/back":
+		return newPacket(msgPresence, presenceOnline, ""), nil
+	case text == "/status" || strings.HasPrefix(text, "/status "):
+		return newPacket(msgStatus, strings.TrimSpace(strings.TrimPrefix(text, "/status"))), nil
+	case strings.HasPrefix(text, "/whisper "):
+		parts := strings.SplitN(strings.TrimPrefix(text, "/whisper "), " ", 2)
+		if len(parts) != 2 {
+			return Packet{}, errors.New("Usage: /whisper username message")
+		}
+		return newPacket(msgWhisper, parts[0], parts[1]), nil
+	case strings.HasPrefix(text, "/kick "):
+		return newPacket(msgKick, strings.TrimPrefix(text, "/kick ")), nil
+	case strings.HasPrefix(text, "/broadcast "):
+		return newPacket(msgBroadcast, strings.TrimPrefix(text, "/broadcast ")), nil
+	case strings.HasPrefix(text, "/mute "):
+		return newPacket(msgMute, strings.TrimPrefix(text, "/mute ")), nil
+	case strings.HasPrefix(text, "/unmute "):
+		return newPacket(msgUnmute, strings.TrimPrefix(text, "/unmute ")), nil
+	case strings.HasPrefix(text, "/grant "):
+		parts := strings.Fields(strings.TrimPrefix(text, "/grant "))
+		if len(parts) != 2 {
+			return Packet{}, errors.New("Usage: /grant username role")
+		}
+		return newPacket(msgGrant, parts[0], parts[1]), nil
+	case strings.HasPrefix(text, "/revoke "):
+		return newPacket(msgRevoke, strings.TrimPrefix(text, "/revoke ")), nil
+	case text == "/shutdown":
+		return newPacket(msgShutdown), nil
+	case text == "/reload":
+		return newPacket(msgReload), nil
+	}
+	return Packet{}, errors.New("Invalid command. Type /help for available commands")
+}
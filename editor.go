@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"         // For reading keys and the history file
+	"fmt"           // For drawing the prompt
+	"io"            // For the terminal output
+	"os"            // For the history file and the terminal
+	"path/filepath" // For the history file's directory
+	"slices"        // For editing the input line
+	"strconv"       // For parsing the terminal size
+	"strings"       // For matching completions
+	"sync"          // For drawing from several goroutines
+	"unicode"       // For control keys
+	"unicode/utf8"  // For telling typed characters from keys
+)
+
+const (
+	historyFile = "history" // Lines typed in earlier sessions, in configDir
+	maxHistory  = 1000      // Lines kept in the history file
+)
+
+// Keys readKey returns besides typed characters
+const (
+	keyEnter     = "enter"
+	keyBackspace = "backspace"
+	keyDelete    = "delete"
+	keyLeft      = "left"
+	keyRight     = "right"
+	keyUp        = "up"
+	keyDown      = "down"
+	keyHome      = "home"
+	keyEnd       = "end"
+	keyPageUp    = "pgup"
+	keyPageDown  = "pgdn"
+	keyTab       = "tab"
+	keyClear     = "ctrl-u"
+	keyRedraw    = "ctrl-l"
+	keyInterrupt = "ctrl-c"
+	keyEOF       = "ctrl-d"
+)
+
+// lineEditor is the input line of a terminal client: cursor movement,
+// history kept across sessions and tab completion of commands and usernames.
+// It only edits; the full-screen interface and promptEditor draw it.
+type lineEditor struct {
+	input  []rune
+	cursor int // Position in input
+
+	history  []string // Oldest first
+	histPos  int      // Line being shown while browsing, len(history) when not
+	draft    []rune   // What was typed before browsing started
+	histPath string   // File history is saved to, "" for none
+
+	users   func() []string // Names to complete
+	matches []string        // Completions Tab cycles through
+	match   int             // Index of the completion shown
+	word    int             // Where the completed word starts in input
+}
+
+// newLineEditor creates an editor with the history saved in histPath ("" keeps none)
+// and completion of the names users returns (nil for none)
+func newLineEditor(histPath string, users func() []string) *lineEditor {
+	e := &lineEditor{histPath: histPath, users: users}
+	if histPath != "" {
+		e.history = loadHistory(histPath)
+	}
+	e.histPos = len(e.history)
+	return e
+}
+
+// defaultHistoryPath is where the terminal client keeps its input history
+func defaultHistoryPath() string {
+	return filepath.Join(configDir(), historyFile)
+}
+
+// loadHistory reads a history file, trimming it if it grew past maxHistory
+func loadHistory(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil // No history yet
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > maxHistory {
+		lines = lines[len(lines)-maxHistory:]
+		os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+	}
+	return lines
+}
+
+// remember adds a line to the history, and to the history file
+func (e *lineEditor) remember(line string) {
+	if n := len(e.history); n > 0 && e.history[n-1] == line {
+		return // Repeating a line doesn't fill the history with it
+	}
+	e.history = append(e.history, line)
+	if e.histPath == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(e.histPath), 0o700); err != nil {
+		return
+	}
+	f, err := os.OpenFile(e.histPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600) // Whispers are private
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+// key applies one key to the line. It returns the line when Enter submits it,
+// or quit for Ctrl-C, and Ctrl-D on an empty line.
+func (e *lineEditor) key(k string) (line string, submit, quit bool) {
+	if k != keyTab {
+		e.matches = nil // Any other key accepts the completion shown
+	}
+	switch k {
+	case "":
+	case keyEnter:
+		if len(e.input) == 0 {
+			return "", false, false
+		}
+		line = string(e.input)
+		e.remember(line)
+		e.input, e.cursor, e.histPos, e.draft = nil, 0, len(e.history), nil
+		return line, true, false
+	case keyInterrupt:
+		return "", false, true
+	case keyEOF:
+		if len(e.input) == 0 {
+			return "", false, true
+		}
+		fallthrough
+	case keyDelete:
+		if e.cursor < len(e.input) {
+			e.input = slices.Delete(e.input, e.cursor, e.cursor+1)
+		}
+	case keyBackspace:
+		if e.cursor > 0 {
+			e.input = slices.Delete(e.input, e.cursor-1, e.cursor)
+			e.cursor--
+		}
+	case keyLeft:
+		e.cursor = max(0, e.cursor-1)
+	case keyRight:
+		e.cursor = min(len(e.input), e.cursor+1)
+	case keyHome:
+		e.cursor = 0
+	case keyEnd:
+		e.cursor = len(e.input)
+	case keyClear:
+		e.input, e.cursor = nil, 0
+	case keyUp:
+		if e.histPos > 0 {
+			if e.histPos == len(e.history) {
+				e.draft = e.input
+			}
+			e.histPos--
+			e.show([]rune(e.history[e.histPos]))
+		}
+	case keyDown:
+		if e.histPos < len(e.history) {
+			e.histPos++
+			if e.histPos == len(e.history) {
+				e.show(e.draft)
+			} else {
+				e.show([]rune(e.history[e.histPos]))
+			}
+		}
+	case keyTab:
+		e.complete()
+	default:
+		if r, _ := utf8.DecodeRuneInString(k); len(k) == utf8.RuneLen(r) { // A typed character
+			e.input = slices.Insert(e.input, e.cursor, r)
+			e.cursor++
+		}
+	}
+	return "", false, false
+}
+
+// show replaces the line with text, cursor at the end
+func (e *lineEditor) show(text []rune) {
+	e.input = slices.Clone(text)
+	e.cursor = len(e.input)
+}
+
+// complete completes the word before the cursor: a command at the start of
+// the line, a username after commands that take one, or an @mention.
+// Ambiguous words are completed as far as they go; pressing Tab again then
+// cycles through the candidates.
+func (e *lineEditor) complete() {
+	if len(e.matches) > 0 { // Next candidate
+		e.match = (e.match + 1) % len(e.matches)
+		e.replaceWord(e.matches[e.match], false)
+		return
+	}
+	e.word = e.cursor
+	for e.word > 0 && e.input[e.word-1] != ' ' {
+		e.word--
+	}
+	word := string(e.input[e.word:e.cursor])
+	before := strings.Fields(string(e.input[:e.word]))
+
+	var candidates []string
+	switch {
+	case len(before) == 0 && strings.HasPrefix(word, "/"):
+		candidates = commandNames
+	case len(before) == 1 && slices.Contains(userCommands, before[0]):
+		candidates = e.names("")
+	case strings.HasPrefix(word, "@"):
+		candidates = e.names("@")
+	default:
+		return
+	}
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(strings.ToLower(c), strings.ToLower(word)) {
+			matches = append(matches, c)
+		}
+	}
+	switch {
+	case len(matches) == 1:
+		e.replaceWord(matches[0], true)
+	case len(matches) > 1:
+		if prefix := commonPrefix(matches); len(prefix) > len(word) {
+			e.replaceWord(prefix, false)
+			return
+		}
+		e.matches, e.match = matches, 0
+		e.replaceWord(matches[0], false)
+	}
+}
+
+// names returns the usernames to complete, each with prefix
+func (e *lineEditor) names(prefix string) []string {
+	if e.users == nil {
+		return nil
+	}
+	var names []string
+	for _, name := range e.users() {
+		names = append(names, prefix+name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// replaceWord puts text in place of the word being completed, with a space
+// after it if it is final
+func (e *lineEditor) replaceWord(text string, final bool) {
+	end := e.cursor
+	if final && (end == len(e.input) || e.input[end] != ' ') {
+		text += " "
+	}
+	e.input = slices.Concat(e.input[:e.word], []rune(text), e.input[end:])
+	e.cursor = e.word + len([]rune(text))
+}
+
+// commonPrefix returns the longest prefix all of words share
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for !utf8.ValidString(prefix) { // Don't split a character
+		prefix = prefix[:len(prefix)-1]
+	}
+	return prefix
+}
+
+// window returns the part of the line that fits in width columns with the
+// cursor in view, and the column of the cursor within it
+func (e *lineEditor) window(width int) (string, int) {
+	start := e.cursor
+	for cols := 0; start > 0 && cols+runeWidth(e.input[start-1]) < width; start-- {
+		cols += runeWidth(e.input[start-1])
+	}
+	visible := wrap(string(e.input[start:]), width)[0]
+	return visible, textWidth(string(e.input[start:e.cursor]))
+}
+
+// readKey reads one key press: a character or one of the key constants
+func readKey(in *bufio.Reader) (string, error) {
+	r, _, err := in.ReadRune()
+	if err != nil {
+		return "", err
+	}
+	switch r {
+	case '\r', '\n':
+		return keyEnter, nil
+	case 0x7f, 0x08:
+		return keyBackspace, nil
+	case '\t':
+		return keyTab, nil
+	case 0x01: // Ctrl-A
+		return keyHome, nil
+	case 0x05: // Ctrl-E
+		return keyEnd, nil
+	case 0x03:
+		return keyInterrupt, nil
+	case 0x04:
+		return keyEOF, nil
+	case 0x0c:
+		return keyRedraw, nil
+	case 0x15:
+		return keyClear, nil
+	case 0x1b:
+		return readEscape(in)
+	}
+	if unicode.IsControl(r) {
+		return "", nil
+	}
+	return string(r), nil
+}
+
+// readEscape reads the rest of an escape sequence sent by a special key
+func readEscape(in *bufio.Reader) (string, error) {
+	b, err := in.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return "", err // Alt+key and the like are ignored
+	}
+	var seq []byte
+	for len(seq) < 16 {
+		c, err := in.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		seq = append(seq, c)
+		if c >= 0x40 && c <= 0x7e { // Final byte
+			break
+		}
+	}
+	switch string(seq) {
+	case "A":
+		return keyUp, nil
+	case "B":
+		return keyDown, nil
+	case "C":
+		return keyRight, nil
+	case "D":
+		return keyLeft, nil
+	case "H", "1~", "7~":
+		return keyHome, nil
+	case "F", "4~", "8~":
+		return keyEnd, nil
+	case "3~":
+		return keyDelete, nil
+	case "5~":
+		return keyPageUp, nil
+	case "6~":
+		return keyPageDown, nil
+	}
+	return "", nil
+}
+
+// terminalSize returns the rows and columns of the terminal, 24x80 if unknown
+func terminalSize() (int, int) {
+	size, err := stty("size")
+	if err != nil {
+		return 24, 80
+	}
+	rows, cols, _ := strings.Cut(size, " ")
+	h, err1 := strconv.Atoi(rows)
+	w, err2 := strconv.Atoi(cols)
+	if err1 != nil || err2 != nil || h < 3 || w < 10 {
+		return 24, 80
+	}
+	return h, w
+}
+
+// promptEditor runs a lineEditor on the prompt line of the simple client,
+// with output from the server scrolling past above it
+type promptEditor struct {
+	mu     sync.Mutex
+	ed     *lineEditor
+	in     *bufio.Reader
+	out    io.Writer
+	saved  string // stty settings restored on close
+	prompt string // Drawn before the line
+	width  int
+}
+
+// startPromptEditor puts the terminal in character mode for ed
+func startPromptEditor(ed *lineEditor) (*promptEditor, error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("terminal settings: %w", err)
+	}
+	// No line buffering, echo or signals (Ctrl-C is a key), but output is still translated
+	if _, err := stty("-icanon", "-echo", "-isig", "min", "1"); err != nil {
+		return nil, fmt.Errorf("character mode: %w", err)
+	}
+	_, width := terminalSize()
+	return &promptEditor{ed: ed, in: bufio.NewReader(os.Stdin), out: os.Stdout, saved: saved, width: width}, nil
+}
+
+// close restores the terminal
+func (p *promptEditor) close() {
+	stty(p.saved)
+}
+
+// suspend gives the terminal back for line-by-line input, until resume
+func (p *promptEditor) suspend() {
+	stty(p.saved)
+}
+
+// resume takes the terminal back after suspend
+func (p *promptEditor) resume() {
+	stty("-icanon", "-echo", "-isig", "min", "1")
+}
+
+// draw shows prompt followed by the line being edited
+func (p *promptEditor) draw(prompt string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prompt = prompt
+	p.redraw()
+}
+
+// redraw repaints the prompt line (caller holds p.mu)
+func (p *promptEditor) redraw() {
+	avail := p.width - textWidth(p.prompt) - 1
+	visible, col := p.ed.window(max(1, avail))
+	fmt.Fprintf(p.out, "\r\033[K%s%s", p.prompt, visible)
+	if back := textWidth(visible) - col; back > 0 {
+		fmt.Fprintf(p.out, "\033[%dD", back)
+	}
+}
+
+// print writes output from the server above the line being edited
+func (p *promptEditor) print(s string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.out, "\r\033[K%s\n", s)
+	p.redraw()
+}
+
+// readLine edits the line until Enter and returns it. It returns false when
+// the user quits with Ctrl-C, with Ctrl-D on an empty line or input ends.
+func (p *promptEditor) readLine() (string, bool) {
+	_, p.width = terminalSize()
+	for {
+		k, err := readKey(p.in)
+		if err != nil {
+			return "", false
+		}
+		p.mu.Lock()
+		if k == keyRedraw {
+			fmt.Fprint(p.out, "\033[H\033[2J")
+		}
+		line, submit, quit := p.ed.key(k)
+		if submit || quit {
+			fmt.Fprintf(p.out, "\r\033[K%s%s\n", p.prompt, line) // Leave the line as sent
+		} else {
+			p.redraw()
+		}
+		p.mu.Unlock()
+		switch {
+		case quit:
+			return "", false
+		case submit:
+			return line, true
+		}
+	}
+}
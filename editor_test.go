@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// typeKeys feeds keys to e, a character at a time unless bracketed like <tab>
+func typeKeys(e *lineEditor, keys string) (submitted []string) {
+	for keys != "" {
+		k := keys[:1]
+		if keys[0] == '<' {
+			end := strings.IndexByte(keys, '>')
+			k = keys[1:end]
+			keys = keys[end+1:]
+		} else {
+			keys = keys[1:]
+		}
+		if line, submit, _ := e.key(k); submit {
+			submitted = append(submitted, line)
+		}
+	}
+	return submitted
+}
+
+func TestLineEditorHistoryPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	first := newLineEditor(path, nil)
+	typeKeys(first, "one<enter>two<enter>two<enter>")
+
+	e := newLineEditor(path, nil)
+	typeKeys(e, "dr<up>")
+	if string(e.input) != "two" {
+		t.Fatalf("up = %q, want the last line of the previous session", string(e.input))
+	}
+	typeKeys(e, "<up><up>")
+	if string(e.input) != "one" {
+		t.Errorf("up twice more = %q, want \"one\" (repeats are kept once)", string(e.input))
+	}
+	typeKeys(e, "<down><down>")
+	if string(e.input) != "dr" || e.cursor != 2 {
+		t.Errorf("down to the end = %q, want the draft back", string(e.input))
+	}
+	if got := typeKeys(e, "<home>a<end>!<left><backspace><enter>"); len(got) != 1 || got[0] != "ad!" {
+		t.Errorf("edited line = %q, want \"ad!\"", got)
+	}
+}
+
+func TestLineEditorCompletion(t *testing.T) {
+	users := func() []string { return []string{"bob", "alice", "albert"} }
+	tests := []struct {
+		keys, want string
+	}{
+		{"/wh<tab>", "/whisper "},
+		{"/whisper b<tab>", "/whisper bob "},
+		{"/kick al<tab>", "/kick albert"},                      // Ambiguous: first candidate
+		{"/kick al<tab><tab>", "/kick alice"},                  // Tab again cycles
+		{"/kick al<tab><tab><tab>", "/kick albert"},            // and wraps around
+		{"thanks @Bo<tab>", "thanks @bob "},                    // Mentions, any case
+		{"/join b<tab>", "/join b"},                            // Rooms aren't users
+		{"/wh<tab>b<tab>hi<home><right>x", "/xwhisper bob hi"}, // Editing after completion
+	}
+	for _, tt := range tests {
+		e := newLineEditor("", users)
+		typeKeys(e, tt.keys)
+		if string(e.input) != tt.want {
+			t.Errorf("%s: line = %q, want %q", tt.keys, string(e.input), tt.want)
+		}
+	}
+}
+
+func TestCompletedCommandsParse(t *testing.T) {
+	for _, name := range commandNames {
+		_, err := parseCommand(name)
+		if err != nil {
+			_, err = parseCommand(name + " bob x")
+		}
+		if err != nil {
+			t.Errorf("%s completes but does not parse: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json" // For JSON-mode clients
+	"fmt"           // For size errors
+	"time"          // For event timestamps
+)
+
+// Event types. Clients that register in JSON mode get every event as a
+// msgEvent packet; everyone else gets it rendered as text.
+const (
+	eventChat         = "chat"         // sender said text in room
+	eventJoin         = "join"         // sender joined room
+	eventLeave        = "leave"        // sender left room (see reason)
+	eventRename       = "rename"       // sender is now called target
+	eventTopic        = "topic"        // room's topic is text (set by sender, if any)
+	eventTyping       = "typing"       // sender is typing in room
+	eventAnnouncement = "announcement" // text from sender to everyone
+	eventWhisper      = "whisper"      // end-to-end encrypted envelope from sender
+	eventHistory      = "history"      // earlier chat events of room
+	eventUserList     = "user_list"    // everyone online
+	eventRoomList     = "room_list"    // every room; room is the client's own
+	eventStats        = "stats"        // server statistics
+	eventPresence     = "presence"     // sender's presence, away message (text) and status (see reason)
+	eventSystem       = "system"       // any other notice, in text
+	eventError        = "error"        // something the client asked for failed
+)
+
+// Reasons for leaving a room
+const (
+	leaveQuit         = "quit"         // Left the chat with /quit
+	leaveMoved        = "moved"        // Went to the room named by target
+	leaveKicked       = "kicked"       // Kicked by target
+	leaveTimeout      = "timeout"      // Missed too many heartbeats
+	leaveDisconnected = "disconnected" // Connection closed
+)
+
+// Reasons for a presence event (none: the sender changed presence)
+const (
+	presenceIdle   = "idle"   // The server marked the sender away after idling, or back after it
+	presenceStatus = "status" // The sender changed their status text
+	presenceReply  = "reply"  // Sent to someone who whispered to the away or busy sender
+)
+
+// Reasons for a system event, which clients style as they like (none: a plain notice)
+const (
+	systemNotice = "notice" // Something another user did to the client's user, e.g. a mute
+	systemDone   = "done"   // Confirms the client's own command, e.g. a whisper sent
+	systemList   = "list"   // A heading line, then one entry per line, e.g. /help
+)
+
+// eventFormatJSON is the msgRegister option that asks for JSON events
+const eventFormatJSON = "json"
+
+// event is something for a client to show. IDs grow with every event, so
+// clients can tell a broadcast they already have from a new one.
+type event struct {
+	ID     uint64    `json:"id,omitempty"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"timestamp"`
+	Room   string    `json:"room,omitempty"`
+	Sender string    `json:"sender,omitempty"`
+	Role   string    `json:"role,omitempty"` // Sender's role
+	Target string    `json:"target,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Text   string    `json:"text,omitempty"`
+
+	Presence string `json:"presence,omitempty"` // Sender's presence (see presence.go)
+	Status   string `json:"status,omitempty"`   // Sender's status text
+
+	Users   []userInfo `json:"users,omitempty"`
+	Rooms   []roomInfo `json:"rooms,omitempty"`
+	Stats   *statsInfo `json:"stats,omitempty"`
+	History []event    `json:"history,omitempty"`
+
+	Key      []byte `json:"key,omitempty"`      // Whisper sender's ed25519 key
+	Envelope []byte `json:"envelope,omitempty"` // Whisper, as sealed by the sender (see whisper.go)
+}
+
+// userInfo describes one user in a user_list event
+type userInfo struct {
+	Name  string `json:"name"`
+	Room  string `json:"room"`
+	Role  string `json:"role"`
+	Muted bool   `json:"muted,omitempty"`
+
+	Presence string `json:"presence,omitempty"`
+	Away     string `json:"away_message,omitempty"`
+	Status   string `json:"status,omitempty"`
+}
+
+// roomInfo describes one room in a room_list event
+type roomInfo struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+	Topic   string `json:"topic,omitempty"`
+}
+
+// statsInfo is the payload of a stats event
+type statsInfo struct {
+	Uptime  int64 `json:"uptime_seconds"`
+	Users   int   `json:"users"`
+	Rooms   int   `json:"rooms"`
+	Timeout int64 `json:"timeout_seconds"` // Without a heartbeat, before a client is dropped
+}
+
+// newEvent starts an event of the given type, stamped now
+func (s *Server) newEvent(kind string) event {
+	return event{ID: s.eventID.Add(1), Type: kind, Time: time.Now()}
+}
+
+// decodeEvent parses the JSON in a msgEvent packet
+func decodeEvent(pkt Packet) (event, error) {
+	var ev event
+	err := json.Unmarshal([]byte(pkt.field(0)), &ev)
+	return ev, err
+}
+
+// sendEvent queues ev for a client, behind the broadcasts and other events
+// queued before it (caller holds s.mu; see unlock)
+func (s *Server) sendEvent(c *Client, ev event) {
+	s.outbox = append(s.outbox, outgoing{to: c, ev: ev})
+}
+
+// deliver reliably sends ev to a client in the format it registered with (caller holds s.mu, read lock is enough)
+func (s *Server) deliver(c *Client, ev event) {
+	if c.jsonEvents {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return
+		}
+		s.sendReliable(c, Packet{kind: msgEvent, fields: [][]byte{data}})
+		return
+	}
+	switch ev.Type {
+	case eventWhisper:
+		s.sendReliable(c, Packet{kind: msgWhisperFrom, fields: [][]byte{[]byte(ev.Sender), ev.Key, ev.Envelope}})
+	case eventError:
+		s.sendReliable(c, newPacket(msgError, ev.Text))
+	default:
+		s.sendReliable(c, newPacket(msgText, textRenderer.render(ev)))
+	}
+}
+
+// fits reports whether ev can reach every client, which gets it in one packet
+// field as JSON or as text. JSON escapes can make text up to six times longer,
+// so when ev does not fit, client (its sender) is told so instead (caller holds s.mu).
+func (s *Server) fits(client *Client, ev event) bool {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return false
+	}
+	if size := max(len(data), len(textRenderer.render(ev))); size > maxFieldSize {
+		s.sendError(client, fmt.Sprintf("Message too long: %d bytes once encoded, the limit is %d", size, maxFieldSize))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForEvent reads packets from conn until a JSON event of the given type arrives
+func waitForEvent(t *testing.T, conn net.Conn, channel *secureChannel, kind string) event {
+	buf := make([]byte, maxDatagramSize)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("no %s event from server: %v", kind, err)
+		}
+		outer, err := decodePacket(buf[:n])
+		if err != nil || outer.kind != msgSealed {
+			continue
+		}
+		inner, _, err := channel.open(outer)
+		if err != nil {
+			continue
+		}
+		pkt, err := decodePacket(inner)
+		if err != nil {
+			continue
+		}
+		if pkt.kind == msgText || pkt.kind == msgError {
+			t.Fatalf("JSON client got rendered text: %q", pkt.field(0))
+		}
+		if pkt.kind != msgEvent {
+			continue
+		}
+		ev, err := decodeEvent(pkt)
+		if err != nil {
+			t.Fatalf("bad event %q: %v", pkt.field(0), err)
+		}
+		if ev.Type == kind {
+			return ev
+		}
+	}
+}
+
+func TestJSONModeSendsEvents(t *testing.T) {
+	s := newServer()
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	bot := mem.dial("bot")
+	botChannel, err := clientHandshake(bot, "localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSend(t, bot, botChannel, newPacket(msgRegister, "bot", "", "", eventFormatJSON), 1)
+	if ev := waitForEvent(t, bot, botChannel, eventJoin); ev.Sender != "bot" || ev.Room != defaultRoom {
+		t.Errorf("own join = %+v", ev)
+	}
+
+	alice := mem.dial("alice")
+	aliceChannel := testRegister(t, alice, "alice")
+	testSend(t, alice, aliceChannel, newPacket(msgChat, "\033[1mhello\033[0m bot"), 2)
+	ev := waitForEvent(t, bot, botChannel, eventChat)
+	if ev.Sender != "alice" || ev.Room != defaultRoom || ev.Text != "\033[1mhello\033[0m bot" || ev.ID == 0 || ev.Time.IsZero() {
+		t.Errorf("chat event = %+v", ev)
+	}
+	waitForText(t, alice, aliceChannel, "hello") // People still get text
+
+	testSend(t, bot, botChannel, newPacket(msgUsers), 2)
+	if ev := waitForEvent(t, bot, botChannel, eventUserList); len(ev.Users) != 2 {
+		t.Errorf("user list = %+v, want bot and alice", ev.Users)
+	}
+	testSend(t, bot, botChannel, newPacket(msgHelp), 3)
+	if ev := waitForEvent(t, bot, botChannel, eventSystem); strings.Contains(ev.Text, "\033[") || !strings.Contains(ev.Text, "/users") || ev.Reason != systemList {
+		t.Errorf("help = %q (%s), want a list without colors", ev.Text, ev.Reason)
+	}
+	testSend(t, bot, botChannel, newPacket(msgKick, "alice"), 4)
+	if ev := waitForEvent(t, bot, botChannel, eventError); !strings.Contains(ev.Text, "Permission denied") {
+		t.Errorf("error = %q", ev.Text)
+	}
+}
+
+func TestEscapeHeavyMessagesAreRefused(t *testing.T) {
+	s := newServer()
+	var sent [][]byte
+	alice := testClient(s, "alice")
+	alice.link = newReliableLink(func(data []byte) error { sent = append(sent, data); return nil })
+	s.enterRoom(alice, defaultRoom)
+	chats := func() (n int) {
+		for _, o := range s.outbox {
+			if o.to == nil && o.ev.Type == eventChat {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Each < is six bytes of JSON, so this would not fit in one field
+	s.dispatch(sessionKey(alice.token), alice, newPacket(msgChat, strings.Repeat("<", defaultMaxMessageSize/3)))
+	if chats() != 0 {
+		t.Fatal("escape-heavy chat was broadcast, although JSON clients cannot be sent it")
+	}
+	s.sendBatch(s.outbox)
+	told := false
+	for _, data := range sent {
+		told = told || strings.Contains(string(data), "Message too long")
+	}
+	if !told {
+		t.Error("sender was not told the message was too long")
+	}
+
+	// As long as plain text, but it encodes as itself
+	s.dispatch(sessionKey(alice.token), alice, newPacket(msgChat, strings.Repeat("a", defaultMaxMessageSize-1024)))
+	if chats() != 1 {
+		t.Error("long plain chat was not broadcast")
+	}
+}
+
+func TestQueuedEventsKeepTheirOrder(t *testing.T) {
+	s := newServer()
+	var mu sync.Mutex
+	var got []string
+	alice, bob := testClient(s, "alice"), testClient(s, "bob")
+	bob.jsonEvents = true
+	bob.link = newReliableLink(func(data []byte) error {
+		if pkt, err := decodePacket(data); err == nil && pkt.kind == msgEvent {
+			ev, _ := decodeEvent(pkt)
+			mu.Lock()
+			got = append(got, ev.Type+" "+ev.Text)
+			mu.Unlock()
+		}
+		return nil
+	})
+	s.rooms["go"] = &room{name: "go", topic: "gophers"}
+	s.enterRoom(alice, "go")
+	s.outbox = nil
+	go s.broadcastMessages()
+
+	// bob sees his own join before the topic sent only to him
+	s.mu.Lock()
+	s.enterRoom(bob, "go")
+	s.unlock()
+	// Batches handed over out of order are still sent in order
+	s.mu.Lock()
+	first := s.newEvent(eventChat)
+	first.Room, first.Text = "go", "first"
+	s.broadcast(first)
+	s.outSeq++
+	b1 := outbatch{seq: s.outSeq, out: s.outbox}
+	s.outbox = nil
+	second := s.newEvent(eventChat)
+	second.Room, second.Text = "go", "second"
+	s.broadcast(second)
+	s.outSeq++
+	b2 := outbatch{seq: s.outSeq, out: s.outbox}
+	s.outbox = nil
+	s.mu.Unlock()
+	s.messages <- b2
+	s.messages <- b1
+
+	want := []string{"join ", "topic gophers", "chat first", "chat second"}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		done := len(got) >= len(want)
+		mu.Unlock()
+		if done {
+			break
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(got, want) {
+		t.Errorf("bob got %q, want %q", got, want)
+	}
+}
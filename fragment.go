@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/binary" // For fragment headers
+	"errors"          // For reassembly errors
+	"fmt"             // For error details
+	"sync"            // For guarding the delivery tracker
+	"sync/atomic"     // For message IDs
+	"time"            // For reassembly timeouts
+)
+
+const (
+	defaultMTU            = 1200             // Largest datagram we send by default (safe on most paths)
+	minMTU                = 128              // Smallest MTU that leaves room for payload
+	maxDatagramSize       = 64 * 1024        // Read buffer size: never truncate an incoming datagram
+	defaultMaxMessageSize = 64 * 1024        // Largest reassembled message accepted by default
+	defaultMaxBuffered    = 256 * 1024       // Memory cap for partial messages per sender
+	reassemblyTimeout     = 10 * time.Second // Partial messages older than this are dropped
+	fragmentHeaderSize    = 12               // id(4) + index(2) + count(2) + total(4)
+)
+
+var (
+	errMessageTooLarge = errors.New("message too large")
+	errReassemblyFull  = errors.New("too many partial messages from sender")
+	errBadFragment     = errors.New("malformed fragment")
+)
+
+// fragmenter splits packets that would not fit in one datagram
+type fragmenter struct {
+	mtu    int           // Max encoded size of a single datagram
+	nextID atomic.Uint32 // Message ID for the next fragmented packet
+}
+
+// newFragmenter creates a fragmenter for the given MTU
+func newFragmenter(mtu int) *fragmenter {
+	return &fragmenter{mtu: max(mtu, minMTU)}
+}
+
+// split returns pkt unchanged if it fits the MTU once sent reliably,
+// otherwise a sequence of msgFragment packets carrying its encoding
+func (f *fragmenter) split(pkt Packet) ([]Packet, error) {
+	data, err := encodePacket(pkt)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)+seqSize <= f.mtu {
+		return []Packet{pkt}, nil
+	}
+
+	// Per-fragment overhead: header, seq, two field lengths and the fragment header
+	chunk := f.mtu - headerSize - seqSize - 4 - fragmentHeaderSize
+	count := (len(data) + chunk - 1) / chunk
+	if count > 0xFFFF {
+		return nil, fmt.Errorf("%w: %d bytes", errMessageTooLarge, len(data))
+	}
+
+	id := f.nextID.Add(1)
+	frags := make([]Packet, 0, count)
+	for i := 0; i < count; i++ {
+		part := data[i*chunk : min((i+1)*chunk, len(data))]
+		hdr := make([]byte, 0, fragmentHeaderSize)
+		hdr = binary.BigEndian.AppendUint32(hdr, id)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(i))
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(count))
+		hdr = binary.BigEndian.AppendUint32(hdr, uint32(len(data)))
+		frags = append(frags, Packet{kind: msgFragment, fields: [][]byte{hdr, part}})
+	}
+	return frags, nil
+}
+
+// fragmentHeader is the decoded first field of a msgFragment packet
+type fragmentHeader struct {
+	id           uint32
+	index, count uint16
+	total        uint32
+}
+
+// parseFragment validates a fragment packet and returns its header and payload
+func parseFragment(pkt Packet) (fragmentHeader, []byte, error) {
+	if len(pkt.fields) != 2 || len(pkt.fields[0]) != fragmentHeaderSize {
+		return fragmentHeader{}, nil, errBadFragment
+	}
+	h := pkt.fields[0]
+	fh := fragmentHeader{
+		id:    binary.BigEndian.Uint32(h[0:]),
+		index: binary.BigEndian.Uint16(h[4:]),
+		count: binary.BigEndian.Uint16(h[6:]),
+		total: binary.BigEndian.Uint32(h[8:]),
+	}
+	if fh.count == 0 || fh.index >= fh.count {
+		return fragmentHeader{}, nil, errBadFragment
+	}
+	return fh, pkt.fields[1], nil
+}
+
+// partialMessage collects the fragments of one message
+type partialMessage struct {
+	chunks   [][]byte  // Received chunks by index
+	received int       // Number of chunks received
+	size     int       // Bytes buffered so far
+	total    int       // Announced total size
+	started  time.Time // First fragment arrival
+	rejected bool      // Too large: remaining fragments are ignored
+}
+
+// reassembler rebuilds fragmented messages from a single sender
+type reassembler struct {
+	maxMessage  int // Largest message accepted
+	maxBuffered int // Memory cap across all partial messages
+	buffered    int // Bytes currently buffered
+	partial     map[uint32]*partialMessage
+}
+
+// newReassembler creates a reassembler with the given limits
+func newReassembler(maxMessage, maxBuffered int) *reassembler {
+	return &reassembler{
+		maxMessage:  maxMessage,
+		maxBuffered: maxBuffered,
+		partial:     make(map[uint32]*partialMessage),
+	}
+}
+
+// add stores one fragment and returns the full encoded message once complete.
+// It returns errMessageTooLarge only for the first fragment of an oversized message.
+func (r *reassembler) add(pkt Packet, now time.Time) ([]byte, error) {
+	fh, part, err := parseFragment(pkt)
+	if err != nil {
+		return nil, err
+	}
+	r.expire(now)
+
+	m, ok := r.partial[fh.id]
+	if !ok {
+		m = &partialMessage{chunks: make([][]byte, fh.count), total: int(fh.total), started: now}
+		r.partial[fh.id] = m
+		if m.total > r.maxMessage {
+			m.rejected = true
+			return nil, fmt.Errorf("%w: %d bytes (max %d)", errMessageTooLarge, m.total, r.maxMessage)
+		}
+	}
+	if m.rejected || len(m.chunks) != int(fh.count) || m.chunks[fh.index] != nil {
+		return nil, nil // Ignored, inconsistent or duplicate fragment
+	}
+	if m.size+len(part) > m.total {
+		r.drop(fh.id)
+		return nil, errBadFragment // Sender lied about the total
+	}
+	if r.buffered+len(part) > r.maxBuffered {
+		r.drop(fh.id)
+		return nil, errReassemblyFull
+	}
+
+	m.chunks[fh.index] = append([]byte(nil), part...)
+	m.received++
+	m.size += len(part)
+	r.buffered += len(part)
+	if m.received < len(m.chunks) {
+		return nil, nil
+	}
+
+	data := make([]byte, 0, m.size)
+	for _, c := range m.chunks {
+		data = append(data, c...)
+	}
+	r.drop(fh.id)
+	return data, nil
+}
+
+// drop forgets a partial message and releases its memory
+func (r *reassembler) drop(id uint32) {
+	if m, ok := r.partial[id]; ok {
+		r.buffered -= m.size
+		delete(r.partial, id)
+	}
+}
+
+// expire drops partial messages older than reassemblyTimeout
+func (r *reassembler) expire(now time.Time) {
+	for id, m := range r.partial {
+		if now.Sub(m.started) > reassemblyTimeout {
+			r.drop(id)
+		}
+	}
+}
+
+// fragmentTracker reports when every fragment of a sent message is acknowledged
+type fragmentTracker struct {
+	mu      sync.Mutex
+	pending map[uint32]int // Unacknowledged fragments per message ID
+}
+
+// newFragmentTracker creates an empty tracker
+func newFragmentTracker() *fragmentTracker {
+	return &fragmentTracker{pending: make(map[uint32]int)}
+}
+
+// track records the fragments about to be sent for one message
+func (t *fragmentTracker) track(frags []Packet) {
+	if len(frags) < 2 {
+		return
+	}
+	fh, _, err := parseFragment(frags[0])
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	t.pending[fh.id] = len(frags)
+	t.mu.Unlock()
+}
+
+// acked records an acknowledged fragment and reports whether its message is now complete
+func (t *fragmentTracker) acked(pkt Packet) bool {
+	fh, _, err := parseFragment(pkt)
+	if err != nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n, ok := t.pending[fh.id]
+	if !ok {
+		return false // Already failed or unknown
+	}
+	if n--; n > 0 {
+		t.pending[fh.id] = n
+		return false
+	}
+	delete(t.pending, fh.id)
+	return true
+}
+
+// failed forgets a message after one of its fragments was given up on,
+// reporting true only the first time so the failure is shown once
+func (t *fragmentTracker) failed(pkt Packet) bool {
+	fh, _, err := parseFragment(pkt)
+	if err != nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.pending[fh.id]
+	delete(t.pending, fh.id)
+	return ok
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFragmentRoundTrip(t *testing.T) {
+	f := newFragmenter(200)
+	long := strings.Repeat("0123456789", 300)
+	frags, err := f.split(newPacket(msgChat, long))
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	if len(frags) < 2 {
+		t.Fatalf("got %d fragments, want several", len(frags))
+	}
+	for _, fr := range frags {
+		fr.flags |= flagReliable
+		data, _ := encodePacket(fr)
+		if len(data) > 200 {
+			t.Fatalf("fragment is %d bytes, exceeds MTU 200", len(data))
+		}
+	}
+
+	r := newReassembler(defaultMaxMessageSize, defaultMaxBuffered)
+	now := time.Now()
+	// Deliver out of order: last fragment first
+	order := append([]Packet{frags[len(frags)-1]}, frags[:len(frags)-1]...)
+	var out []byte
+	for i, fr := range order {
+		data, err := r.add(fr, now)
+		if err != nil {
+			t.Fatalf("add %d: %v", i, err)
+		}
+		if data != nil && i != len(order)-1 {
+			t.Fatalf("message completed early at fragment %d", i)
+		}
+		out = data
+	}
+
+	pkt, err := decodePacket(out)
+	if err != nil || pkt.kind != msgChat || pkt.field(0) != long {
+		t.Fatalf("reassembled %v (err %v), want original chat packet", pkt.kind, err)
+	}
+	if r.buffered != 0 || len(r.partial) != 0 {
+		t.Errorf("reassembler still holds %d bytes in %d messages", r.buffered, len(r.partial))
+	}
+}
+
+func TestFragmentSmallPacketUnchanged(t *testing.T) {
+	frags, err := newFragmenter(defaultMTU).split(newPacket(msgChat, "hi"))
+	if err != nil || len(frags) != 1 || frags[0].kind != msgChat {
+		t.Fatalf("got %v, %v; want the packet unchanged", frags, err)
+	}
+}
+
+func TestReassemblerRejectsOversizedMessage(t *testing.T) {
+	frags, _ := newFragmenter(200).split(newPacket(msgChat, strings.Repeat("x", 5000)))
+	r := newReassembler(1000, defaultMaxBuffered)
+	now := time.Now()
+
+	if _, err := r.add(frags[0], now); !errors.Is(err, errMessageTooLarge) {
+		t.Fatalf("first fragment: got %v, want errMessageTooLarge", err)
+	}
+	for _, fr := range frags[1:] {
+		if data, err := r.add(fr, now); data != nil || err != nil {
+			t.Fatalf("later fragment: got %d bytes, %v; want silently ignored", len(data), err)
+		}
+	}
+}
+
+func TestReassemblerMemoryCapAndTimeout(t *testing.T) {
+	f := newFragmenter(200)
+	r := newReassembler(defaultMaxMessageSize, 1000)
+	now := time.Now()
+
+	// Start many messages without finishing any until the cap is hit
+	var err error
+	for i := 0; i < 20 && err == nil; i++ {
+		frags, _ := f.split(newPacket(msgChat, strings.Repeat("x", 1000)))
+		_, err = r.add(frags[0], now)
+	}
+	if !errors.Is(err, errReassemblyFull) {
+		t.Fatalf("got %v, want errReassemblyFull", err)
+	}
+
+	frags, _ := f.split(newPacket(msgChat, strings.Repeat("y", 1000)))
+	if _, err := r.add(frags[0], now.Add(reassemblyTimeout+time.Second)); err != nil {
+		t.Fatalf("after timeout: %v", err)
+	}
+	if len(r.partial) != 1 {
+		t.Errorf("%d partial messages survived the timeout, want only the new one", len(r.partial))
+	}
+}
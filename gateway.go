@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"      // For status lines
+	"log"      // For logging gateway errors
+	"net/http" // For the web page and upgrades
+	"net/url"  // For checking the Origin of upgrades
+	"strings"  // For names and commands
+	"sync"     // For the pending password challenge
+	"time"     // For retransmits and flushes
+)
+
+// The WebSocket gateway lets browsers chat without the Go binary. Each browser
+// becomes an ordinary client of the server, connected through an in-memory
+// transport: the gateway runs the handshake, registers the user and turns
+// lines typed in the browser into packets, exactly as the terminal client does.
+const defaultWebIdentities = "web_identities.json" // Whisper key seeds of web users, kept by the gateway
+
+// gateway serves the web chat page and its WebSocket endpoint
+type gateway struct {
+	mem      *memTransport
+	keysPath string // Whisper key seeds by username
+}
+
+// newGateway creates a gateway that joins browsers to the server behind mem
+func newGateway(mem *memTransport, keysPath string) *gateway {
+	return &gateway{mem: mem, keysPath: keysPath}
+}
+
+// handler routes the page and the WebSocket endpoint
+func (g *gateway) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, gatewayPage)
+	})
+	mux.HandleFunc("/ws", g.serveWS)
+	return mux
+}
+
+// serveWS runs one browser's chat session
+func (g *gateway) serveWS(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		http.Error(w, "WebSocket connections are only accepted from this site's page", http.StatusForbidden)
+		return
+	}
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	// send passes an event to the page, which renders it in the browser's locale and time zone
+	send := func(ev event) { ws.WriteText(string(mustJSON(ev))) }
+	notify := func(kind, text string) { send(event{Type: kind, Time: time.Now(), Text: text}) }
+	if name == "" {
+		notify(eventError, "Username cannot be empty")
+		return
+	}
+
+	conn := g.mem.dial("web/" + r.RemoteAddr)
+	defer conn.Close()
+	channel, err := clientHandshake(conn, "gateway", nil) // In-process, so nothing to pin
+	if err != nil {
+		notify(eventError, "Cannot reach the chat server")
+		return
+	}
+	cc := newClientConn(conn, channel)
+
+	// Whisper keys are chosen once the server has welcomed the user (see sessionKeys)
+	whispers := newWhisperer(nil, &knownUsers{}) // No pins: the browser could not act on them
+	cc.send(Packet{kind: msgRegister, fields: [][]byte{[]byte(name), nil, nil, []byte(eventFormatJSON)}})
+
+	done := make(chan struct{})
+	defer close(done)
+	// Retransmit unacknowledged packets and keep the session alive while the page is open
+	go func() {
+		ticker := time.NewTicker(retransmitTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if cc.link.retransmit(now) > 0 {
+					cc.conn.Close() // Stalled for good: end the session
+					return
+				}
+				cc.keepAlive(now)
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var challenge *Packet // Waiting for the password typed in the browser
+
+	// Server to browser
+	go func() {
+		defer ws.Close() // Ends the browser loop below
+		welcomed, authed := false, false
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			for _, pkt := range cc.receive(buf[:n]) {
+				switch pkt.kind {
+				case msgEvent:
+					ev, err := decodeEvent(pkt)
+					if err != nil {
+						continue
+					}
+					for _, ev := range whispers.openEvent(ev) {
+						send(ev)
+					}
+					if ev.Type == eventError && !welcomed {
+						return // Name taken or wrong password: the session is gone
+					}
+				case msgChallenge:
+					if len(pkt.fields) == 4 {
+						authed = true // Welcomed only if the password is right
+						mu.Lock()
+						challenge = &pkt
+						mu.Unlock()
+						notify(eventSystem, fmt.Sprintf("Password for %s:", name))
+					}
+				case msgWelcome:
+					welcomed = true
+					keys, err := sessionKeys(g.keysPath, name, authed)
+					if err != nil {
+						log.Printf("Gateway whisper keys: %v", err)
+						notify(eventError, "Whisper keys unavailable")
+					} else {
+						whispers.keys = keys // Only this goroutine opens and seals whispers
+						cc.send(keys.publish())
+					}
+					notify(eventSystem, fmt.Sprintf("Connected as %s. Type /help for commands", name))
+				case msgKey:
+					out, notice := whispers.keyArrived(pkt)
+					for _, w := range out {
+						cc.send(w)
+					}
+					if notice != "" {
+						notify(eventError, notice)
+					}
+				}
+			}
+		}
+	}()
+
+	// Browser to server
+	for {
+		line, err := ws.ReadMessage()
+		if err != nil {
+			cc.send(newPacket(msgQuit))
+			cc.link.flush(time.Second)
+			return
+		}
+		line = strings.TrimSpace(line)
+		mu.Lock()
+		pending := challenge
+		challenge = nil
+		mu.Unlock()
+		if pending != nil {
+			if auth, err := challengeAnswer(*pending, line); err == nil {
+				cc.send(auth)
+			}
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		pkt, err := parseCommand(line)
+		if err != nil {
+			notify(eventError, err.Error())
+			continue
+		}
+		if pkt.kind == msgWhisper {
+			pkt = whispers.queue(pkt.field(0), pkt.field(1)) // Encrypted once the key arrives
+		}
+		cc.send(pkt)
+		if pkt.kind == msgQuit {
+			cc.link.flush(time.Second)
+			return
+		}
+	}
+}
+
+// sameOrigin reports whether an upgrade request comes from a page served by
+// this host, so other sites cannot open chat sessions from their visitors'
+// browsers. Browsers always send Origin; requests without one are not from a page.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// gatewayPage is the whole web client. It renders the events itself, so
+// times are shown in the browser's time zone and locale.
+const gatewayPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>GoChat</title>
+<style>
+body { font-family: monospace; margin: 0; display: flex; flex-direction: column; height: 100vh; }
+#log { flex: 1; overflow-y: auto; margin: 0; padding: 8px; white-space: pre-wrap; }
+#line { border: 0; border-top: 1px solid #ccc; padding: 8px; font: inherit; }
+.time, .history { color: #888; }
+.join { color: #080; }
+.leave, .error { color: #b00; }
+.rename, .topic, .announcement, .presence { color: #a60; }
+.whisper { color: #808; }
+.system.notice { color: #a60; }
+.system.done { color: #088; }
+.system.list::first-line { font-weight: bold; }
+</style>
+</head>
+<body>
+<div id="log"></div>
+<input id="line" autocomplete="off" autofocus placeholder="Your name">
+<script>
+const log = document.getElementById("log"), line = document.getElementById("line");
+const badges = {owner: "👑 ", moderator: "🛡 "};
+const left = {moved: e => " left for #" + e.target, kicked: e => " was kicked by " + e.target,
+  timeout: () => " timed out", disconnected: () => " left the chat (connection closed)"};
+let ws = null;
+function stamp(ts) {
+  const d = new Date(ts), opts = {hour: "numeric", minute: "2-digit"};
+  if (d.toDateString() !== new Date().toDateString()) Object.assign(opts, {month: "short", day: "numeric"});
+  return d.toLocaleString([], opts);
+}
+function presence(e) {
+  if (e.reason === "status") return e.sender + (e.status ? " set their status: " + e.status : " cleared their status");
+  if (e.presence === "online") return e.sender + " is back";
+  if (e.reason === "idle") return e.sender + " is " + e.presence + " (idle)";
+  return e.sender + " is " + e.presence + (e.text ? ": " + e.text : "");
+}
+function render(e) {
+  switch (e.type) {
+  case "chat": return (badges[e.role] || "") + e.sender + ": " + e.text;
+  case "join": return e.sender + " joined #" + e.room;
+  case "leave": return e.sender + (left[e.reason] ? left[e.reason](e) : " left the chat");
+  case "rename": return e.sender + " changed name to " + e.target;
+  case "topic": return e.sender ? e.sender + " set the topic of #" + e.room + " to: " + e.text :
+    e.text ? "Topic for #" + e.room + ": " + e.text : "#" + e.room + " has no topic";
+  case "announcement": return "[ADMIN ANNOUNCEMENT] " + e.text;
+  case "whisper": return "[WHISPER from " + e.sender + "] " + e.text;
+  case "presence": return presence(e);
+  case "user_list": return "Connected users:\n" + e.users.map(u => "- " + u.name + " #" + u.room +
+    (u.role !== "member" && u.role !== "guest" ? " (" + u.role + ")" : "") + (u.muted ? " (muted)" : "") +
+    (u.presence && u.presence !== "online" ? " (" + u.presence + (u.away_message ? ": " + u.away_message : "") + ")" : "") +
+    (u.status ? " - " + u.status : "")).join("\n");
+  case "room_list": return "Rooms:\n" + e.rooms.map(r => (r.name === e.room ? "* #" : "  #") + r.name +
+    " (" + r.members + ")" + (r.topic ? " - " + r.topic : "")).join("\n");
+  case "stats": return "Uptime: " + e.stats.uptime_seconds + "s\nUsers connected: " + e.stats.users + "\nRooms: " + e.stats.rooms;
+  case "error": return "Error: " + e.text;
+  }
+  return e.text || "";
+}
+function show(e, cls) {
+  const div = document.createElement("div");
+  div.className = cls || (e.type === "system" && e.reason ? "system " + e.reason : e.type);
+  if (["chat", "join", "leave", "rename", "whisper"].includes(e.type)) {
+    const t = document.createElement("span");
+    t.className = "time";
+    t.textContent = stamp(e.timestamp) + " ";
+    div.appendChild(t);
+  }
+  div.appendChild(document.createTextNode(render(e)));
+  log.appendChild(div);
+}
+line.addEventListener("keydown", e => {
+  if (e.key !== "Enter") return;
+  const text = line.value;
+  line.value = "";
+  if (ws === null) {
+    const proto = location.protocol === "https:" ? "wss:" : "ws:";
+    ws = new WebSocket(proto + "//" + location.host + "/ws?name=" + encodeURIComponent(text));
+    ws.onmessage = m => {
+      const ev = JSON.parse(m.data);
+      if (ev.type === "typing") return;
+      if (ev.type === "history") {
+        (ev.history || []).forEach(h => show(h, "history"));
+        if (!ev.history) show({text: "No earlier messages in #" + ev.room}, "history");
+      } else {
+        show(ev);
+      }
+      log.scrollTop = log.scrollHeight;
+      line.type = ev.type === "system" && ev.text.startsWith("Password for ") ? "password" : "text";
+    };
+    ws.onclose = () => show({text: "Disconnected from server"}, "error");
+    line.placeholder = "Message or /command";
+    return;
+  }
+  ws.send(text);
+  line.type = "text";
+});
+</script>
+</body>
+</html>
+`
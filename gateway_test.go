@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWS is a browser-side WebSocket connection for tests
+type testWS struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialTestWS opens a WebSocket to the gateway at url as name
+func dialTestWS(t *testing.T, url, name string) *testWS {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	req := "GET /ws?name=" + name + " HTTP/1.1\r\nHost: gochat\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	conn.Write([]byte(req))
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade failed: %v %v", resp, err)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" { // Example from RFC 6455
+		t.Fatalf("Sec-WebSocket-Accept = %q", got)
+	}
+	return &testWS{conn: conn, r: r}
+}
+
+// send writes text as one masked frame, as browsers must
+func (ws *testWS) send(text string) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | wsText, 0x80 | byte(len(text))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(text); i++ {
+		frame = append(frame, text[i]^mask[i%4])
+	}
+	ws.conn.Write(frame)
+}
+
+// waitFor reads text messages until one contains want (a password login takes a while under -race)
+func (ws *testWS) waitFor(t *testing.T, want string) {
+	ws.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(ws.r, head[:]); err != nil {
+			t.Fatalf("no %q from gateway: %v", want, err)
+		}
+		size := int(head[1] & 0x7F)
+		if size == 126 {
+			var ext [2]byte
+			io.ReadFull(ws.r, ext[:])
+			size = int(binary.BigEndian.Uint16(ext[:]))
+		}
+		payload := make([]byte, size)
+		io.ReadFull(ws.r, payload)
+		if head[0]&0x0F == wsText && strings.Contains(string(payload), want) {
+			return
+		}
+	}
+}
+
+func TestGatewayJoinsWebUsersToTheChat(t *testing.T) {
+	s := newServer()
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	gw := newGateway(mem, filepath.Join(t.TempDir(), defaultWebIdentities))
+	web := httptest.NewServer(gw.handler())
+	defer web.Close()
+
+	ws := dialTestWS(t, web.URL, "webby")
+	ws.waitFor(t, "Connected as webby")
+
+	native := mem.dial("alice")
+	channel := testRegister(t, native, "alice")
+	ws.waitFor(t, `"type":"join","timestamp"`) // Events, for the page to render
+
+	testSend(t, native, channel, newPacket(msgChat, "hi browser"), 2)
+	ws.waitFor(t, "hi browser")
+
+	ws.send("hello terminal")
+	waitForText(t, native, channel, "hello terminal")
+
+	ws.send("/users")
+	ws.waitFor(t, `{"name":"alice","room":"lobby"`)
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil) // No upgrade headers
+	rec := httptest.NewRecorder()
+	if _, err := upgradeWebSocket(rec, req); err == nil || rec.Code != http.StatusBadRequest {
+		t.Errorf("plain GET upgraded: %v, status %d", err, rec.Code)
+	}
+}
+
+// publishedKey waits for name's whisper signing key to reach the server
+func publishedKey(t *testing.T, s *Server, name string) []byte {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.RLock()
+		var key []byte
+		if c := s.findClient(name); c != nil {
+			key = c.whisperSign
+		}
+		s.mu.RUnlock()
+		if key != nil {
+			return key
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s published no whisper key", name)
+	return nil
+}
+
+func TestGatewayStoredKeysNeedPassword(t *testing.T) {
+	s := newServer()
+	s.users.setPassword("alice", "secret", roleMember)
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	path := filepath.Join(t.TempDir(), defaultWebIdentities)
+	stored := make(map[string]*userKeys)
+	for _, name := range []string{"alice", "bob"} {
+		keys, err := loadUserKeys(path, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored[name] = keys
+	}
+	web := httptest.NewServer(newGateway(mem, path).handler())
+	defer web.Close()
+
+	// A guest typing a name with stored keys gets fresh ones
+	guest := dialTestWS(t, web.URL, "bob")
+	guest.waitFor(t, "Connected as bob")
+	if key := publishedKey(t, s, "bob"); bytes.Equal(key, stored["bob"].signPublic()) {
+		t.Error("guest bob was given bob's stored whisper key")
+	}
+
+	member := dialTestWS(t, web.URL, "alice")
+	member.waitFor(t, "Password for alice")
+	member.send("secret")
+	member.waitFor(t, "Connected as alice")
+	if key := publishedKey(t, s, "alice"); !bytes.Equal(key, stored["alice"].signPublic()) {
+		t.Error("alice's stored whisper key was not published after her password")
+	}
+}
+
+func TestGatewayRefusesOtherOrigins(t *testing.T) {
+	gw := newGateway(newMemTransport(), "")
+	req := httptest.NewRequest(http.MethodGet, "http://gochat/ws?name=eve", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	rec := httptest.NewRecorder()
+	gw.handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("cross-site upgrade: status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://gochat/ws", nil)
+	req.Header.Set("Origin", "http://gochat")
+	if !sameOrigin(req) {
+		t.Error("the gateway's own page was refused")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"         // For reading log files line by line
+	"encoding/json" // For log entries
+	"errors"        // For missing-file checks
+	"fmt"           // For rotated file names
+	"io"            // For the end of log files
+	"log"           // For reporting skipped log lines
+	"os"            // For log files
+	"slices"        // For ordering scrollback
+	"sync"          // For guarding the log
+	"time"          // For timestamps and retention
+	"unicode/utf8"  // For shortening long messages
+)
+
+const (
+	defaultHistoryFile = "history.log"       // Chat log, relative to the server's working directory
+	maxHistorySize     = 1 << 20             // Rotate the log once it grows past this many bytes
+	maxHistoryFiles    = 5                   // Rotated logs kept (history.log.1 ... .5)
+	historyRetention   = 30 * 24 * time.Hour // Messages older than this are neither loaded nor kept
+	historyKeep        = 1000                // Recent messages kept in memory per room
+	scrollbackLines    = 20                  // Messages shown when joining a room
+	maxHistoryReply    = 60 * 1024           // History must fit in one text or event field
+	maxHistoryText     = 8 * 1024            // Longer messages are cut to this in the log
+	maxHistoryLine     = 8 * maxHistoryText  // Longer log lines are skipped (JSON escapes take up to 6 bytes a byte)
+)
+
+// historyEntry is one chat message as stored in the log (one JSON object per line)
+type historyEntry struct {
+	ID     uint64    `json:"id,omitempty"` // ID of the chat event
+	Time   time.Time `json:"time"`
+	Room   string    `json:"room"`
+	Sender string    `json:"sender,omitempty"` // "" in older logs, whose text is the rendered line
+	Role   string    `json:"role,omitempty"`   // Sender's role at the time
+	Text   string    `json:"text"`
+}
+
+// event turns e back into the chat event it was logged from
+func (e historyEntry) event() event {
+	if e.Sender == "" {
+		// Rendered for terminals before events existed: take the colors out
+		return event{Type: eventSystem, Time: e.Time, Room: e.Room, Text: ansiEscape.ReplaceAllString(e.Text, "")}
+	}
+	return event{ID: e.ID, Type: eventChat, Time: e.Time, Room: e.Room, Sender: e.Sender, Role: e.Role, Text: e.Text}
+}
+
+// historyLog is an append-only chat log on disk plus the recent messages of each room
+type historyLog struct {
+	mu      sync.Mutex
+	path    string   // Current log file ("" keeps history in memory only)
+	file    *os.File // Open for appending
+	size    int64    // Bytes in the current file
+	maxSize int64    // Rotate once the current file would grow past this
+	recent  map[string][]historyEntry
+}
+
+// newHistory creates an in-memory history
+func newHistory() *historyLog {
+	return &historyLog{maxSize: maxHistorySize, recent: make(map[string][]historyEntry)}
+}
+
+// openHistory loads the logs at path (rotated ones first) and opens it for appending
+func openHistory(path string) (*historyLog, error) {
+	h := newHistory()
+	h.path = path
+	h.expire(time.Now())
+
+	cutoff := time.Now().Add(-historyRetention)
+	for i := maxHistoryFiles; i >= 0; i-- {
+		if err := h.load(h.rotatedName(i), cutoff); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	h.file, h.size = f, fi.Size()
+	return h, nil
+}
+
+// rotatedName is the file name of the i-th rotated log (0 is the current one)
+func (h *historyLog) rotatedName(i int) string {
+	if i == 0 {
+		return h.path
+	}
+	return fmt.Sprintf("%s.%d", h.path, i)
+}
+
+// load adds the entries of one log file newer than cutoff to the recent lists
+func (h *historyLog) load(name string, cutoff time.Time) error {
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	in := bufio.NewReader(f)
+	skipped := 0
+	for {
+		line, err := in.ReadBytes('\n')
+		if len(line) > 0 {
+			var e historyEntry
+			if len(line) > maxHistoryLine || json.Unmarshal(line, &e) != nil {
+				skipped++ // e.g. a line cut short by a crash, or written before texts were capped
+			} else if e.Time.After(cutoff) {
+				h.remember(e)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d malformed or oversized line(s) in %s", skipped, name)
+	}
+	return nil
+}
+
+// remember adds e to its room's recent messages, dropping the oldest beyond historyKeep (caller holds h.mu)
+func (h *historyLog) remember(e historyEntry) {
+	r := append(h.recent[e.Room], e)
+	if len(r) > historyKeep {
+		r = append([]historyEntry(nil), r[len(r)-historyKeep:]...) // Copy so the old array can be freed
+	}
+	h.recent[e.Room] = r
+}
+
+// add records a message broadcast in its room, rotating the log when it gets too big
+func (h *historyLog) add(e historyEntry) error {
+	if len(e.Text) > maxHistoryText {
+		n := maxHistoryText
+		for n > 0 && !utf8.RuneStart(e.Text[n]) { // Don't split a character
+			n--
+		}
+		e.Text = e.Text[:n]
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remember(e)
+	if h.file == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if h.size > 0 && h.size+int64(len(line)) > h.maxSize {
+		if err := h.rotate(e.Time); err != nil {
+			return err
+		}
+	}
+	n, err := h.file.Write(line)
+	h.size += int64(n)
+	return err
+}
+
+// rotate shifts history.log to history.log.1 (and so on), deleting the oldest
+// file and any rotated file past the retention period (caller holds h.mu)
+func (h *historyLog) rotate(now time.Time) error {
+	if err := h.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(h.rotatedName(maxHistoryFiles))
+	for i := maxHistoryFiles - 1; i >= 0; i-- {
+		if err := os.Rename(h.rotatedName(i), h.rotatedName(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	h.expire(now)
+
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		h.file = nil // Keep serving history from memory
+		return err
+	}
+	h.file, h.size = f, 0
+	return nil
+}
+
+// expire deletes rotated logs last written before the retention period
+func (h *historyLog) expire(now time.Time) {
+	for i := 1; i <= maxHistoryFiles; i++ {
+		if fi, err := os.Stat(h.rotatedName(i)); err == nil && now.Sub(fi.ModTime()) > historyRetention {
+			os.Remove(h.rotatedName(i))
+		}
+	}
+}
+
+// last returns up to n of the most recent messages in room, oldest first
+func (h *historyLog) last(room string, n int) []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := h.recent[room]
+	n = min(n, len(r))
+	return append([]historyEntry(nil), r[len(r)-n:]...)
+}
+
+// close flushes and closes the log file
+func (h *historyLog) close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
+
+// historyEvent holds up to the last n messages of room, leaving out the oldest
+// if the event would not fit in one field as JSON
+func (s *Server) historyEvent(room string, n int) event {
+	ev := s.newEvent(eventHistory)
+	ev.Room = room
+	entries := s.history.last(room, n)
+	size := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i].event()
+		data, _ := json.Marshal(e)
+		if size += len(data) + 1; size > maxHistoryReply { // 1: comma
+			break
+		}
+		ev.History = append(ev.History, e)
+	}
+	slices.Reverse(ev.History) // Oldest first
+	return ev
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestHistorySurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.log")
+	h, err := openHistory(path)
+	if err != nil {
+		t.Fatalf("openHistory: %v", err)
+	}
+	now := time.Now()
+	for i := 0; i < 30; i++ {
+		h.add(historyEntry{Time: now, Room: "go", Sender: "alice", Text: fmt.Sprintf("msg %d", i)})
+	}
+	h.add(historyEntry{Time: now, Room: defaultRoom, Sender: "bob", Text: "lobby chatter"})
+	h.close()
+
+	reopened, err := openHistory(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.close()
+	got := reopened.last("go", 3)
+	if len(got) != 3 || got[0].Text != "msg 27" || got[2].Text != "msg 29" {
+		t.Fatalf("last 3 in #go = %+v, want msg 27..29", got)
+	}
+	if all := reopened.last("go", 1000); len(all) != 30 {
+		t.Errorf("got %d messages in #go, want 30 (other rooms must not leak in)", len(all))
+	}
+}
+
+func TestHistoryRotationAndRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.log")
+	h, err := openHistory(path)
+	if err != nil {
+		t.Fatalf("openHistory: %v", err)
+	}
+	h.maxSize = 500
+	now := time.Now()
+	for i := 0; i < 200; i++ {
+		h.add(historyEntry{Time: now, Room: "go", Sender: "alice", Text: strings.Repeat("x", 50)})
+	}
+	h.close()
+
+	for i := 1; i <= maxHistoryFiles; i++ {
+		if _, err := os.Stat(fmt.Sprintf("%s.%d", path, i)); err != nil {
+			t.Errorf("rotated file %d missing: %v", i, err)
+		}
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s.%d", path, maxHistoryFiles+1)); err == nil {
+		t.Errorf("more than %d rotated files kept", maxHistoryFiles)
+	}
+	if fi, _ := os.Stat(path); fi.Size() > 500 {
+		t.Errorf("current log is %d bytes, want at most 500", fi.Size())
+	}
+
+	// Rotated files past the retention period are deleted and not loaded
+	old := now.Add(-historyRetention - time.Hour)
+	os.Chtimes(path+".1", old, old)
+	if _, err := openHistory(path); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if _, err := os.Stat(path + ".1"); err == nil {
+		t.Error("expired rotated log was kept")
+	}
+}
+
+func TestHistorySkipsOldAndMalformedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.log")
+	old := time.Now().Add(-historyRetention - time.Hour).Format(time.RFC3339)
+	data := `{"time":"` + old + `","room":"go","text":"ancient"}` + "\n" +
+		`{"time":"` + time.Now().Format(time.RFC3339) + `","room":"go","text":"recent"}` + "\n" +
+		`{"time":"2024-01-01T00:00:00Z","room":"go","te` // Cut short by a crash
+	os.WriteFile(path, []byte(data), 0o600)
+
+	h, err := openHistory(path)
+	if err != nil {
+		t.Fatalf("openHistory: %v", err)
+	}
+	defer h.close()
+	if got := h.last("go", 10); len(got) != 1 || got[0].Text != "recent" {
+		t.Fatalf("loaded %+v, want only the recent message", got)
+	}
+}
+
+func TestHistorySurvivesEscapeHeavyMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.log")
+	now := time.Now()
+	// Written before texts were capped: far longer than any line add writes now
+	huge := `{"time":"` + now.Format(time.RFC3339) + `","room":"go","sender":"eve","text":"` +
+		strings.Repeat(`\u003c`, defaultMaxMessageSize) + `"}` + "\n"
+	os.WriteFile(path, []byte(huge), 0o600)
+
+	h, err := openHistory(path)
+	if err != nil {
+		t.Fatalf("openHistory with an oversized line: %v", err)
+	}
+	h.add(historyEntry{Time: now, Room: "go", Sender: "eve", Text: "<" + strings.Repeat("é<", defaultMaxMessageSize/3)})
+	h.add(historyEntry{Time: now, Room: "go", Sender: "bob", Text: "still here"})
+	h.close()
+
+	reopened, err := openHistory(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.close()
+	got := reopened.last("go", 10)
+	if len(got) != 2 || got[1].Text != "still here" {
+		t.Fatalf("loaded %d messages, want the capped one and the next", len(got))
+	}
+	if n := len(got[0].Text); n > maxHistoryText || n < maxHistoryText-utf8.UTFMax || !utf8.ValidString(got[0].Text) {
+		t.Errorf("stored text is %d bytes, want about %d and valid UTF-8", n, maxHistoryText)
+	}
+}
+
+func TestRenderHistoryFitsOnePacket(t *testing.T) {
+	var entries []event
+	for i := 0; i < historyKeep; i++ {
+		entries = append(entries, event{Type: eventChat, Time: time.Now(), Room: "go", Sender: "alice", Text: strings.Repeat("y", 200)})
+	}
+	out := textRenderer.history("go", entries, time.Now())
+	if len(out) > maxFieldSize {
+		t.Fatalf("rendered history is %d bytes, exceeds the %d-byte field limit", len(out), maxFieldSize)
+	}
+	if !strings.Contains(out, "message(s) in #go") {
+		t.Errorf("rendered history lacks its header: %.80q", out)
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bufio"        // For reading IRC lines
+	"errors"       // For login failures
+	"log"          // For logging bridge errors
+	"net"          // For IRC connections
+	"os"           // For read deadline errors
+	"strings"      // For parsing IRC lines
+	"sync"         // For serializing writes
+	"time"         // For timeouts and retransmits
+	"unicode/utf8" // For cutting long lines between characters
+)
+
+// The IRC bridge lets existing IRC clients use the chat. Like the web gateway,
+// it joins each IRC connection to the server as an ordinary client over an
+// in-memory transport and translates a subset of IRC (NICK, USER, PASS, JOIN,
+// PART, PRIVMSG, TOPIC, WHO, KICK, PING, QUIT) into the same packets.
+// Rooms are IRC channels; since a user is in one room at a time, joining a
+// channel parts the previous one. PRIVMSG to a nick is an encrypted whisper.
+const (
+	ircServerName        = "gochat"
+	defaultIRCIdentities = "irc_identities.json" // Whisper key seeds of IRC users, kept by the bridge
+	ircMaxLine           = 512                   // RFC 1459 line limit, including CRLF
+	ircLoginTimeout      = 10 * time.Second
+	ircRegisterTimeout   = time.Minute // Connections that have not finished NICK and USER by then are closed
+	ircWriteTimeout      = 5 * time.Second
+)
+
+var errPasswordRequired = errors.New("password required")
+
+// ircRenderer renders the events IRC has no command for as plain notices
+var ircRenderer = &renderer{theme: themes["none"], loc: time.Local, clock24: true}
+
+// ircQuitReasons are the QUIT messages for users who left the chat
+var ircQuitReasons = map[string]string{
+	leaveQuit:         "Quit",
+	leaveTimeout:      "Timed out",
+	leaveDisconnected: "Connection closed",
+}
+
+// ircUnsafe replaces the characters that end or break an IRC line
+var ircUnsafe = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ", "\x00", "")
+
+// ircBridge accepts IRC clients for the server behind mem
+type ircBridge struct {
+	mem             *memTransport
+	keysPath        string        // Whisper key seeds by nick
+	registerTimeout time.Duration // Time a connection has to register
+}
+
+// newIRCBridge creates a bridge that joins IRC users to the server behind mem
+func newIRCBridge(mem *memTransport, keysPath string) *ircBridge {
+	return &ircBridge{mem: mem, keysPath: keysPath, registerTimeout: ircRegisterTimeout}
+}
+
+// serve accepts IRC clients on ln until it is closed
+func (b *ircBridge) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("IRC accept error: %v", err)
+			continue
+		}
+		c := &ircConn{bridge: b, conn: conn}
+		go c.run()
+	}
+}
+
+// ircConn is one IRC client and, once registered, its chat session
+type ircConn struct {
+	bridge *ircBridge
+	conn   net.Conn
+	wmu    sync.Mutex
+
+	user, pass string // Collected during registration
+
+	server   net.Conn // In-memory connection to the chat server
+	cc       *clientConn
+	whispers *whisperer
+
+	mu         sync.Mutex
+	nick       string // Current nick (set during registration, changed by NICK)
+	room       string // Current room, as announced by the server
+	whoPending string // Mask of an unanswered WHO ("" if none)
+}
+
+// parseIRCLine splits a line into its command (upper case) and parameters,
+// dropping any prefix. The trailing parameter may contain spaces.
+func parseIRCLine(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, ":") {
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			line = line[i+1:]
+		} else {
+			return "", nil
+		}
+	}
+	var params []string
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if strings.HasPrefix(line, ":") {
+			params = append(params, line[1:])
+			break
+		}
+		word, rest, _ := strings.Cut(line, " ")
+		if word != "" {
+			params = append(params, word)
+		}
+		line = rest
+	}
+	if len(params) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+// write sends one line, marking the last parameter as trailing
+func (c *ircConn) write(prefix, command string, params ...string) {
+	var sb strings.Builder
+	if prefix != "" {
+		sb.WriteString(":" + prefix + " ")
+	}
+	sb.WriteString(command)
+	for i, p := range params {
+		p = ircUnsafe.Replace(p) // Chat text may hold line breaks that would start new IRC lines
+		if i == len(params)-1 {
+			sb.WriteString(" :" + p)
+		} else {
+			sb.WriteString(" " + p)
+		}
+	}
+	line := sb.String()
+	if len(line) > ircMaxLine-2 {
+		n := ircMaxLine - 2
+		for n > 0 && !utf8.RuneStart(line[n]) { // Don't split a character
+			n--
+		}
+		line = line[:n]
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(ircWriteTimeout))
+	c.conn.Write([]byte(line + "\r\n"))
+}
+
+// currentNick returns the client's nick ("" until NICK)
+func (c *ircConn) currentNick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
+
+// setNick changes the client's nick
+func (c *ircConn) setNick(nick string) {
+	c.mu.Lock()
+	c.nick = nick
+	c.mu.Unlock()
+}
+
+// numeric sends a numeric reply addressed to the client
+func (c *ircConn) numeric(code string, params ...string) {
+	nick := c.currentNick()
+	if c.cc == nil { // Not registered yet
+		nick = "*"
+	}
+	c.write(ircServerName, code, append([]string{nick}, params...)...)
+}
+
+// notice shows server text to the client, one line at a time
+func (c *ircConn) notice(text string) {
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimRight(line, " "); line != "" {
+			c.write(ircServerName, "NOTICE", c.currentNick(), line)
+		}
+	}
+}
+
+// mask is the nick!user@host prefix of a chat user
+func mask(nick string) string {
+	return nick + "!" + nick + "@" + ircServerName
+}
+
+// run serves the connection until the client or the server goes away
+func (c *ircConn) run() {
+	defer c.conn.Close()
+	defer func() {
+		if c.server != nil {
+			c.server.Close()
+		}
+	}()
+
+	c.conn.SetReadDeadline(time.Now().Add(c.bridge.registerTimeout))
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(make([]byte, 0, ircMaxLine), 16*1024) // Some clients exceed 512 bytes
+	for scanner.Scan() {
+		command, params := parseIRCLine(scanner.Text())
+		if command == "" {
+			continue
+		}
+		registered := c.cc != nil
+		if !c.handle(command, params) {
+			return
+		}
+		if !registered && c.cc != nil {
+			c.conn.SetReadDeadline(time.Time{}) // Registered: idle as long as the session lasts
+		}
+	}
+	if c.cc == nil && errors.Is(scanner.Err(), os.ErrDeadlineExceeded) {
+		c.write("", "ERROR", "Closing link: registration timed out")
+	}
+	if c.cc != nil { // Connection dropped without QUIT
+		c.cc.send(newPacket(msgQuit))
+		c.cc.link.flush(time.Second)
+	}
+}
+
+// handle acts on one command, returning false once the connection should close
+func (c *ircConn) handle(command string, params []string) bool {
+	switch command {
+	case "PING":
+		c.write(ircServerName, "PONG", ircServerName, strings.Join(params, " "))
+		return true
+	case "PONG":
+		return true
+	case "CAP": // No capabilities to offer
+		if len(params) > 0 && strings.EqualFold(params[0], "LS") {
+			c.write(ircServerName, "CAP", "*", "LS", "")
+		} else if len(params) > 1 && strings.EqualFold(params[0], "REQ") {
+			c.write(ircServerName, "CAP", "*", "NAK", params[1])
+		}
+		return true
+	case "QUIT":
+		if c.cc != nil {
+			c.cc.send(newPacket(msgQuit))
+			c.cc.link.flush(time.Second)
+		}
+		c.write("", "ERROR", "Closing link")
+		return false
+	}
+
+	if c.cc == nil {
+		return c.register(command, params)
+	}
+
+	need := map[string]int{"NICK": 1, "JOIN": 1, "PART": 1, "PRIVMSG": 2, "TOPIC": 1, "KICK": 2}
+	if len(params) < need[command] {
+		c.numeric("461", command, "Not enough parameters")
+		return true
+	}
+	switch command {
+	case "NICK":
+		c.cc.send(newPacket(msgRename, params[0])) // Takes effect with the rename event
+
+	case "JOIN":
+		target := strings.Split(params[0], ",")[0] // One room at a time
+		if target == "0" {
+			c.cc.send(newPacket(msgLeave))
+		} else {
+			c.cc.send(newPacket(msgJoin, target))
+		}
+
+	case "PART":
+		if !c.inRoom(params[0]) {
+			c.numeric("442", params[0], "You're not on that channel")
+			return true
+		}
+		c.cc.send(newPacket(msgLeave))
+
+	case "PRIVMSG":
+		target, text := params[0], params[1]
+		if action, ok := strings.CutPrefix(text, "\x01ACTION "); ok {
+			text = "* " + c.currentNick() + " " + strings.TrimSuffix(action, "\x01")
+		} else if strings.HasPrefix(text, "\x01") {
+			return true // Other CTCP requests are not supported
+		}
+		if !strings.HasPrefix(target, "#") {
+			c.cc.send(c.whispers.queue(target, text)) // Encrypted once the key arrives
+			return true
+		}
+		if !c.inRoom(target) {
+			c.numeric("404", target, "Cannot send to channel (join it first)")
+			return true
+		}
+		c.cc.send(newPacket(msgChat, text))
+
+	case "TOPIC":
+		if !c.inRoom(params[0]) {
+			c.numeric("442", params[0], "You're not on that channel")
+			return true
+		}
+		topic := ""
+		if len(params) > 1 {
+			topic = params[1]
+		}
+		c.cc.send(newPacket(msgTopic, topic))
+
+	case "WHO":
+		who := "*"
+		if len(params) > 0 {
+			who = params[0]
+		}
+		c.mu.Lock()
+		c.whoPending = who
+		c.mu.Unlock()
+		c.cc.send(newPacket(msgUsers))
+
+	case "KICK":
+		c.cc.send(newPacket(msgKick, params[1])) // Kicks from the chat, whatever the channel
+
+	case "AWAY":
+		if len(params) == 0 || params[0] == "" {
+			c.cc.send(newPacket(msgPresence, presenceOnline, ""))
+		} else {
+			c.cc.send(newPacket(msgPresence, presenceAway, params[0]))
+		}
+
+	case "NOTICE", "MODE", "USER", "PASS":
+		// Never answered (NOTICE), or meaningless once registered
+
+	default:
+		c.numeric("421", command, "Unknown command")
+	}
+	return true
+}
+
+// inRoom reports whether channel names the client's current room
+func (c *ircConn) inRoom(channel string) bool {
+	name, err := normalizeRoom(channel)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return err == nil && name == c.room
+}
+
+// register collects NICK, USER and PASS and logs in once it has both names
+func (c *ircConn) register(command string, params []string) bool {
+	switch command {
+	case "PASS":
+		if len(params) > 0 {
+			c.pass = params[0]
+		}
+	case "NICK":
+		if len(params) > 0 {
+			c.setNick(params[0])
+		}
+	case "USER":
+		if len(params) > 0 {
+			c.user = params[0]
+		}
+	default:
+		c.numeric("451", "You have not registered")
+		return true
+	}
+	if c.currentNick() == "" || c.user == "" {
+		return true
+	}
+
+	err := c.login()
+	var refused *loginError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &refused) && strings.HasPrefix(refused.text, "Username already taken"):
+		c.numeric("433", c.currentNick(), "Nickname is already in use")
+		c.setNick("") // Wait for another NICK
+		return true
+	case errors.Is(err, errPasswordRequired), errors.As(err, &refused) && strings.Contains(refused.text, "password"):
+		c.numeric("464", "Password incorrect (use your account password as the server password)")
+	default:
+		c.notice(err.Error())
+	}
+	c.write("", "ERROR", "Closing link: "+err.Error())
+	return false
+}
+
+// login connects to the chat server under the current nick and starts relaying its packets
+func (c *ircConn) login() error {
+	nick := c.currentNick()
+	server := c.bridge.mem.dial("irc/" + c.conn.RemoteAddr().String())
+	channel, err := clientHandshake(server, ircServerName, nil) // In-process, so nothing to pin
+	if err != nil {
+		server.Close()
+		return err
+	}
+	cc := newClientConn(server, channel)
+	cc.send(Packet{kind: msgRegister, fields: [][]byte{[]byte(nick), nil, nil, []byte(eventFormatJSON)}})
+	authed := false
+	_, backlog, err := cc.awaitWelcome(ircLoginTimeout, func(challenge Packet) (Packet, error) {
+		if c.pass == "" {
+			return Packet{}, errPasswordRequired
+		}
+		authed = true // Welcomed only if the password is right
+		return challengeAnswer(challenge, c.pass)
+	})
+	if err != nil {
+		server.Close()
+		return err
+	}
+	keys, err := sessionKeys(c.bridge.keysPath, nick, authed) // Stored keys for accounts only
+	if err != nil {
+		server.Close()
+		return err
+	}
+	cc.send(keys.publish())
+
+	c.server, c.cc = server, cc
+	c.whispers = newWhisperer(keys, &knownUsers{}) // No pins: IRC clients could not act on them
+	c.numeric("001", "Welcome to GoChat, "+nick)
+	c.numeric("002", "Your host is "+ircServerName)
+	c.numeric("003", "This server was bridged from GoChat")
+	c.numeric("004", ircServerName, "gochat", "o", "o")
+	c.numeric("422", "MOTD File is missing")
+
+	go c.pump(backlog)
+	return nil
+}
+
+// pump relays packets from the chat server to the IRC client and keeps the
+// reliable link and heartbeats going, closing the IRC connection when the
+// session ends
+func (c *ircConn) pump(backlog []Packet) {
+	for _, pkt := range backlog {
+		c.relay(pkt)
+	}
+	buf := make([]byte, maxDatagramSize)
+	for {
+		c.cc.keepAlive(time.Now())
+		c.server.SetReadDeadline(time.Now().Add(retransmitTick))
+		n, err := c.server.Read(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if c.cc.link.retransmit(time.Now()) == 0 {
+					continue
+				}
+				c.cc.conn.Close() // Stalled for good: end the session
+			}
+			c.conn.Close() // Server gone: end the IRC side too
+			return
+		}
+		for _, pkt := range c.cc.receive(buf[:n]) {
+			c.relay(pkt)
+		}
+	}
+}
+
+// relay translates one packet from the chat server into IRC
+func (c *ircConn) relay(pkt Packet) {
+	switch pkt.kind {
+	case msgRoom:
+		room, topic, nick := pkt.field(0), pkt.field(1), c.currentNick()
+		c.mu.Lock()
+		old := c.room
+		c.room = room
+		c.mu.Unlock()
+		if old != "" {
+			c.write(mask(nick), "PART", "#"+old)
+		}
+		c.write(mask(nick), "JOIN", "#"+room)
+		if topic != "" {
+			c.numeric("332", "#"+room, topic)
+		} else {
+			c.numeric("331", "#"+room, "No topic is set")
+		}
+		c.numeric("353", "=", "#"+room, nick)
+		c.numeric("366", "#"+room, "End of /NAMES list")
+
+	case msgEvent:
+		ev, err := decodeEvent(pkt)
+		if err != nil {
+			return
+		}
+		for _, ev := range c.whispers.openEvent(ev) {
+			c.relayEvent(ev)
+		}
+
+	case msgKey:
+		out, notice := c.whispers.keyArrived(pkt)
+		for _, w := range out {
+			c.cc.send(w)
+		}
+		if notice != "" {
+			c.notice(notice)
+		}
+	}
+}
+
+// relayEvent turns a chat event into the IRC message for it, or a notice
+func (c *ircConn) relayEvent(ev event) {
+	nick := c.currentNick()
+	switch ev.Type {
+	case eventChat:
+		if ev.Sender != nick { // IRC clients show their own messages already
+			c.write(mask(ev.Sender), "PRIVMSG", "#"+ev.Room, ev.Text)
+		}
+
+	case eventJoin:
+		if ev.Sender != nick { // Our own join came with msgRoom
+			c.write(mask(ev.Sender), "JOIN", "#"+ev.Room)
+		}
+
+	case eventLeave:
+		switch ev.Reason {
+		case leaveMoved:
+			c.write(mask(ev.Sender), "PART", "#"+ev.Room, "Left for #"+ev.Target)
+		case leaveKicked:
+			c.write(mask(ev.Target), "KICK", "#"+ev.Room, ev.Sender, "Kicked by "+ev.Target)
+		default:
+			c.write(mask(ev.Sender), "QUIT", ircQuitReasons[ev.Reason])
+		}
+
+	case eventRename:
+		c.write(mask(ev.Sender), "NICK", ev.Target)
+		if ev.Sender == nick {
+			c.setNick(ev.Target)
+		}
+
+	case eventTopic:
+		switch {
+		case ev.Sender != "":
+			c.write(mask(ev.Sender), "TOPIC", "#"+ev.Room, ev.Text)
+		case ev.Text != "":
+			c.numeric("332", "#"+ev.Room, ev.Text)
+		default:
+			c.numeric("331", "#"+ev.Room, "No topic is set")
+		}
+
+	case eventTyping: // IRC has no typing indicator
+
+	case eventWhisper:
+		c.write(mask(ev.Sender), "PRIVMSG", nick, ev.Text)
+
+	case eventUserList:
+		c.mu.Lock()
+		who := c.whoPending
+		c.whoPending = ""
+		c.mu.Unlock()
+		if who == "" {
+			c.notice(ircRenderer.render(ev))
+			return
+		}
+		for _, u := range ev.Users { // Answer to our WHO
+			if who != "*" && who != u.Name && who != "#"+u.Room {
+				continue
+			}
+			here := "H"
+			if u.Presence == presenceAway || u.Presence == presenceBusy {
+				here = "G" // Gone
+			}
+			c.numeric("352", "#"+u.Room, u.Name, ircServerName, ircServerName, u.Name, here, "0 "+u.Name)
+		}
+		c.numeric("315", who, "End of WHO list")
+
+	case eventPresence:
+		switch {
+		case ev.Reason == presenceReply: // Whispered to someone away
+			message := ev.Text
+			if message == "" {
+				message = "I am " + ev.Presence
+			}
+			c.numeric("301", ev.Sender, message)
+		case ev.Sender == nick && ev.Reason != presenceStatus && ev.Presence == presenceOnline:
+			c.numeric("305", "You are no longer marked as being away")
+		case ev.Sender == nick && ev.Reason != presenceStatus:
+			c.numeric("306", "You have been marked as being away")
+		default:
+			c.notice(ircRenderer.render(ev))
+		}
+
+	case eventError:
+		c.notice("Error: " + ev.Text)
+
+	default: // Announcements, lists, stats, history and other notices
+		c.notice(ircRenderer.render(ev))
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestParseIRCLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		command string
+		params  []string
+	}{
+		{"NICK alice\r\n", "NICK", []string{"alice"}},
+		{"USER alice 0 * :Alice Liddell", "USER", []string{"alice", "0", "*", "Alice Liddell"}},
+		{":alice!a@host privmsg #go :hello: world", "PRIVMSG", []string{"#go", "hello: world"}},
+		{"PRIVMSG bob ::)", "PRIVMSG", []string{"bob", ":)"}},
+		{"QUIT", "QUIT", []string{}},
+		{":prefix-only", "", nil},
+		{"", "", nil},
+	}
+	for _, tt := range tests {
+		command, params := parseIRCLine(tt.line)
+		if command != tt.command || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("parseIRCLine(%q) = %q %q, want %q %q", tt.line, command, params, tt.command, tt.params)
+		}
+	}
+}
+
+// testIRC is an IRC client connection for tests
+type testIRC struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// send writes one IRC line
+func (c *testIRC) send(line string) {
+	c.conn.Write([]byte(line + "\r\n"))
+}
+
+// waitFor reads lines until one contains want
+func (c *testIRC) waitFor(t *testing.T, want string) {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("no %q from bridge: %v", want, err)
+		}
+		if strings.Contains(line, want) {
+			return
+		}
+	}
+}
+
+func TestIRCBridge(t *testing.T) {
+	s := newServer()
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newIRCBridge(mem, filepath.Join(t.TempDir(), defaultIRCIdentities)).serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	irc := &testIRC{conn: conn, r: bufio.NewReader(conn)}
+	irc.send("NICK ircy")
+	irc.send("USER ircy 0 * :IRC User")
+	irc.waitFor(t, " 001 ircy ")
+	irc.waitFor(t, ":ircy!ircy@gochat JOIN :#lobby")
+
+	native := mem.dial("alice")
+	channel := testRegister(t, native, "alice")
+	irc.waitFor(t, ":alice!alice@gochat JOIN :#lobby")
+	testSend(t, native, channel, newPacket(msgChat, "hi irc"), 2)
+	irc.waitFor(t, ":alice!alice@gochat PRIVMSG #lobby :hi irc")
+
+	irc.send("PRIVMSG #lobby :hello native")
+	waitForText(t, native, channel, "hello native")
+
+	irc.send("WHO #lobby")
+	irc.waitFor(t, " 352 ircy #lobby alice ")
+	irc.waitFor(t, " 315 ircy #lobby ")
+
+	irc.send("AWAY :in a meeting")
+	irc.waitFor(t, " 306 ircy ")
+	waitForText(t, native, channel, "ircy is away: in a meeting")
+	irc.send("AWAY")
+	irc.waitFor(t, " 305 ircy ")
+
+	irc.send("NICK ircy2")
+	irc.waitFor(t, ":ircy!ircy@gochat NICK :ircy2")
+	waitForText(t, native, channel, "ircy changed name to ircy2")
+
+	irc.send("JOIN #go")
+	irc.waitFor(t, ":ircy2!ircy2@gochat PART :#lobby")
+	irc.waitFor(t, ":ircy2!ircy2@gochat JOIN :#go")
+	irc.send("PRIVMSG #lobby :wrong room")
+	irc.waitFor(t, " 404 ircy2 #lobby ")
+
+	irc.send("QUIT")
+	waitForText(t, native, channel, "ircy2 left")
+}
+
+func TestIRCNickInUse(t *testing.T) {
+	s := newServer()
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+	testRegister(t, mem.dial("alice"), "alice")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newIRCBridge(mem, filepath.Join(t.TempDir(), defaultIRCIdentities)).serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	irc := &testIRC{conn: conn, r: bufio.NewReader(conn)}
+	irc.send("NICK alice")
+	irc.send("USER alice 0 * :Imposter")
+	irc.waitFor(t, " 433 * alice ")
+	irc.send("NICK alice2")
+	irc.waitFor(t, " 001 alice2 ")
+}
+
+func TestIRCLineBreaksCannotInjectCommands(t *testing.T) {
+	s := newServer()
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newIRCBridge(mem, filepath.Join(t.TempDir(), defaultIRCIdentities)).serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	irc := &testIRC{conn: conn, r: bufio.NewReader(conn)}
+	irc.send("NICK ircy")
+	irc.send("USER ircy 0 * :IRC User")
+	irc.waitFor(t, ":ircy!ircy@gochat JOIN :#lobby")
+
+	native := mem.dial("alice")
+	channel := testRegister(t, native, "alice")
+	testSend(t, native, channel, newPacket(msgChat, "hi\r\n:bob!bob@gochat KICK #lobby ircy :bye\x00"), 2)
+	irc.waitFor(t, ":alice!alice@gochat PRIVMSG #lobby :hi :bob!bob@gochat KICK #lobby ircy :bye\r\n")
+
+	// Names that would break a nick!user@host prefix are refused
+	for _, name := range []string{"bad name", "bad:name", "bad\nname"} {
+		conn := mem.dial(name)
+		channel, err := clientHandshake(conn, "localhost", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testSend(t, conn, channel, Packet{kind: msgRegister, fields: [][]byte{[]byte(name), nil, nil, []byte(eventFormatJSON)}}, 1)
+		if ev := waitForEvent(t, conn, channel, eventError); !strings.Contains(ev.Text, "cannot contain") {
+			t.Errorf("register %q: %q", name, ev.Text)
+		}
+	}
+}
+
+func TestIRCLongLinesKeepCharactersWhole(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := &ircConn{conn: server}
+	// After the odd-length ":gochat NOTICE ircy :", byte 510 is inside a character
+	go c.write(ircServerName, "NOTICE", "ircy", strings.Repeat("é", ircMaxLine))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(line) > ircMaxLine || !utf8.ValidString(line) || !strings.HasSuffix(line, "é\r\n") {
+		t.Errorf("got a %d-byte line ending %q, want at most %d bytes of whole characters", len(line), line[len(line)-4:], ircMaxLine)
+	}
+}
+
+func TestIRCRegistrationDeadline(t *testing.T) {
+	s := newServer()
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	bridge := newIRCBridge(mem, filepath.Join(t.TempDir(), defaultIRCIdentities))
+	bridge.registerTimeout = 300 * time.Millisecond
+	go bridge.serve(ln)
+
+	dial := func() *testIRC {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return &testIRC{conn: conn, r: bufio.NewReader(conn)}
+	}
+	idle, ircy := dial(), dial()
+	idle.send("NICK idle") // Never sends USER
+	ircy.send("NICK ircy")
+	ircy.send("USER ircy 0 * :IRC User")
+	ircy.waitFor(t, " 001 ircy ")
+
+	idle.waitFor(t, "ERROR :Closing link: registration timed out")
+	if _, err := idle.r.ReadString('\n'); err == nil {
+		t.Error("unregistered connection still open")
+	}
+	time.Sleep(bridge.registerTimeout)
+	ircy.send("PING :still")
+	ircy.waitFor(t, "PONG")
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
-	"fmt" // For formatted I/O
-	"os"  // For OS operations
+	"flag" // For client options
+	"fmt"  // For formatted I/O
+	"log"  // For bad options
+	"os"   // For OS operations
+	"time" // For time zones
 )
 
 // main is the entry point of the application
@@ -10,24 +13,62 @@ func main() {
 	// Check command line arguments
 	if len(os.Args) < 2 {
 		fmt.Println("Usage:")
-		fmt.Println("  Server: go run . server")
-		fmt.Println("  Client: go run . client <server-address> <username>")
+		fmt.Println("  Server: go run . server [-config gochat.json] [-udp :8080] [-tcp :8081] [-max-users n] [-motd text] [-log file]")
+		fmt.Println("  Client: go run . client [-tcp] [-json] [-theme dark|light|none] [-no-color] [-tui=false] [-clock 12|24] [-tz zone] <server-address> <username>")
+		fmt.Println("  Account: go run . useradd <username> [--admin]")
 		return
 	}
 
 	mode := os.Args[1] // First argument is mode (server/client)
 	switch mode {
 	case "server":
-		startServer() // Start in server mode
+		startServer(os.Args[2:]) // Start in server mode
 	case "client":
+		fs := flag.NewFlagSet("client", flag.ExitOnError)
+		useTCP := fs.Bool("tcp", false, "connect over TCP instead of UDP")
+		jsonMode := fs.Bool("json", false, "print server events as JSON lines, for scripts and bots")
+		themeName := fs.String("theme", "dark", "colors: dark, light or none")
+		useTUI := fs.Bool("tui", true, "full-screen interface on a terminal (-tui=false for a simple prompt)")
+		noColor := fs.Bool("no-color", false, "write no colors or other escape codes (also with $NO_COLOR, TERM=dumb or redirected output)")
+		clock := fs.String("clock", "", "12 or 24-hour clock (default: from the locale)")
+		tz := fs.String("tz", "", "time zone for timestamps, e.g. Europe/Paris (default: local)")
+		fs.Parse(os.Args[2:])
 		// Client mode requires additional arguments
-		if len(os.Args) < 4 {
-			fmt.Println("Client usage: go run . client <server-address> <username>")
+		if fs.NArg() < 2 {
+			fmt.Println("Client usage: go run . client [-tcp] [-json] [-theme dark|light|none] [-no-color] [-tui=false] [-clock 12|24] [-tz zone] <server-address> <username>")
 			return
 		}
+		loc := time.Local
+		if *tz != "" {
+			var err error
+			if loc, err = time.LoadLocation(*tz); err != nil {
+				log.Fatal("Bad -tz: ", err)
+			}
+		}
+		plain := *noColor || !colorAllowed(os.Stdout)
+		if plain {
+			*themeName = "none"
+		}
+		render, err := newRenderer(*themeName, loc)
+		if err != nil {
+			log.Fatal("Bad -theme: ", err)
+		}
+		switch *clock {
+		case "12", "24":
+			render.clock24 = *clock == "24"
+		case "":
+		default:
+			log.Fatal("Bad -clock: use 12 or 24")
+		}
 		// Start client with provided server address and username
-		startClient(os.Args[2], os.Args[3])
+		interactive := isTerminal(os.Stdin) && isTerminal(os.Stdout)
+		startClient(fs.Arg(0), fs.Arg(1), clientOptions{
+			useTCP: *useTCP, jsonMode: *jsonMode, render: render,
+			plain: plain, interactive: interactive, tui: *useTUI && interactive && !plain && !*jsonMode,
+		})
+	case "useradd":
+		runUserAdd(os.Args[2:]) // Create or reset an account in the user store
 	default:
-		fmt.Println("Invalid mode. Use 'server' or 'client'")
+		fmt.Println("Invalid mode. Use 'server', 'client' or 'useradd'")
 	}
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net"  // For the net.Conn interface
+	"os"   // For deadline errors
+	"sync" // For closing once
+	"time" // For read deadlines
+)
+
+// memTransport is an in-process Transport: clients made with dial talk to the
+// server through channels, so tests can run whole sessions without sockets
+type memTransport struct {
+	packets chan received
+	done    chan struct{}
+	once    sync.Once
+}
+
+// memAddr names an in-memory client
+type memAddr string
+
+// memConn is the client's end of an in-memory connection. It reads and writes
+// whole packets like a connected UDP socket.
+type memConn struct {
+	t      *memTransport
+	addr   memAddr
+	inbox  chan []byte // Packets from the server
+	closed chan struct{}
+	once   sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time // Read deadline, checked when Read starts
+}
+
+// memPeer is the server's handle on a memConn
+type memPeer struct {
+	conn *memConn
+}
+
+// newMemTransport creates an in-memory transport with no clients
+func newMemTransport() *memTransport {
+	return &memTransport{packets: make(chan received, 64), done: make(chan struct{})}
+}
+
+// dial connects a new client called name
+func (t *memTransport) dial(name string) net.Conn {
+	return &memConn{t: t, addr: memAddr(name), inbox: make(chan []byte, 256), closed: make(chan struct{})}
+}
+
+// Receive returns the next packet from any client
+func (t *memTransport) Receive() ([]byte, Peer, error) {
+	select {
+	case r := <-t.packets:
+		return r.data, r.from, nil
+	case <-t.done:
+		return nil, nil, net.ErrClosed
+	}
+}
+
+// Close disconnects the transport; clients' reads and writes fail from now on
+func (t *memTransport) Close() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// Addr returns the client's name
+func (p *memPeer) Addr() net.Addr {
+	return p.conn.addr
+}
+
+// Send queues data for the client, dropping it (like UDP) if the client is
+// gone or not keeping up
+func (p *memPeer) Send(data []byte) error {
+	select {
+	case <-p.conn.closed:
+	case p.conn.inbox <- append([]byte(nil), data...):
+	default:
+	}
+	return nil
+}
+
+// Read returns the next packet from the server
+func (c *memConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case data := <-c.inbox:
+		return copy(b, data), nil
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.t.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// Write sends b to the server as one packet
+func (c *memConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.t.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	select {
+	case c.t.packets <- received{append([]byte(nil), b...), &memPeer{c}}:
+		return len(b), nil
+	case <-c.t.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// Close disconnects the client, which the server sees like a closed TCP connection
+func (c *memConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		select {
+		case c.t.packets <- received{nil, &memPeer{c}}:
+		case <-c.t.done:
+		}
+	})
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.addr }
+func (c *memConn) RemoteAddr() net.Addr { return memAddr("server") }
+
+// SetDeadline sets the read deadline; writes never block for long
+func (c *memConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline makes later Reads give up at t (zero means never)
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline is a no-op
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"          // For presence errors
+	"time"         // For idle detection
+	"unicode/utf8" // For message length limits
+)
+
+// Presence states
+const (
+	presenceOnline = "online" // Around (everyone starts here)
+	presenceAway   = "away"   // Not at the keyboard
+	presenceBusy   = "busy"   // Around, but rather not disturbed
+)
+
+const (
+	defaultAwayAfter = 15 * time.Minute // Idle time before the server marks someone away
+	maxStatusLength  = 100              // Longest away message or status text, in characters
+)
+
+// setPresence changes client's presence and away message and tells its room.
+// auto marks the changes the server makes itself around idling (caller holds s.mu).
+func (s *Server) setPresence(client *Client, presence, message string, auto bool) {
+	switch presence {
+	case presenceOnline:
+		message = ""
+	case presenceAway, presenceBusy:
+	default:
+		s.sendError(client, fmt.Sprintf("Unknown presence %q", presence))
+		return
+	}
+	if utf8.RuneCountInString(message) > maxStatusLength {
+		s.sendError(client, fmt.Sprintf("Away messages are limited to %d characters", maxStatusLength))
+		return
+	}
+	if client.presence == presence && client.awayMessage == message {
+		if presence == presenceOnline {
+			s.sendError(client, "You are not away")
+		} else {
+			s.sendError(client, fmt.Sprintf("You are already %s", presence))
+		}
+		return
+	}
+	client.presence, client.awayMessage = presence, message
+	client.autoAway = auto && presence == presenceAway
+	ev := s.presenceEvent(client)
+	if auto {
+		ev.Reason = presenceIdle
+	}
+	s.broadcast(ev)
+}
+
+// setStatus changes client's status text, shown in /users, and tells its room (caller holds s.mu)
+func (s *Server) setStatus(client *Client, text string) {
+	if utf8.RuneCountInString(text) > maxStatusLength {
+		s.sendError(client, fmt.Sprintf("Status texts are limited to %d characters", maxStatusLength))
+		return
+	}
+	if text == client.status {
+		s.sendError(client, "Your status is unchanged")
+		return
+	}
+	client.status = text
+	ev := s.presenceEvent(client)
+	ev.Reason = presenceStatus
+	s.broadcast(ev)
+}
+
+// presenceEvent describes client's presence, away message and status (caller holds s.mu)
+func (s *Server) presenceEvent(client *Client) event {
+	ev := s.newEvent(eventPresence)
+	ev.Room, ev.Sender, ev.Role = client.room, client.name, client.role
+	ev.Presence, ev.Text, ev.Status = client.presence, client.awayMessage, client.status
+	return ev
+}
+
+// noteActivity records that client's user did something, which ends an away
+// the server set for idling (caller holds s.mu)
+func (s *Server) noteActivity(client *Client, kind MsgType) {
+	if kind == msgUsers || kind == msgKeyRequest || kind == msgKeys {
+		return // Clients send these on their own, e.g. to keep a user list fresh
+	}
+	client.lastSeen = time.Now()
+	if client.autoAway && kind != msgPresence { // Unless setting a presence of their own
+		s.setPresence(client, presenceOnline, "", true)
+	}
+}
+
+// markIdle sets clients whose users have done nothing for s.awayAfter away (caller holds s.mu)
+func (s *Server) markIdle(now time.Time) {
+	if s.awayAfter <= 0 {
+		return // Turned off
+	}
+	for _, c := range s.clients {
+		if c.authed && c.presence == presenceOnline && now.Sub(c.lastSeen) >= s.awayAfter {
+			s.setPresence(c, presenceAway, "", true)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRegisterJSON logs name in over conn in JSON mode, with made-up whisper keys
+func testRegisterJSON(t *testing.T, conn net.Conn, name string) *secureChannel {
+	channel, err := clientHandshake(conn, "localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := Packet{kind: msgRegister, fields: [][]byte{
+		[]byte(name), make([]byte, x25519KeySize), make([]byte, 32), []byte(eventFormatJSON),
+	}}
+	testSend(t, conn, channel, keys, 1)
+	waitForEvent(t, conn, channel, eventJoin)
+	return channel
+}
+
+// waitForPresence reads events until a presence event about sender with the given reason
+func waitForPresence(t *testing.T, conn net.Conn, channel *secureChannel, sender, reason string) event {
+	for {
+		if ev := waitForEvent(t, conn, channel, eventPresence); ev.Sender == sender && ev.Reason == reason {
+			return ev
+		}
+	}
+}
+
+func TestPresence(t *testing.T) {
+	s := newServer()
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	bob := mem.dial("bob")
+	bobChannel := testRegisterJSON(t, bob, "bob")
+	alice := mem.dial("alice")
+	aliceChannel := testRegisterJSON(t, alice, "alice")
+
+	testSend(t, alice, aliceChannel, newPacket(msgPresence, presenceAway, "lunch"), 2)
+	if ev := waitForPresence(t, bob, bobChannel, "alice", ""); ev.Presence != presenceAway || ev.Text != "lunch" {
+		t.Errorf("presence event = %+v, want away: lunch", ev)
+	}
+	testSend(t, alice, aliceChannel, newPacket(msgStatus, "reviewing"), 3)
+	if ev := waitForPresence(t, bob, bobChannel, "alice", presenceStatus); ev.Status != "reviewing" || ev.Presence != presenceAway {
+		t.Errorf("status event = %+v", ev)
+	}
+
+	// Whispering to someone away tells you so
+	testSend(t, bob, bobChannel, newPacket(msgWhisper, "alice", "sealed"), 2)
+	if ev := waitForPresence(t, bob, bobChannel, "alice", presenceReply); describePresence(ev) != "alice is away: lunch" {
+		t.Errorf("whisper reply = %q", describePresence(ev))
+	}
+
+	testSend(t, bob, bobChannel, newPacket(msgUsers), 3)
+	users := waitForEvent(t, bob, bobChannel, eventUserList).Users
+	for _, u := range users {
+		if u.Name == "alice" && (u.Presence != presenceAway || u.Away != "lunch" || u.Status != "reviewing") {
+			t.Errorf("alice in /users = %+v", u)
+		}
+	}
+	text := (&renderer{theme: themes["none"], loc: time.UTC}).render(event{Type: eventUserList, Users: users})
+	if !strings.Contains(text, "alice #lobby (away: lunch) - reviewing") {
+		t.Errorf("user list:\n%s", text)
+	}
+
+	testSend(t, alice, aliceChannel, newPacket(msgPresence, presenceOnline, ""), 4)
+	if ev := waitForPresence(t, bob, bobChannel, "alice", ""); ev.Presence != presenceOnline {
+		t.Errorf("presence event = %+v, want back online", ev)
+	}
+	testSend(t, alice, aliceChannel, newPacket(msgPresence, "asleep", ""), 5)
+	waitForEvent(t, alice, aliceChannel, eventError)
+}
+
+func TestAutoAway(t *testing.T) {
+	s := newServer()
+	s.heartbeat, s.heartbeatMisses, s.awayAfter = 20*time.Millisecond, 1000, 100*time.Millisecond
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	bob := mem.dial("bob")
+	bobChannel := testRegisterJSON(t, bob, "bob")
+	for end := time.Now().Add(2 * s.awayAfter); time.Now().Before(end); time.Sleep(s.heartbeat) {
+		testSend(t, bob, bobChannel, newPacket(msgUsers), 0) // Automatic, so still idle (and heard from)
+	}
+	if ev := waitForPresence(t, bob, bobChannel, "bob", presenceIdle); ev.Presence != presenceAway {
+		t.Fatalf("idle event = %+v, want away", ev)
+	}
+
+	testSend(t, bob, bobChannel, newPacket(msgChat, "back already"), 2)
+	if ev := waitForPresence(t, bob, bobChannel, "bob", presenceIdle); ev.Presence != presenceOnline {
+		t.Errorf("activity event = %+v, want back online", ev)
+	}
+}
+
+func TestManyClientsGoIdleAtOnce(t *testing.T) {
+	s := newServer()
+	s.messages = make(chan outbatch, 1) // Fewer than the clients going idle
+	s.awayAfter = time.Minute
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		testClient(s, name).presence = presenceOnline // Never seen, so idle
+	}
+	go s.broadcastMessages()
+
+	done := make(chan struct{})
+	go func() {
+		s.mu.Lock()
+		s.markIdle(time.Now())
+		s.unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("marking clients idle blocked")
+	}
+	for name, c := range s.clients {
+		if c.presence != presenceAway {
+			t.Errorf("%s is %s, want away", name, c.presence)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"           // For recognizing old text commands
+	"encoding/binary" // For big-endian length prefixes
+	"errors"          // For sentinel decode errors
+	"fmt"             // For wrapped error messages
+)
+
+// Wire format (all integers big-endian):
+//
+//	+-------+---------+------+-------+-------+---------+--------+-----------------------------+
+//	| magic | version | type | flags | [seq] | [token] | fields | fields × (uint16 len, data) |
+//	| 1 B   | 1 B     | 1 B  | 1 B   | 4 B   | 16 B    | 1 B    | ...                         |
+//	+-------+---------+------+-------+-------+---------+--------+-----------------------------+
+//
+// seq is only present when flagReliable is set, token only when flagSession is set.
+// Apart from the msgHello/msgServerHello key exchange, packets travel encrypted
+// inside msgSealed packets (see secure.go).
+const (
+	protocolMagic   = 0xC7   // First byte of every GoChat packet
+	protocolVersion = 2      // Wire protocol version spoken by this build (2: encrypted sessions)
+	headerSize      = 5      // magic + version + type + flags + field count
+	seqSize         = 4      // Sequence number of reliable packets
+	tokenSize       = 16     // Session token issued at registration
+	maxFields       = 255    // Field count is a single byte
+	maxFieldSize    = 0xFFFF // Field lengths are uint16
+)
+
+// Packet flags
+const (
+	flagReliable byte = 1 << 0 // Packet carries a sequence number and must be acknowledged
+	flagSession  byte = 1 << 1 // Packet carries the sender's session token
+)
+
+// MsgType identifies what a packet carries
+type MsgType byte
+
+// Client → server message types
+const (
+	msgRegister   MsgType = iota + 1 // [username, whisper X25519 key, whisper ed25519 key, optional "json", optional resume ticket of a previous session]
+	msgChat                          // [text]
+	msgTyping                        // []
+	msgUsers                         // []
+	msgStats                         // []
+	msgHelp                          // []
+	msgMenu                          // []
+	msgRename                        // [new name]
+	msgWhisper                       // [target, end-to-end encrypted envelope (see whisper.go)]
+	msgQuit                          // []
+	msgKick                          // [target] (kick permission)
+	msgBroadcast                     // [text] (broadcast permission)
+	msgShutdown                      // [] (shutdown permission)
+	msgAuth                          // [HMAC-SHA256(password key, nonce)]
+	msgMute                          // [target] (mute permission)
+	msgUnmute                        // [target] (mute permission)
+	msgGrant                         // [target, role] (roles permission)
+	msgRevoke                        // [target] (roles permission)
+	msgHello                         // [client X25519 public key] (unencrypted, starts a session)
+	msgKeyRequest                    // [target] asks for a user's whisper keys
+	msgJoin                          // [room] moves to (or creates) a room
+	msgLeave                         // [] goes back to the lobby
+	msgRooms                         // []
+	msgTopic                         // [topic] sets the room topic; [""] shows it
+	msgHistory                       // [count] asks for the room's last messages
+	msgPresence                      // [presence ("online", "away" or "busy"), message for whoever whispers]
+	msgStatus                        // [status text] ("" clears it)
+	msgReload                        // [] rereads the server's config (reload permission)
+	msgKeys                          // [whisper X25519 key, whisper ed25519 key] publishes keys msgRegister left out
+)
+
+// Message types sent in both directions
+const (
+	msgAck       MsgType = iota + 0x30 // [cumulative seq, selective seqs] (unreliable)
+	msgFragment                        // [fragment header, chunk of an encoded packet]
+	msgSealed                          // [counter, encrypted packet] (see secure.go)
+	msgHeartbeat                       // [] (unreliable) sent by clients every heartbeat interval, echoed by the server
+)
+
+// Server → client message types
+const (
+	msgText        MsgType = iota + 0x40 // [rendered text]
+	msgError                             // [error text]
+	msgWelcome                           // [session token, username, role, permissions, heartbeat interval (ms), resume ticket, then if an old session was resumed: its room, last seq it delivered]
+	msgChallenge                         // [session token, salt, PBKDF2 iterations, nonce]
+	msgRole                              // [role, permissions] after a grant or revoke
+	msgServerHello                       // [session token, server X25519 key, identity key, signature]
+	msgKey                               // [username, whisper X25519 key, whisper ed25519 key], or just [username] if there is none
+	msgWhisperFrom                       // [sender, sender's whisper ed25519 key, envelope]
+	msgRoom                              // [room, topic] after joining a room
+	msgEvent                             // [JSON event] replaces text, errors and whispers in JSON mode (see events.go)
+)
+
+// Decode errors
+var (
+	errLegacyPacket       = errors.New("legacy text packet (protocol v0) is not supported")
+	errUnsupportedVersion = errors.New("unsupported protocol version")
+	errTruncatedPacket    = errors.New("truncated packet")
+)
+
+// Packet is a single decoded protocol message
+type Packet struct {
+	kind   MsgType  // Message type
+	flags  byte     // Flag bits
+	seq    uint32   // Sequence number (only with flagReliable)
+	token  []byte   // Session token (only with flagSession)
+	fields [][]byte // Length-prefixed payload fields
+}
+
+// newPacket builds a packet from string fields
+func newPacket(kind MsgType, fields ...string) Packet {
+	p := Packet{kind: kind, fields: make([][]byte, len(fields))}
+	for i, f := range fields {
+		p.fields[i] = []byte(f)
+	}
+	return p
+}
+
+// withToken returns a copy of p that carries the given session token
+func (p Packet) withToken(token []byte) Packet {
+	if len(token) == 0 {
+		return p
+	}
+	p.flags |= flagSession
+	p.token = token
+	return p
+}
+
+// field returns field i as a string, or "" if it is missing
+func (p Packet) field(i int) string {
+	if i < 0 || i >= len(p.fields) {
+		return ""
+	}
+	return string(p.fields[i])
+}
+
+// encodePacket serializes a packet into its wire format
+func encodePacket(p Packet) ([]byte, error) {
+	if len(p.fields) > maxFields {
+		return nil, fmt.Errorf("too many fields: %d (max %d)", len(p.fields), maxFields)
+	}
+
+	size := headerSize
+	if p.flags&flagReliable != 0 {
+		size += seqSize
+	}
+	if p.flags&flagSession != 0 {
+		if len(p.token) != tokenSize {
+			return nil, fmt.Errorf("session token is %d bytes, want %d", len(p.token), tokenSize)
+		}
+		size += tokenSize
+	}
+	for _, f := range p.fields {
+		if len(f) > maxFieldSize {
+			return nil, fmt.Errorf("field too large: %d bytes (max %d)", len(f), maxFieldSize)
+		}
+		size += 2 + len(f)
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, protocolMagic, protocolVersion, byte(p.kind), p.flags)
+	if p.flags&flagReliable != 0 {
+		buf = binary.BigEndian.AppendUint32(buf, p.seq)
+	}
+	if p.flags&flagSession != 0 {
+		buf = append(buf, p.token...)
+	}
+	buf = append(buf, byte(len(p.fields)))
+	for _, f := range p.fields {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(f)))
+		buf = append(buf, f...)
+	}
+	return buf, nil
+}
+
+// decodePacket parses a wire-format packet
+func decodePacket(data []byte) (Packet, error) {
+	if len(data) == 0 || data[0] != protocolMagic {
+		return Packet{}, errLegacyPacket // Old "PREFIX:" text or garbage
+	}
+	if len(data) < headerSize {
+		return Packet{}, errTruncatedPacket
+	}
+	if data[1] != protocolVersion {
+		return Packet{}, fmt.Errorf("%w: got v%d, want v%d", errUnsupportedVersion, data[1], protocolVersion)
+	}
+
+	p := Packet{kind: MsgType(data[2]), flags: data[3]}
+	rest := data[4:]
+	if p.flags&flagReliable != 0 {
+		if len(rest) < seqSize+1 {
+			return Packet{}, errTruncatedPacket
+		}
+		p.seq = binary.BigEndian.Uint32(rest)
+		rest = rest[seqSize:]
+	}
+	if p.flags&flagSession != 0 {
+		if len(rest) < tokenSize+1 {
+			return Packet{}, errTruncatedPacket
+		}
+		p.token = rest[:tokenSize:tokenSize]
+		rest = rest[tokenSize:]
+	}
+	p.fields = make([][]byte, rest[0])
+	rest = rest[1:]
+	for i := range p.fields {
+		if len(rest) < 2 {
+			return Packet{}, errTruncatedPacket
+		}
+		n := int(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+		if len(rest) < n {
+			return Packet{}, errTruncatedPacket
+		}
+		p.fields[i] = rest[:n:n] // Cap so appends never clobber the next field
+		rest = rest[n:]
+	}
+	if len(rest) != 0 {
+		return Packet{}, fmt.Errorf("%d trailing bytes after last field", len(rest))
+	}
+	return p, nil
+}
+
+// fromOldClient reports whether data, which failed to decode with err, came
+// from a GoChat client speaking another protocol: a v0 "PREFIX:" command or a
+// packet with our magic byte and another version. Other junk gets no answer.
+func fromOldClient(data []byte, err error) bool {
+	if errors.Is(err, errUnsupportedVersion) {
+		return true
+	}
+	if !errors.Is(err, errLegacyPacket) {
+		return false
+	}
+	prefix, _, ok := bytes.Cut(data, []byte(":"))
+	if !ok || len(prefix) < 3 || len(prefix) > 10 { // TYPING, REGISTER, BROADCAST...
+		return false
+	}
+	for _, c := range prefix {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// versionErrorText is sent (unframed) to peers speaking an incompatible protocol
+func versionErrorText(err error) string {
+	return fmt.Sprintf("\033[31mProtocol error: %v. Please upgrade your client (protocol v%d).\033[0m\n",
+		err, protocolVersion)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	in := newPacket(msgWhisper, "bob:the:builder", "KICK:not a command")
+	in.flags = 0x01
+
+	data, err := encodePacket(in)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	out, err := decodePacket(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if out.kind != in.kind || out.flags != in.flags || len(out.fields) != len(in.fields) {
+		t.Fatalf("header mismatch: got %+v, want %+v", out, in)
+	}
+	for i := range in.fields {
+		if !bytes.Equal(out.fields[i], in.fields[i]) {
+			t.Errorf("field %d: got %q, want %q", i, out.fields[i], in.fields[i])
+		}
+	}
+}
+
+func TestDecodeRejectsLegacyText(t *testing.T) {
+	for _, legacy := range []string{"REGISTER:alice", "KICK:bob", "hello"} {
+		if _, err := decodePacket([]byte(legacy)); !errors.Is(err, errLegacyPacket) {
+			t.Errorf("%q: got %v, want errLegacyPacket", legacy, err)
+		}
+	}
+}
+
+func TestDecodeRejectsOtherVersions(t *testing.T) {
+	data, _ := encodePacket(newPacket(msgChat, "hi"))
+	data[1] = protocolVersion + 1
+	if _, err := decodePacket(data); !errors.Is(err, errUnsupportedVersion) {
+		t.Fatalf("got %v, want errUnsupportedVersion", err)
+	}
+}
+
+func TestDecodeRejectsTruncated(t *testing.T) {
+	data, _ := encodePacket(newPacket(msgChat, "hello"))
+	for n := 1; n < len(data); n++ {
+		if _, err := decodePacket(data[:n]); err == nil {
+			t.Errorf("decoding %d of %d bytes succeeded", n, len(data))
+		}
+	}
+}
+
+func TestOnlyOldClientsHearAboutVersions(t *testing.T) {
+	other, _ := encodePacket(newPacket(msgChat, "hi"))
+	other[1] = protocolVersion + 1
+	for data, want := range map[string]bool{
+		"REGISTER:alice": true, "QUIT:bob": true, string(other): true,
+		"x": false, "hello": false, "register:alice": false, "\x00\x01:": false, "A:": false,
+	} {
+		_, err := decodePacket([]byte(data))
+		if got := fromOldClient([]byte(data), err); got != want {
+			t.Errorf("fromOldClient(%q) = %v, want %v", data, got, want)
+		}
+	}
+
+	l := newReplyLimiter(time.Minute)
+	now := time.Now()
+	host := func(port int) net.Addr { return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port} }
+	if !l.allow(host(1), now) {
+		t.Fatal("first reply refused")
+	}
+	if l.allow(host(2), now.Add(time.Second)) {
+		t.Error("same host answered twice within a minute")
+	}
+	if !l.allow(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1}, now) {
+		t.Error("another host refused")
+	}
+	if !l.allow(host(1), now.Add(time.Minute)) {
+		t.Error("host refused again after a minute")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"       // For the offline error
+	"math/rand/v2" // For backoff jitter
+	"sync"         // For swapping connections
+	"time"         // For backoff and liveness
+)
+
+const (
+	defaultHeartbeat = 5 * time.Second  // How often clients send a heartbeat, unless the server says otherwise
+	missedHeartbeats = 4                // Heartbeats missed before either side gives the other up (server default)
+	reconnectMin     = time.Second      // First wait before reconnecting
+	reconnectMax     = 30 * time.Second // Backoff ceiling
+)
+
+var errOffline = errors.New("not connected")
+
+// backoff returns how long to wait before reconnect attempt n (from 0): it
+// doubles from reconnectMin up to reconnectMax, give or take a quarter so
+// clients cut off together don't all come back at the same moment
+func backoff(attempt int) time.Duration {
+	d := reconnectMax
+	if attempt < 16 {
+		d = min(reconnectMin<<attempt, reconnectMax)
+	}
+	return d - d/4 + rand.N(d/2)
+}
+
+// connection is the client's current session with the server, replaced when
+// it reconnects. What is sent while there is none waits in a queue.
+type connection struct {
+	mu    sync.Mutex
+	cc    *clientConn // nil while reconnecting
+	queue []Packet    // Sent while disconnected, in order
+}
+
+// current returns the live session, or nil while reconnecting
+func (c *connection) current() *clientConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cc
+}
+
+// send reliably sends pkt, or queues it until the connection is back
+func (c *connection) send(pkt Packet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cc != nil {
+		return c.cc.send(pkt)
+	}
+	if len(c.queue) >= maxSendQueue {
+		return errSendQueueFull
+	}
+	c.queue = append(c.queue, pkt)
+	return nil
+}
+
+// sendUnreliable sends a packet that is cheap to lose; nothing is sent while offline
+func (c *connection) sendUnreliable(pkt Packet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cc == nil {
+		return errOffline
+	}
+	return c.cc.sendUnreliable(pkt)
+}
+
+// queued reports how many packets wait for the connection to come back
+func (c *connection) queued() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.queue)
+}
+
+// lost takes the session out of use and closes it. What it never got
+// acknowledged goes to the front of the queue, to be sent again; the
+// fragments of long messages are returned instead, since the server can't
+// complete them on a new session.
+func (c *connection) lost() (dropped []Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cc == nil {
+		return nil
+	}
+	var resend []Packet
+	for _, p := range c.cc.link.unacked() {
+		if p.kind == msgFragment {
+			dropped = append(dropped, p)
+		} else {
+			resend = append(resend, p)
+		}
+	}
+	c.queue = append(resend, c.queue...)
+	c.cc.conn.Close()
+	c.cc = nil
+	return dropped
+}
+
+// restore puts a new session in use and sends first, then everything queued, on
+// it. A resumed session reports the last packet of the old one it delivered;
+// those up to there are not sent twice. It returns how many queued packets it sent.
+func (c *connection) restore(cc *clientConn, delivered uint32, first ...Packet) (sent int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cc = cc
+	for _, pkt := range append(first, c.queue...) {
+		if pkt.seq != 0 && pkt.seq <= delivered {
+			continue // Arrived just before the old connection was given up on
+		}
+		cc.send(pkt)
+		sent++
+	}
+	c.queue = nil
+	return sent - len(first)
+}
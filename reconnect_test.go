@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for attempt, want := range []time.Duration{reconnectMin, 2 * reconnectMin, 4 * reconnectMin} {
+		if d := backoff(attempt); d < want*3/4 || d > want*5/4 {
+			t.Errorf("backoff(%d) = %v, want about %v", attempt, d, want)
+		}
+	}
+	for _, attempt := range []int{10, 100} {
+		if d := backoff(attempt); d < reconnectMax*3/4 || d > reconnectMax*5/4 {
+			t.Errorf("backoff(%d) = %v, want about %v", attempt, d, reconnectMax)
+		}
+	}
+}
+
+// testClientConn makes a handshaken clientConn on mem, not yet registered
+func testClientConn(t *testing.T, mem *memTransport, name string) *clientConn {
+	conn := mem.dial(name)
+	channel, err := clientHandshake(conn, "localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newClientConn(conn, channel)
+}
+
+func TestConnectionQueuesWhileOffline(t *testing.T) {
+	s := newServer()
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	session := &connection{}
+	session.send(newPacket(msgChat, "one"))
+	session.send(newPacket(msgChat, "two"))
+	if err := session.sendUnreliable(newPacket(msgTyping)); !errors.Is(err, errOffline) {
+		t.Errorf("typing while offline: err = %v, want errOffline", err)
+	}
+	if n := session.queued(); n != 2 {
+		t.Fatalf("queued = %d, want 2", n)
+	}
+
+	cc := testClientConn(t, mem, "alice")
+	if sent := session.restore(cc, 0); sent != 2 || session.queued() != 0 || cc.link.pending() != 2 {
+		t.Errorf("after restore: sent %d, queued %d, pending %d, want 2, 0 and 2", sent, session.queued(), cc.link.pending())
+	}
+
+	session.lost() // Never acknowledged: nobody registered
+	if session.current() != nil {
+		t.Error("lost connection still current")
+	}
+	if n := session.queued(); n != 2 {
+		t.Errorf("after losing the connection: queued = %d, want both back", n)
+	}
+
+	// A resumed session that got the first one only needs the second
+	if sent := session.restore(testClientConn(t, mem, "alice"), 1); sent != 1 {
+		t.Errorf("resent %d, want 1", sent)
+	}
+}
+
+func TestReconnectResumesSession(t *testing.T) {
+	s := newServer()
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	// register logs in on cc, presenting a resume ticket when there is one
+	register := func(cc *clientConn, ticket string) (Packet, error) {
+		cc.send(Packet{kind: msgRegister, fields: [][]byte{[]byte("alice"), nil, nil, nil, []byte(ticket)}})
+		welcome, _, err := cc.awaitWelcome(2*time.Second, nil)
+		return welcome, err
+	}
+	// alice reports the room and address of alice's session on the server
+	alice := func() (room, from string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, c := range s.clients {
+			if c.name == "alice" {
+				return c.room, c.peer.Addr().String()
+			}
+		}
+		return "", ""
+	}
+
+	first := testClientConn(t, mem, "first")
+	welcome, err := register(first, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.send(newPacket(msgJoin, "go"))
+	deadline := time.Now().Add(2 * time.Second)
+	for room, _ := alice(); room != "go"; room, _ = alice() {
+		if time.Now().After(deadline) {
+			t.Fatal("never joined #go")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Someone else can't take the name, with a made-up ticket or with the
+	// session token, which anyone watching the wire can read
+	for _, guess := range []string{string(newSessionToken()), welcome.field(0)} {
+		if _, err := register(testClientConn(t, mem, "thief"), guess); err == nil {
+			t.Error("registered alice twice")
+		}
+	}
+
+	// The first connection goes quiet; a new one takes the session back
+	second := testClientConn(t, mem, "second")
+	resumed, err := register(second, welcome.field(5))
+	if err != nil {
+		t.Fatalf("resume failed: %v", err)
+	}
+	if resumed.field(0) == welcome.field(0) || resumed.field(5) == welcome.field(5) {
+		t.Error("resumed session kept the old token or ticket")
+	}
+	if resumed.field(6) != "go" || resumed.field(7) != "2" {
+		t.Errorf("welcome says resumed in #%s after seq %s, want #go after 2 (register and join)", resumed.field(6), resumed.field(7))
+	}
+	if room, from := alice(); room != "go" || from != "second" {
+		t.Fatalf("resumed session in #%s from %q, want #go from second", room, from)
+	}
+	s.mu.Lock()
+	n := len(s.clients)
+	s.mu.Unlock()
+	if n != 1 {
+		t.Errorf("%d sessions after resuming, want 1", n)
+	}
+}
+
+func TestHeartbeatsKeepIdleClientsConnected(t *testing.T) {
+	s := newServer()
+	s.heartbeat, s.heartbeatMisses = 50*time.Millisecond, 3
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	testRegister(t, mem.dial("crashed"), "crashed") // Never heard from again
+	reader := testClientConn(t, mem, "reader")
+	reader.send(newPacket(msgRegister, "reader"))
+	if _, _, err := reader.awaitWelcome(2*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	if beat := reader.heartbeat(); beat != s.heartbeat {
+		t.Errorf("client heartbeat = %v, want the server's %v", beat, s.heartbeat)
+	}
+
+	// The reader says nothing for a while, but its heartbeats keep going
+	buf := make([]byte, maxDatagramSize)
+	for end := time.Now().Add(10 * s.heartbeat); time.Now().Before(end); {
+		reader.keepAlive(time.Now())
+		reader.conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if n, err := reader.conn.Read(buf); err == nil {
+			reader.receive(buf[:n])
+		}
+	}
+	if reader.silent(time.Now()) {
+		t.Error("heartbeats were not echoed")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for _, c := range s.clients {
+		names = append(names, c.name)
+	}
+	if len(names) != 1 || names[0] != "reader" {
+		t.Errorf("clients left = %v, want just the reader", names)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"cmp"             // For ordering unacknowledged packets
+	"encoding/binary" // For encoding ACK payloads
+	"errors"          // For send queue errors
+	"slices"          // For sorting unacknowledged packets
+	"sync"            // For guarding link state
+	"time"            // For retransmit timers
+)
+
+const (
+	reliableWindow   = 32                     // Max unacknowledged packets in flight per peer
+	maxSendQueue     = 1024                   // Max packets waiting for window space
+	maxReorderBuffer = 256                    // Max out-of-order packets held per peer
+	maxSelectiveAcks = 32                     // Max sequence numbers listed in one ACK
+	initialRTO       = 250 * time.Millisecond // First retransmit timeout
+	maxRTO           = 4 * time.Second        // Backoff ceiling
+	maxRetransmits   = 8                      // Give up after this many retries
+	retransmitTick   = 50 * time.Millisecond  // How often retransmit timers are checked
+)
+
+var (
+	errSendQueueFull = errors.New("send queue full")
+	errLinkStalled   = errors.New("gave up resending a message") // The peer can never deliver past it
+)
+
+// pendingPacket is a reliable packet waiting to be acknowledged
+type pendingPacket struct {
+	pkt     Packet        // Original packet (handed to callbacks)
+	data    []byte        // Encoded packet, resent verbatim
+	sentAt  time.Time     // Last (re)transmission time
+	rto     time.Duration // Current retransmit timeout
+	retries int           // Retransmissions so far
+}
+
+// reliableLink adds sequencing, acknowledgement and retransmission to one peer
+type reliableLink struct {
+	mu    sync.Mutex
+	write func([]byte) error // Sends a datagram to the peer
+	token []byte             // Session token stamped on outgoing packets (client side)
+
+	// Sending side
+	nextSeq  uint32                    // Next sequence number to assign
+	inflight map[uint32]*pendingPacket // Sent but not yet acknowledged
+	queue    []*pendingPacket          // Waiting for window space
+
+	// Receiving side
+	recvNext uint32            // Next in-order sequence number expected
+	recvBuf  map[uint32]Packet // Out-of-order packets waiting for gaps to fill
+
+	rtt     time.Duration // Smoothed round trip time, 0 until the first sample
+	stalled bool          // A packet was given up on: the peer waits for it forever
+
+	onDelivered func(Packet) // Called when a sent packet is acknowledged
+	onFailed    func(Packet) // Called when a sent packet is given up on
+}
+
+// newReliableLink creates a link that writes datagrams with write
+func newReliableLink(write func([]byte) error) *reliableLink {
+	return &reliableLink{
+		write:    write,
+		nextSeq:  1,
+		inflight: make(map[uint32]*pendingPacket),
+		recvNext: 1,
+		recvBuf:  make(map[uint32]Packet),
+	}
+}
+
+// send assigns a sequence number to pkt and transmits it once the window allows
+func (l *reliableLink) send(pkt Packet) (uint32, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.queue) >= maxSendQueue {
+		return 0, errSendQueueFull
+	}
+
+	pkt = pkt.withToken(l.token)
+	pkt.flags |= flagReliable
+	pkt.seq = l.nextSeq
+	data, err := encodePacket(pkt)
+	if err != nil {
+		return 0, err
+	}
+	l.nextSeq++
+
+	p := &pendingPacket{pkt: pkt, data: data, rto: initialRTO}
+	if len(l.inflight) < reliableWindow {
+		l.transmit(p)
+	} else {
+		l.queue = append(l.queue, p) // Window full, wait for ACKs
+	}
+	return pkt.seq, nil
+}
+
+// transmit writes p and starts its retransmit timer (caller holds l.mu)
+func (l *reliableLink) transmit(p *pendingPacket) {
+	p.sentAt = time.Now()
+	l.inflight[p.pkt.seq] = p
+	l.write(p.data) // Losses are recovered by retransmission
+}
+
+// receive processes a reliable packet from the peer, acknowledges it and
+// returns any packets that are now deliverable in order
+func (l *reliableLink) receive(pkt Packet) []Packet {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var ready []Packet
+	switch {
+	case pkt.seq < l.recvNext:
+		// Duplicate (our ACK was lost), just re-acknowledge
+	case pkt.seq == l.recvNext:
+		ready = append(ready, pkt)
+		l.recvNext++
+		// Release buffered packets that are now in order
+		for {
+			next, ok := l.recvBuf[l.recvNext]
+			if !ok {
+				break
+			}
+			delete(l.recvBuf, l.recvNext)
+			ready = append(ready, next)
+			l.recvNext++
+		}
+	case pkt.seq-l.recvNext < maxReorderBuffer:
+		l.recvBuf[pkt.seq] = pkt // Arrived early, hold until the gap fills
+	default:
+		return nil // Too far ahead, drop without ACK so the peer retransmits later
+	}
+
+	l.sendAck()
+	return ready
+}
+
+// sendAck writes a cumulative ACK plus selective ACKs for buffered packets (caller holds l.mu)
+func (l *reliableLink) sendAck() {
+	l.write(encodeAck(l.recvNext-1, l.recvBuf, l.token))
+}
+
+// setToken makes the link stamp token on every packet it sends from now on,
+// re-acknowledging anything received before the token was known
+func (l *reliableLink) setToken(token []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.token = token
+	if l.recvNext > 1 {
+		l.sendAck()
+	}
+}
+
+// encodeAck builds an ACK packet: [cumulative seq, selective seqs...]
+func encodeAck(cumulative uint32, received map[uint32]Packet, token []byte) []byte {
+	cum := binary.BigEndian.AppendUint32(nil, cumulative)
+	var sack []byte
+	for seq := range received {
+		if len(sack) >= maxSelectiveAcks*4 {
+			break
+		}
+		sack = binary.BigEndian.AppendUint32(sack, seq)
+	}
+	data, _ := encodePacket(Packet{kind: msgAck, fields: [][]byte{cum, sack}}.withToken(token))
+	return data
+}
+
+// handleAck releases acknowledged packets and refills the window
+func (l *reliableLink) handleAck(pkt Packet) {
+	if len(pkt.fields) != 2 || len(pkt.fields[0]) != 4 || len(pkt.fields[1])%4 != 0 {
+		return // Malformed ACK
+	}
+
+	l.mu.Lock()
+	var delivered []Packet
+	ack := func(seq uint32) {
+		if p, ok := l.inflight[seq]; ok {
+			if p.retries == 0 { // Karn: a retransmitted packet's ACK can't be timed
+				l.sampleRTT(time.Since(p.sentAt))
+			}
+			delete(l.inflight, seq)
+			delivered = append(delivered, p.pkt)
+		}
+	}
+
+	cumulative := binary.BigEndian.Uint32(pkt.fields[0])
+	for seq := range l.inflight {
+		if seq <= cumulative {
+			ack(seq)
+		}
+	}
+	for sack := pkt.fields[1]; len(sack) > 0; sack = sack[4:] {
+		ack(binary.BigEndian.Uint32(sack))
+	}
+
+	// Refill the window from the queue
+	for len(l.queue) > 0 && len(l.inflight) < reliableWindow {
+		l.transmit(l.queue[0])
+		l.queue = l.queue[1:]
+	}
+	onDelivered := l.onDelivered
+	l.mu.Unlock()
+
+	if onDelivered != nil { // Callbacks run unlocked so they may send
+		for _, p := range delivered {
+			onDelivered(p)
+		}
+	}
+}
+
+// sampleRTT folds a round trip measurement into the estimate, as TCP does (caller holds l.mu)
+func (l *reliableLink) sampleRTT(sample time.Duration) {
+	if l.rtt == 0 {
+		l.rtt = sample
+		return
+	}
+	l.rtt += (sample - l.rtt) / 8
+}
+
+// latency returns the smoothed round trip time, 0 if nothing was acknowledged yet
+func (l *reliableLink) latency() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rtt
+}
+
+// retransmit resends packets whose timers expired, backing off exponentially,
+// and gives up on packets that exhausted their retries. The receiver delivers
+// in order, so nothing sent after a packet given up on can arrive either: the
+// link is stalled from then on and its session has to be replaced.
+func (l *reliableLink) retransmit(now time.Time) (failed int) {
+	l.mu.Lock()
+	var dropped []Packet
+	for seq, p := range l.inflight {
+		if now.Sub(p.sentAt) < p.rto {
+			continue
+		}
+		if p.retries >= maxRetransmits {
+			delete(l.inflight, seq)
+			dropped = append(dropped, p.pkt)
+			l.stalled = true
+			continue
+		}
+		p.retries++
+		p.rto = min(p.rto*2, maxRTO)
+		l.transmit(p)
+	}
+	for len(l.queue) > 0 && len(l.inflight) < reliableWindow {
+		l.transmit(l.queue[0])
+		l.queue = l.queue[1:]
+	}
+	onFailed := l.onFailed
+	l.mu.Unlock()
+
+	if onFailed != nil {
+		for _, p := range dropped {
+			onFailed(p)
+		}
+	}
+	return len(dropped)
+}
+
+// isStalled reports whether a packet was given up on (see retransmit)
+func (l *reliableLink) isStalled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stalled
+}
+
+// pending reports how many sent packets are still unacknowledged
+func (l *reliableLink) pending() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.inflight) + len(l.queue)
+}
+
+// delivered returns the sequence number of the last packet received in order
+func (l *reliableLink) delivered() uint32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.recvNext - 1
+}
+
+// unacked returns the packets sent on the link but never acknowledged, in
+// the order they were sent, so they can be sent again on a new link
+func (l *reliableLink) unacked() []Packet {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []Packet
+	for _, p := range l.inflight {
+		out = append(out, p.pkt)
+	}
+	slices.SortFunc(out, func(a, b Packet) int { return cmp.Compare(a.seq, b.seq) })
+	for _, p := range l.queue {
+		out = append(out, p.pkt)
+	}
+	return out
+}
+
+// flush waits until every sent packet is acknowledged or timeout elapses
+func (l *reliableLink) flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for l.pending() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(retransmitTick)
+	}
+	return true
+}
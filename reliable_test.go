@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// linkPair connects two reliable links through in-memory queues
+type linkPair struct {
+	a, b       *reliableLink
+	toA, toB   [][]byte
+	dropEveryN int // Drop every Nth datagram in each direction (0 = lossless)
+	sent       int
+}
+
+func newLinkPair(dropEveryN int) *linkPair {
+	lp := &linkPair{dropEveryN: dropEveryN}
+	lp.a = newReliableLink(func(d []byte) error { lp.enqueue(&lp.toB, d); return nil })
+	lp.b = newReliableLink(func(d []byte) error { lp.enqueue(&lp.toA, d); return nil })
+	return lp
+}
+
+func (lp *linkPair) enqueue(q *[][]byte, d []byte) {
+	lp.sent++
+	if lp.dropEveryN > 0 && lp.sent%lp.dropEveryN == 0 {
+		return // Simulated loss
+	}
+	*q = append(*q, d)
+}
+
+// pump delivers queued datagrams to b, returning the packets b accepted in order
+func (lp *linkPair) pump(t *testing.T) []Packet {
+	var got []Packet
+	for len(lp.toA) > 0 || len(lp.toB) > 0 {
+		toA, toB := lp.toA, lp.toB
+		lp.toA, lp.toB = nil, nil
+		for _, d := range toB {
+			pkt, err := decodePacket(d)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			got = append(got, lp.b.receive(pkt)...)
+		}
+		for _, d := range toA {
+			pkt, err := decodePacket(d)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			lp.a.handleAck(pkt)
+		}
+	}
+	return got
+}
+
+func TestReliableLinkDeliversInOrderDespiteLoss(t *testing.T) {
+	lp := newLinkPair(3)
+	delivered := 0
+	lp.a.onDelivered = func(Packet) { delivered++ }
+
+	const total = 100
+	for i := 0; i < total; i++ {
+		if _, err := lp.a.send(newPacket(msgChat, string(rune('a'+i%26)))); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+
+	var got []Packet
+	now := time.Now()
+	for round := 0; round < 50 && len(got) < total; round++ {
+		got = append(got, lp.pump(t)...)
+		now = now.Add(maxRTO)
+		lp.a.retransmit(now)
+	}
+	got = append(got, lp.pump(t)...)
+
+	if len(got) != total {
+		t.Fatalf("delivered %d packets, want %d", len(got), total)
+	}
+	for i, p := range got {
+		if p.seq != uint32(i+1) {
+			t.Fatalf("packet %d has seq %d, want %d", i, p.seq, i+1)
+		}
+	}
+	if delivered != total || lp.a.pending() != 0 {
+		t.Errorf("sender saw %d acks with %d pending, want %d and 0", delivered, lp.a.pending(), total)
+	}
+}
+
+func TestReliableLinkWindowIsBounded(t *testing.T) {
+	var wire int
+	l := newReliableLink(func([]byte) error { wire++; return nil })
+	for i := 0; i < reliableWindow*2; i++ {
+		l.send(newPacket(msgChat, "x"))
+	}
+	if wire != reliableWindow {
+		t.Errorf("wrote %d packets with no ACKs, want window of %d", wire, reliableWindow)
+	}
+}
+
+func TestReliableLinkGivesUp(t *testing.T) {
+	l := newReliableLink(func([]byte) error { return nil })
+	var failed []Packet
+	l.onFailed = func(p Packet) { failed = append(failed, p) }
+	l.send(newPacket(msgChat, "lost"))
+
+	now := time.Now()
+	for i := 0; i <= maxRetransmits; i++ {
+		now = now.Add(maxRTO)
+		l.retransmit(now)
+	}
+	if len(failed) != 1 || failed[0].field(0) != "lost" || l.pending() != 0 {
+		t.Fatalf("failed = %v, pending = %d; want the packet given up on", failed, l.pending())
+	}
+	if !l.isStalled() {
+		t.Error("link not stalled after giving up on a packet")
+	}
+}
+
+func TestServerDropsStalledSession(t *testing.T) {
+	s := newServer()
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	alice := mem.dial("alice")
+	testRegister(t, alice, "alice") // Never acknowledges its welcome
+
+	now := time.Now()
+	for i := 0; i <= maxRetransmits; i++ {
+		now = now.Add(maxRTO)
+		s.retransmit(now)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.findClient("alice") != nil || len(s.clients) != 0 {
+		t.Fatal("stalled session was kept")
+	}
+}
+
+func TestReliableLinkMeasuresLatency(t *testing.T) {
+	lp := newLinkPair(0)
+	if lp.a.latency() != 0 {
+		t.Fatal("latency known before anything was sent")
+	}
+	lp.a.send(newPacket(msgChat, "ping"))
+	time.Sleep(20 * time.Millisecond)
+	lp.pump(t)
+	if rtt := lp.a.latency(); rtt < 20*time.Millisecond || rtt > time.Second {
+		t.Errorf("latency = %v, want about 20ms", rtt)
+	}
+}
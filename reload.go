@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"     // For describing changes
+	"log"     // For logging reloads
+	"os"      // For the log file
+	"reflect" // For comparing settings
+	"sort"    // For stable change lists
+	"strings" // For summaries
+)
+
+// restartSettings cannot change while the server runs: the listeners are bound
+// and the message channel is made once, at startup
+var restartSettings = map[string]bool{"udp": true, "tcp": true, "ws": true, "irc": true, "message_buffer": true}
+
+// newSessionSettings only reach sessions that start after a reload: connected
+// clients keep the heartbeat interval their welcome told them
+var newSessionSettings = map[string]bool{"heartbeat": true}
+
+// reload rereads the config file (with the command line flags on top), the
+// roles file and the user store, and applies them without dropping anyone.
+// Nothing changes unless all of them are valid. by says who asked, for the
+// log (caller holds s.mu).
+func (s *Server) reload(by string) ([]string, error) {
+	cfg, err := parseServerConfig(s.configArgs)
+	if err != nil {
+		return nil, s.rejectReload(by, err)
+	}
+	roles := s.roles
+	if s.rolesFile != "" {
+		if roles, err = loadRoles(s.rolesFile); err != nil {
+			return nil, s.rejectReload(by, err)
+		}
+	}
+	users := s.users
+	if s.users.path != "" { // In-memory stores have nothing to reread
+		if users, err = loadUserStore(s.users.path); err != nil {
+			return nil, s.rejectReload(by, err)
+		}
+	}
+	if cfg.LogFile != "" || s.logFile != nil { // Reopened even if unchanged, for log rotation
+		if err := s.openLog(cfg.LogFile); err != nil {
+			return nil, s.rejectReload(by, err)
+		}
+	}
+
+	changes := configChanges(s.config, cfg)
+	cfg.UDP, cfg.TCP, cfg.WS, cfg.IRC = s.config.UDP, s.config.TCP, s.config.WS, s.config.IRC
+	cfg.MessageBuffer = s.config.MessageBuffer
+	if !reflect.DeepEqual(roles, s.roles) {
+		changes = append(changes, "role permissions from "+s.rolesFile)
+	}
+	changes = append(changes, accountChanges(s.users, users)...)
+
+	oldRoles := s.roles
+	s.apply(cfg)
+	s.roles, s.users = roles, users
+	for _, c := range s.clients { // Size limits apply to messages already under way too
+		c.reasm.maxMessage, c.reasm.maxBuffered = s.maxMessageSize, s.maxBuffered
+	}
+	for _, c := range s.clients { // Sessions pick up new roles and permissions right away
+		if !c.authed {
+			continue
+		}
+		role := c.role
+		if acct, ok := users.lookup(c.account); ok {
+			role = acct.Role
+		}
+		perms := encodePermissions(roles.permissions(role))
+		if role == c.role && perms == encodePermissions(oldRoles.permissions(c.role)) {
+			continue
+		}
+		c.role = role
+		s.sendReliable(c, newPacket(msgRole, role, perms))
+		s.sendSystem(c, systemNotice, fmt.Sprintf("Your role is now %s (permissions: %s)", role, perms))
+	}
+
+	if len(changes) == 0 {
+		log.Printf("Config reloaded by %s: no changes", by)
+	} else {
+		log.Printf("Config reloaded by %s: %s", by, strings.Join(changes, "; "))
+	}
+	return changes, nil
+}
+
+// rejectReload logs why a reload was refused and returns err
+func (s *Server) rejectReload(by string, err error) error {
+	log.Printf("Config reload by %s rejected, keeping the current settings: %s", by, strings.ReplaceAll(err.Error(), "\n", "; "))
+	return err
+}
+
+// configChanges describes the settings that differ between old and cur, e.g. `motd: "" -> "hi"`
+func configChanges(old, cur serverConfig) []string {
+	var changes []string
+	ov, cv := reflect.ValueOf(old), reflect.ValueOf(cur)
+	for i := range ov.NumField() {
+		was, is := fmt.Sprint(ov.Field(i).Interface()), fmt.Sprint(cv.Field(i).Interface())
+		if was == is {
+			continue
+		}
+		name := ov.Type().Field(i).Tag.Get("json")
+		change := fmt.Sprintf("%s: %q -> %q", name, was, is)
+		switch {
+		case restartSettings[name]:
+			change += " (needs a restart)"
+		case newSessionSettings[name]:
+			change += " (new sessions only)"
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// accountChanges describes accounts added, removed or given another role in
+// cur, a store that was just loaded and is not shared yet
+func accountChanges(old, cur *userStore) []string {
+	var changes []string
+	for name, a := range cur.users {
+		prev, ok := old.lookup(name)
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("new account %s (%s)", name, a.Role))
+		case prev.Role != a.Role:
+			changes = append(changes, fmt.Sprintf("role of %s: %s -> %s", name, prev.Role, a.Role))
+		}
+	}
+	old.mu.RLock()
+	for name := range old.users {
+		if _, ok := cur.users[name]; !ok {
+			changes = append(changes, fmt.Sprintf("account %s removed", name))
+		}
+	}
+	old.mu.RUnlock()
+	sort.Strings(changes)
+	return changes
+}
+
+// reloadSummary tells an admin what a reload changed
+func reloadSummary(changes []string) string {
+	if len(changes) == 0 {
+		return "Reloaded: nothing changed"
+	}
+	return "Reloaded:\n- " + strings.Join(changes, "\n- ")
+}
+
+// openLog appends the log to the file at path ("" for stderr) and closes the
+// previous log file. Opening the same path again follows a rotated log.
+func (s *Server) openLog(path string) error {
+	var f *os.File
+	if path != "" {
+		var err error
+		if f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+			return err
+		}
+		log.SetOutput(f)
+	} else {
+		log.SetOutput(os.Stderr)
+	}
+	if s.logFile != nil {
+		s.logFile.Close()
+	}
+	s.logFile = f
+	return nil
+}
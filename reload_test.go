@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReloadAppliesChangesWithoutDroppingSessions(t *testing.T) {
+	dir := t.TempDir()
+	configPath, rolesPath, usersPath := filepath.Join(dir, "gochat.json"), filepath.Join(dir, "roles.json"), filepath.Join(dir, "users.json")
+	os.WriteFile(configPath, []byte(`{"motd": "v1"}`), 0o600)
+	os.WriteFile(usersPath, []byte(`[{"name": "carol", "role": "member"}]`), 0o600)
+
+	s := newServer()
+	cfg, err := parseServerConfig([]string{"-config", configPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.configure(cfg)
+	s.configArgs, s.rolesFile = []string{"-config", configPath}, rolesPath
+	users, err := loadUserStore(usersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.users = users
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	bob := mem.dial("bob")
+	bobChannel := testRegisterJSON(t, bob, "bob")
+
+	os.WriteFile(configPath, []byte(`{"motd": "v2", "udp": ":9999", "max_users": 5, "heartbeat": "2s",
+		"max_message_size": 2048, "fragment_buffer": 4096}`), 0o600)
+	os.WriteFile(rolesPath, []byte(`{"guest": ["stats", "broadcast"]}`), 0o600)
+	os.WriteFile(usersPath, []byte(`[{"name": "carol", "role": "moderator"}, {"name": "dave", "role": "member"}]`), 0o600)
+	s.mu.Lock()
+	changes, err := s.reload("test")
+	motd, maxUsers, udp := s.motd, s.maxUsers, s.config.UDP
+	reasm := s.findClient("bob").reasm
+	maxMessage, maxBuffered := reasm.maxMessage, reasm.maxBuffered
+	s.unlock()
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	for _, want := range []string{
+		`motd: "v1" -> "v2"`, `udp: ":8080" -> ":9999" (needs a restart)`, `max_users: "0" -> "5"`,
+		`heartbeat: "5s" -> "2s" (new sessions only)`, `max_message_size: "65536" -> "2048"`,
+		"role permissions from " + rolesPath, "role of carol: member -> moderator", "new account dave (member)",
+	} {
+		if !slices.Contains(changes, want) {
+			t.Errorf("changes = %q, missing %q", changes, want)
+		}
+	}
+	if motd != "v2" || maxUsers != 5 || udp != ":8080" {
+		t.Errorf("after reload: motd %q, max users %d, udp %q", motd, maxUsers, udp)
+	}
+	if maxMessage != 2048 || maxBuffered != 4096 {
+		t.Errorf("bob's session still limits messages to %d bytes and buffers %d", maxMessage, maxBuffered)
+	}
+	ev := waitForEvent(t, bob, bobChannel, eventSystem)
+	if ev.Text == "v1" { // The MOTD from logging in
+		ev = waitForEvent(t, bob, bobChannel, eventSystem)
+	}
+	if !strings.Contains(ev.Text, "broadcast") {
+		t.Errorf("role notice = %q, want the new permissions", ev.Text)
+	}
+
+	// A bad file changes nothing
+	os.WriteFile(configPath, []byte(`{"motd": "v3", "heartbeat": "1ms"}`), 0o600)
+	s.mu.Lock()
+	_, err = s.reload("test")
+	motd = s.motd
+	s.unlock()
+	if err == nil || motd != "v2" {
+		t.Errorf("bad config: err = %v, motd = %q", err, motd)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"     // For rendering events
+	"os"      // For the locale environment
+	"regexp"  // For measuring and stripping colors
+	"strings" // For rendering lists
+	"time"    // For local times
+)
+
+// theme holds the colors (ANSI SGR parameters, "" for none) and badges a
+// renderer uses, so people can pick what reads well on their terminal
+type theme struct {
+	time       string // Timestamps
+	sender     string // Names in chat lines
+	join       string
+	leave      string
+	notice     string // Renames, topics, announcements, timeouts, things done to you
+	done       string // Confirmations of your own commands
+	whisper    string
+	typing     string
+	header     string // First line of lists
+	errors     string
+	dim        string // Delivery receipts and scrollback frames
+	prompt     string
+	promptRoom string
+	owner      string // Badge before an owner's name
+	moderator  string // Badge before a moderator's name
+}
+
+// themes are the themes clients can choose from
+var themes = map[string]theme{
+	"dark": {
+		time: "90", sender: "36", join: "32", leave: "31", notice: "33", done: "36", whisper: "35", typing: "2",
+		header: "1", errors: "31", dim: "90", prompt: "35", promptRoom: "36", owner: "👑 ", moderator: "🛡 ",
+	},
+	"light": { // No yellow or cyan, which wash out on white
+		time: "90", sender: "34", join: "32", leave: "31", notice: "35", done: "34", whisper: "35;1", typing: "2",
+		header: "1", errors: "31", dim: "90", prompt: "35", promptRoom: "34", owner: "👑 ", moderator: "🛡 ",
+	},
+	"none": {owner: "~", moderator: "@"}, // Plain text, with IRC-style badges
+}
+
+// renderer formats events as text for one client
+type renderer struct {
+	theme    theme
+	loc      *time.Location // Time zone timestamps are shown in
+	clock24  bool           // "15:04" rather than "3:04 PM"
+	dayFirst bool           // "2 Jan" rather than "Jan 2"
+}
+
+// textRenderer renders events for clients that did not ask for them, as the
+// server always did: dark theme, server time, 24-hour clock
+var textRenderer = &renderer{theme: themes["dark"], loc: time.Local, clock24: true}
+
+// newRenderer creates a renderer with the named theme for the given time zone.
+// Clock and date formats come from the locale ($LC_ALL, $LC_TIME or $LANG).
+func newRenderer(themeName string, loc *time.Location) (*renderer, error) {
+	t, ok := themes[themeName]
+	if !ok {
+		return nil, fmt.Errorf("unknown theme %q (dark, light or none)", themeName)
+	}
+	r := &renderer{theme: t, loc: loc, clock24: true}
+	switch locale := envLocale(); {
+	case strings.HasPrefix(locale, "en_US"):
+		r.clock24 = false
+	case strings.HasPrefix(locale, "en_CA"), strings.HasPrefix(locale, "en_AU"),
+		strings.HasPrefix(locale, "en_NZ"), strings.HasPrefix(locale, "en_PH"), strings.HasPrefix(locale, "en_IN"):
+		r.clock24, r.dayFirst = false, true
+	case locale != "" && locale != "C" && locale != "POSIX" && !strings.HasPrefix(locale, "C."):
+		r.dayFirst = true
+	}
+	return r, nil
+}
+
+// envLocale returns the locale that governs time formats
+func envLocale() string {
+	for _, name := range []string{"LC_ALL", "LC_TIME", "LANG"} {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// colorAllowed reports whether escape codes may be written to out: not when
+// $NO_COLOR is set (see no-color.org), $TERM is "dumb" or out is redirected
+func colorAllowed(out *os.File) bool {
+	return os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb" && isTerminal(out)
+}
+
+// ansiEscape matches the color codes paint puts in rendered text
+var ansiEscape = regexp.MustCompile("\033\\[[0-9;]*[A-Za-z]")
+
+// paint wraps s in the given color ("" leaves it alone)
+func paint(color, s string) string {
+	if color == "" {
+		return s
+	}
+	return "\033[" + color + "m" + s + "\033[0m"
+}
+
+// clock formats the time of day of t
+func (r *renderer) clock(t time.Time) string {
+	if r.clock24 {
+		return t.In(r.loc).Format("15:04")
+	}
+	return t.In(r.loc).Format("3:04 PM")
+}
+
+// date formats the day of t
+func (r *renderer) date(t time.Time) string {
+	if r.dayFirst {
+		return t.In(r.loc).Format("2 Jan")
+	}
+	return t.In(r.loc).Format("Jan 2")
+}
+
+// chat renders a chat line with timestamp and username
+func (r *renderer) chat(t time.Time, sender, role, msg string) string {
+	switch role {
+	case roleOwner:
+		sender = r.theme.owner + sender
+	case roleModerator:
+		sender = r.theme.moderator + sender
+	}
+	// Format: [time] username │ message
+	return fmt.Sprintf("%s %s │ %s", paint(r.theme.time, r.clock(t)), paint(r.theme.sender, fmt.Sprintf("%-15s", sender)), msg)
+}
+
+// render formats an event as text. Whispers must have been decrypted (see whisperer.openEvent).
+func (r *renderer) render(ev event) string {
+	clock := r.clock(ev.Time)
+	switch ev.Type {
+	case eventChat:
+		return r.chat(ev.Time, ev.Sender, ev.Role, ev.Text)
+	case eventJoin:
+		return paint(r.theme.join, r.chat(ev.Time, ev.Sender, ev.Role, "joined #"+ev.Room))
+	case eventLeave:
+		switch ev.Reason {
+		case leaveMoved:
+			return paint(r.theme.leave, fmt.Sprintf("[%s] %s left for #%s", clock, ev.Sender, ev.Target))
+		case leaveKicked:
+			return paint(r.theme.leave, fmt.Sprintf("[%s] %s was kicked by %s", clock, ev.Sender, ev.Target))
+		case leaveTimeout:
+			return paint(r.theme.notice, fmt.Sprintf("[%s] %s timed out (stopped responding)", clock, ev.Sender))
+		case leaveDisconnected:
+			return paint(r.theme.leave, fmt.Sprintf("[%s] %s left the chat (connection closed)", clock, ev.Sender))
+		}
+		return paint(r.theme.leave, fmt.Sprintf("[%s] %s left the chat", clock, ev.Sender))
+	case eventRename:
+		return paint(r.theme.notice, fmt.Sprintf("[%s] %s changed name to %s", clock, ev.Sender, ev.Target))
+	case eventTopic:
+		switch {
+		case ev.Sender != "":
+			return paint(r.theme.notice, fmt.Sprintf("%s set the topic of #%s to: %s", ev.Sender, ev.Room, ev.Text))
+		case ev.Text == "":
+			return paint(r.theme.notice, fmt.Sprintf("#%s has no topic", ev.Room))
+		}
+		return paint(r.theme.notice, fmt.Sprintf("Topic for #%s: %s", ev.Room, ev.Text))
+	case eventTyping:
+		return paint(r.theme.typing, ev.Sender+" is typing...")
+	case eventPresence:
+		return paint(r.theme.notice, fmt.Sprintf("[%s] %s", clock, describePresence(ev)))
+	case eventAnnouncement:
+		return paint(r.theme.notice, "[ADMIN ANNOUNCEMENT] "+ev.Text)
+	case eventWhisper:
+		return paint(r.theme.whisper, fmt.Sprintf("[WHISPER from %s] %s", ev.Sender, ev.Text))
+	case eventHistory:
+		return r.history(ev.Room, ev.History, ev.Time)
+	case eventUserList:
+		var sb strings.Builder
+		sb.WriteString(paint(r.theme.header, "Connected users:") + "\n")
+		for _, u := range ev.Users {
+			tag := ""
+			if u.Role != roleMember && u.Role != roleGuest {
+				tag = " (" + u.Role + ")"
+			}
+			if u.Muted {
+				tag += " (muted)"
+			}
+			if u.Presence != "" && u.Presence != presenceOnline {
+				tag += " (" + u.Presence
+				if u.Away != "" {
+					tag += ": " + u.Away
+				}
+				tag += ")"
+			}
+			if u.Status != "" {
+				tag += " - " + u.Status
+			}
+			fmt.Fprintf(&sb, "- %s #%s%s\n", u.Name, u.Room, tag)
+		}
+		return sb.String()
+	case eventRoomList:
+		var sb strings.Builder
+		sb.WriteString(paint(r.theme.header, "Rooms:") + "\n")
+		for _, rm := range ev.Rooms {
+			marker := " "
+			if rm.Name == ev.Room {
+				marker = "*"
+			}
+			fmt.Fprintf(&sb, "%s #%s (%d)", marker, rm.Name, rm.Members)
+			if rm.Topic != "" {
+				fmt.Fprintf(&sb, " - %s", rm.Topic)
+			}
+			sb.WriteString("\n")
+		}
+		return sb.String()
+	case eventStats:
+		return fmt.Sprintf("%s\n"+
+			"Uptime: %s\n"+
+			"Users connected: %d\n"+
+			"Rooms: %d\n"+
+			"Timeout: %s without a heartbeat\n",
+			paint(r.theme.header, "Server Stats:"), time.Duration(ev.Stats.Uptime)*time.Second, ev.Stats.Users, ev.Stats.Rooms,
+			time.Duration(ev.Stats.Timeout)*time.Second)
+	case eventError:
+		return paint(r.theme.errors, ev.Text)
+	case eventSystem:
+		switch ev.Reason {
+		case systemNotice:
+			return paint(r.theme.notice, ev.Text)
+		case systemDone:
+			return paint(r.theme.done, ev.Text)
+		case systemList:
+			heading, entries, _ := strings.Cut(ev.Text, "\n")
+			return paint(r.theme.header, heading) + "\n" + entries
+		}
+	}
+	return ev.Text
+}
+
+// describePresence says what a presence event tells, e.g. "bob is away: lunch"
+func describePresence(ev event) string {
+	switch {
+	case ev.Reason == presenceStatus && ev.Status == "":
+		return ev.Sender + " cleared their status"
+	case ev.Reason == presenceStatus:
+		return fmt.Sprintf("%s set their status: %s", ev.Sender, ev.Status)
+	case ev.Presence == presenceOnline:
+		return ev.Sender + " is back"
+	case ev.Reason == presenceIdle:
+		return fmt.Sprintf("%s is %s (idle)", ev.Sender, ev.Presence)
+	case ev.Text != "":
+		return fmt.Sprintf("%s is %s: %s", ev.Sender, ev.Presence, ev.Text)
+	}
+	return fmt.Sprintf("%s is %s", ev.Sender, ev.Presence)
+}
+
+// history formats chat events as one block of text, dating lines from other days.
+// The oldest entries are left out if the block would exceed maxHistoryReply.
+func (r *renderer) history(room string, entries []event, now time.Time) string {
+	size := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		if size += len(entries[i].Text) + len(entries[i].Sender) + 64; size > maxHistoryReply { // 64: colors, time, date
+			entries = entries[i+1:]
+			break
+		}
+	}
+	if len(entries) == 0 {
+		return paint(r.theme.dim, fmt.Sprintf("No earlier messages in #%s", room))
+	}
+	var sb strings.Builder
+	sb.WriteString(paint(r.theme.dim, fmt.Sprintf("── last %d message(s) in #%s ──", len(entries), room)) + "\n")
+	y, m, d := now.In(r.loc).Date()
+	for _, e := range entries {
+		if ey, em, ed := e.Time.In(r.loc).Date(); ey != y || em != m || ed != d {
+			sb.WriteString(paint(r.theme.dim, r.date(e.Time)) + " ")
+		}
+		sb.WriteString(r.render(e))
+		sb.WriteString("\n")
+	}
+	sb.WriteString(paint(r.theme.dim, "──"))
+	return sb.String()
+}
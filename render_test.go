@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderEvents(t *testing.T) {
+	at := time.Date(2026, 3, 1, 15, 4, 0, 0, time.Local)
+	tests := []struct {
+		ev   event
+		want string
+	}{
+		{event{Type: eventChat, Time: at, Sender: "alice", Role: roleOwner, Text: "hi"}, "👑 alice"},
+		{event{Type: eventLeave, Time: at, Sender: "bob", Reason: leaveKicked, Target: "alice"}, "[15:04] bob was kicked by alice"},
+		{event{Type: eventLeave, Time: at, Sender: "bob", Reason: leaveMoved, Target: "go"}, "bob left for #go"},
+		{event{Type: eventTopic, Room: "go"}, "#go has no topic"},
+		{event{Type: eventUserList, Users: []userInfo{{Name: "bob", Room: "go", Role: roleModerator, Muted: true}}},
+			"- bob #go (moderator) (muted)"},
+		{event{Type: eventStats, Stats: &statsInfo{Uptime: 90, Users: 2, Rooms: 1}}, "Uptime: 1m30s"},
+	}
+	for _, tt := range tests {
+		if got := textRenderer.render(tt.ev); !strings.Contains(got, tt.want) {
+			t.Errorf("render(%s) = %q, want it to contain %q", tt.ev.Type, got, tt.want)
+		}
+	}
+}
+
+func TestRendererTimeZoneClockAndTheme(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	ev := event{Type: eventChat, Time: time.Date(2026, 3, 1, 6, 30, 0, 0, time.UTC), Sender: "alice", Role: roleOwner, Text: "hi"}
+
+	r := &renderer{theme: themes["none"], loc: tokyo}
+	if got := r.render(ev); got != "3:30 PM ~alice          │ hi" {
+		t.Errorf("12-hour, Tokyo, no colors: %q", got)
+	}
+	r.clock24 = true
+	if got := r.render(ev); !strings.HasPrefix(got, "15:30 ") {
+		t.Errorf("24-hour: %q", got)
+	}
+	r.theme = themes["light"]
+	if got := r.render(ev); strings.Contains(got, "\033[36m") || !strings.Contains(got, "\033[34m") {
+		t.Errorf("light theme uses cyan names: %q", got)
+	}
+}
+
+func TestRendererLocale(t *testing.T) {
+	for _, tt := range []struct {
+		locale            string
+		clock24, dayFirst bool
+	}{
+		{"", true, false},
+		{"en_US.UTF-8", false, false},
+		{"en_AU.UTF-8", false, true},
+		{"de_DE.UTF-8", true, true},
+	} {
+		t.Setenv("LC_ALL", tt.locale)
+		t.Setenv("LC_TIME", "")
+		t.Setenv("LANG", "")
+		r, err := newRenderer("dark", time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.clock24 != tt.clock24 || r.dayFirst != tt.dayFirst {
+			t.Errorf("locale %q: clock24=%v dayFirst=%v, want %v %v", tt.locale, r.clock24, r.dayFirst, tt.clock24, tt.dayFirst)
+		}
+	}
+	if _, err := newRenderer("neon", time.UTC); err == nil {
+		t.Error("unknown theme accepted")
+	}
+}
+
+func TestNoColorWhenRedirected(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if isTerminal(f) || colorAllowed(f) {
+		t.Error("a file was taken for a terminal")
+	}
+}
+
+func TestRendererStylesSystemNotices(t *testing.T) {
+	r := &renderer{theme: themes["dark"], loc: time.UTC}
+	tests := []struct {
+		reason, text, want string
+	}{
+		{"", "Session resumed in #lobby", "Session resumed in #lobby"},
+		{systemNotice, "You have been muted by bob", "\033[33mYou have been muted by bob\033[0m"},
+		{systemDone, "[Whisper sent to bob]", "\033[36m[Whisper sent to bob]\033[0m"},
+		{systemList, "Commands:\n/users\n/help\n", "\033[1mCommands:\033[0m\n/users\n/help\n"},
+	}
+	for _, tt := range tests {
+		if got := r.render(event{Type: eventSystem, Reason: tt.reason, Text: tt.text}); got != tt.want {
+			t.Errorf("%q notice: %q, want %q", tt.reason, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json" // For the roles file format
+	"errors"        // For missing-file checks
+	"fmt"           // For validation errors
+	"log"           // For auditing role changes
+	"os"            // For reading the roles file
+	"sort"          // For stable permission listings
+	"strings"       // For joining permission lists
+)
+
+// permission names a group of privileged commands
+type permission string
+
+const (
+	permKick      permission = "kick"      // /kick
+	permMute      permission = "mute"      // /mute, /unmute
+	permBroadcast permission = "broadcast" // /broadcast
+	permShutdown  permission = "shutdown"  // /shutdown
+	permStats     permission = "stats"     // /stats
+	permRoles     permission = "roles"     // /grant, /revoke
+	permReload    permission = "reload"    // /reload
+)
+
+// Built-in roles
+const (
+	roleOwner     = "owner"
+	roleModerator = "moderator"
+	roleMember    = "member" // Default for registered accounts
+	roleGuest     = "guest"  // Names without an account
+)
+
+const defaultRolesFile = "roles.json" // Optional permission overrides
+
+// knownPermissions is every permission a role may be granted
+var knownPermissions = []permission{permKick, permMute, permBroadcast, permShutdown, permStats, permRoles, permReload}
+
+// commandPermissions is the permission required by each privileged message type,
+// checked centrally before dispatch
+var commandPermissions = map[MsgType]permission{
+	msgKick:      permKick,
+	msgMute:      permMute,
+	msgUnmute:    permMute,
+	msgBroadcast: permBroadcast,
+	msgShutdown:  permShutdown,
+	msgStats:     permStats,
+	msgGrant:     permRoles,
+	msgRevoke:    permRoles,
+	msgReload:    permReload,
+}
+
+// permissionHelp describes the commands unlocked by each permission (for the admin menu)
+var permissionHelp = map[permission]string{
+	permKick:      "/kick <username> - Kick a user",
+	permMute:      "/mute <username>, /unmute <username> - Silence a user",
+	permBroadcast: "/broadcast <msg> - Server announcement",
+	permShutdown:  "/shutdown - Shutdown server",
+	permStats:     "/stats - Server statistics",
+	permRoles:     "/grant <username> <role>, /revoke <username> - Change roles",
+	permReload:    "/reload - Reload the config file, roles and accounts",
+}
+
+// roleTable maps each role to the permissions it grants
+type roleTable map[string]map[permission]bool
+
+// defaultRoles is used when no roles file exists
+func defaultRoles() roleTable {
+	return roleTable{
+		roleOwner:     {permKick: true, permMute: true, permBroadcast: true, permShutdown: true, permStats: true, permRoles: true, permReload: true},
+		roleModerator: {permKick: true, permMute: true, permBroadcast: true, permStats: true},
+		roleMember:    {permStats: true},
+		roleGuest:     {permStats: true},
+	}
+}
+
+// loadRoles reads role permissions from a JSON file such as
+// {"moderator": ["kick", "mute"], "guest": []}; roles it omits keep their defaults
+func loadRoles(path string) (roleTable, error) {
+	roles := defaultRoles()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return roles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string][]permission
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for role, perms := range raw {
+		set := make(map[permission]bool)
+		for _, p := range perms {
+			if _, ok := permissionHelp[p]; !ok {
+				return nil, fmt.Errorf("%s: role %q has unknown permission %q", path, role, p)
+			}
+			set[p] = true
+		}
+		roles[role] = set
+	}
+	return roles, nil
+}
+
+// exists reports whether role is defined
+func (rt roleTable) exists(role string) bool {
+	_, ok := rt[role]
+	return ok
+}
+
+// allows reports whether role grants p
+func (rt roleTable) allows(role string, p permission) bool {
+	return rt[role][p]
+}
+
+// permissions lists the permissions role grants, in a stable order
+func (rt roleTable) permissions(role string) []permission {
+	var perms []permission
+	for _, p := range knownPermissions {
+		if rt[role][p] {
+			perms = append(perms, p)
+		}
+	}
+	return perms
+}
+
+// names lists all defined roles, sorted
+func (rt roleTable) names() []string {
+	names := make([]string, 0, len(rt))
+	for r := range rt {
+		names = append(names, r)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// privileged reports whether role grants anything beyond viewing stats
+func (rt roleTable) privileged(role string) bool {
+	for p := range rt[role] {
+		if p != permStats {
+			return true
+		}
+	}
+	return false
+}
+
+// menu renders the admin menu for role, listing only commands it may use
+func (rt roleTable) menu(role string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "ADMIN MENU (%s):\n", role)
+	sb.WriteString("1. /users - List all users\n")
+	for i, p := range rt.permissions(role) {
+		fmt.Fprintf(&sb, "%d. %s\n", i+2, permissionHelp[p])
+	}
+	return sb.String()
+}
+
+// encodePermissions joins permissions for the wire ("kick,mute")
+func encodePermissions(perms []permission) string {
+	s := make([]string, len(perms))
+	for i, p := range perms {
+		s[i] = string(p)
+	}
+	return strings.Join(s, ",")
+}
+
+// findClient returns the logged-in client using name (caller holds s.mu)
+func (s *Server) findClient(name string) *Client {
+	for _, c := range s.clients {
+		if c.name == name && c.authed {
+			return c
+		}
+	}
+	return nil
+}
+
+// setMuted mutes or unmutes target on behalf of actor (caller holds s.mu)
+func (s *Server) setMuted(actor *Client, target string, muted bool) {
+	c := s.findClient(target)
+	if c == nil {
+		s.sendError(actor, fmt.Sprintf("User %s not found", target))
+		return
+	}
+	if s.roles.allows(c.role, permMute) && muted {
+		s.sendError(actor, fmt.Sprintf("%s is a %s and cannot be muted", target, c.role))
+		return
+	}
+	c.muted = muted
+	verb := "muted"
+	if !muted {
+		verb = "unmuted"
+	}
+	s.sendSystem(c, systemNotice, fmt.Sprintf("You have been %s by %s", verb, actor.name))
+	s.sendSystem(actor, systemDone, fmt.Sprintf("%s %s", target, verb))
+}
+
+// kick ends target's session on behalf of actor. Users who may kick cannot be
+// kicked, as with muting (caller holds s.mu).
+func (s *Server) kick(actor *Client, target string) {
+	c := s.findClient(target)
+	if c == nil {
+		s.sendError(actor, fmt.Sprintf("User %s not found", target))
+		return
+	}
+	if s.roles.allows(c.role, permKick) {
+		s.sendError(actor, fmt.Sprintf("%s is a %s and cannot be kicked", target, c.role))
+		return
+	}
+	delete(s.clients, sessionKey(c.token))
+	s.sendError(c, fmt.Sprintf("You have been kicked by %s", actor.name))
+	// Tell the target's room (and the kicker, if elsewhere)
+	if notice := s.leaveRoom(c, leaveKicked, actor.name); notice.Room != actor.room {
+		s.sendEvent(actor, notice)
+	}
+}
+
+// setRole changes the persisted role of target's account on behalf of actor and
+// applies it immediately if target is online (caller holds s.mu)
+func (s *Server) setRole(actor *Client, target, role string) {
+	if !s.roles.exists(role) || role == roleGuest {
+		s.sendError(actor, fmt.Sprintf("Cannot grant role %q. Roles: %s", role, strings.Join(s.roles.names(), ", ")))
+		return
+	}
+	if target == actor.account {
+		s.sendError(actor, "You cannot change your own role")
+		return
+	}
+	if err := s.users.setRole(target, role); err != nil {
+		s.sendError(actor, err.Error())
+		return
+	}
+	log.Printf("%s set the role of %s to %s", actor.name, target, role)
+
+	// Apply to every live session logged in to that account
+	for _, c := range s.clients {
+		if c.account == target && c.authed {
+			c.role = role
+			perms := encodePermissions(s.roles.permissions(role))
+			s.sendReliable(c, newPacket(msgRole, role, perms))
+			s.sendSystem(c, systemNotice, fmt.Sprintf("%s made you a %s", actor.name, role))
+		}
+	}
+	s.sendSystem(actor, systemDone, fmt.Sprintf("%s is now a %s", target, role))
+}
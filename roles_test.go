@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRolesOverridesDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "roles.json")
+	os.WriteFile(path, []byte(`{"member": ["stats", "mute"], "helper": ["kick"]}`), 0o600)
+
+	roles, err := loadRoles(path)
+	if err != nil {
+		t.Fatalf("loadRoles: %v", err)
+	}
+	if !roles.allows(roleMember, permMute) || roles.allows(roleMember, permKick) {
+		t.Errorf("member permissions = %v, want stats and mute", roles.permissions(roleMember))
+	}
+	if !roles.allows("helper", permKick) {
+		t.Error("custom role was not loaded")
+	}
+	if !roles.allows(roleOwner, permShutdown) {
+		t.Error("owner lost its default permissions")
+	}
+}
+
+func TestLoadRolesRejectsUnknownPermission(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "roles.json")
+	os.WriteFile(path, []byte(`{"member": ["fly"]}`), 0o600)
+	if _, err := loadRoles(path); err == nil {
+		t.Fatal("unknown permission accepted")
+	}
+}
+
+func TestEveryPrivilegedCommandHasKnownPermission(t *testing.T) {
+	for kind, perm := range commandPermissions {
+		if _, ok := permissionHelp[perm]; !ok {
+			t.Errorf("message type %d requires undocumented permission %q", kind, perm)
+		}
+	}
+}
+
+func TestKickChecksTarget(t *testing.T) {
+	s := newServer()
+	var sent [][]byte
+	mod := testClient(s, "mod")
+	mod.role = roleModerator
+	mod.link = newReliableLink(func(data []byte) error { sent = append(sent, data); return nil })
+	owner, bob := testClient(s, "owner"), testClient(s, "bob")
+	owner.role = roleOwner
+	testClient(s, "ghost").authed = false // Still at the password prompt
+	for _, c := range []*Client{mod, owner, bob} {
+		s.enterRoom(c, defaultRoom)
+	}
+	told := func(want string) {
+		t.Helper()
+		s.sendBatch(s.outbox)
+		s.outbox = nil
+		for _, data := range sent {
+			if bytes.Contains(data, []byte(want)) {
+				sent = nil
+				return
+			}
+		}
+		t.Errorf("moderator was not told %q", want)
+	}
+
+	s.kick(mod, "owner")
+	told("owner is a owner and cannot be kicked")
+	s.kick(mod, "nobody")
+	told("User nobody not found")
+	s.kick(mod, "ghost")
+	told("User ghost not found")
+	if len(s.clients) != 4 {
+		t.Fatalf("refused kicks removed sessions: %d left", len(s.clients))
+	}
+
+	s.kick(mod, "bob")
+	if s.findClient("bob") != nil || s.members(defaultRoom) != 2 {
+		t.Error("member survived being kicked")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"     // For room notices
+	"sort"    // For stable room listings
+	"strings" // For room name checks
+)
+
+const (
+	defaultRoom = "lobby" // Everyone starts here; it is never deleted
+	maxRoomName = 32      // Longest room name accepted
+)
+
+// room is a named channel: chat, typing and join/leave notices stay inside it
+type room struct {
+	name  string
+	topic string
+}
+
+// normalizeRoom validates a room name typed by a user ("#Go" becomes "go")
+func normalizeRoom(name string) (string, error) {
+	name = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "#"))
+	if name == "" || len(name) > maxRoomName {
+		return "", fmt.Errorf("room names must be 1-%d characters", maxRoomName)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return "", fmt.Errorf("room names may only contain letters, digits, - and _")
+		}
+	}
+	return name, nil
+}
+
+// members counts the logged-in clients in the named room (caller holds s.mu)
+func (s *Server) members(name string) int {
+	n := 0
+	for _, c := range s.clients {
+		if c.authed && c.room == name {
+			n++
+		}
+	}
+	return n
+}
+
+// enterRoom moves client into the named room, creating it if needed (caller holds s.mu)
+func (s *Server) enterRoom(client *Client, name string) {
+	if client.room == name {
+		s.sendError(client, fmt.Sprintf("You are already in #%s", name))
+		return
+	}
+	if client.room != "" {
+		s.leaveRoom(client, leaveMoved, name)
+	}
+
+	r, ok := s.rooms[name]
+	if !ok {
+		r = &room{name: name}
+		s.rooms[name] = r
+	}
+	client.room = name
+	s.sendReliable(client, newPacket(msgRoom, r.name, r.topic)) // Updates the client's prompt
+	join := s.newEvent(eventJoin)
+	join.Room, join.Sender, join.Role = name, client.name, client.role
+	s.broadcast(join)
+	if r.topic != "" {
+		s.sendEvent(client, s.topicEvent(r))
+	}
+	if scrollback := s.historyEvent(name, scrollbackLines); len(scrollback.History) > 0 {
+		s.sendEvent(client, scrollback) // Catch up on the conversation
+	}
+}
+
+// leaveRoom takes client out of its room, tells the remaining members why
+// and deletes the room once it is empty. It returns the leave event it
+// broadcast (caller holds s.mu).
+func (s *Server) leaveRoom(client *Client, reason, target string) event {
+	old := client.room
+	if old == "" {
+		return event{}
+	}
+	client.room = ""
+	ev := s.newEvent(eventLeave)
+	ev.Room, ev.Sender, ev.Reason, ev.Target = old, client.name, reason, target
+	s.broadcast(ev)
+	if old != defaultRoom && s.members(old) == 0 {
+		delete(s.rooms, old)
+	}
+	return ev
+}
+
+// listRooms lists every room with its member count and topic (caller holds s.mu)
+func (s *Server) listRooms(current string) event {
+	names := make([]string, 0, len(s.rooms))
+	for name := range s.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ev := s.newEvent(eventRoomList)
+	ev.Room = current
+	for _, name := range names {
+		ev.Rooms = append(ev.Rooms, roomInfo{Name: name, Members: s.members(name), Topic: s.rooms[name].topic})
+	}
+	return ev
+}
+
+// topicEvent tells a client the topic of r
+func (s *Server) topicEvent(r *room) event {
+	ev := s.newEvent(eventTopic)
+	ev.Room, ev.Text = r.name, r.topic
+	return ev
+}
+
+// setTopic shows or changes the topic of client's room (caller holds s.mu)
+func (s *Server) setTopic(client *Client, topic string) {
+	r := s.rooms[client.room]
+	if r == nil {
+		return
+	}
+	if topic == "" {
+		s.sendEvent(client, s.topicEvent(r))
+		return
+	}
+	// Everyone lands in the lobby, so its topic is an announcement
+	if r.name == defaultRoom && !s.roles.allows(client.role, permBroadcast) {
+		s.sendError(client, fmt.Sprintf("Permission denied: setting the #%s topic needs %q", defaultRoom, permBroadcast))
+		return
+	}
+	ev := s.topicEvent(r)
+	ev.Sender, ev.Text = client.name, topic
+	if !s.fits(client, ev) {
+		return
+	}
+	r.topic = topic
+	s.broadcast(ev)
+}
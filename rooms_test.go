@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+// testClient adds a logged-in client to s whose packets go nowhere
+func testClient(s *Server, name string) *Client {
+	c := &Client{name: name, token: []byte(name), authed: true, role: roleMember, link: newReliableLink(func([]byte) error { return nil })}
+	s.clients[sessionKey(c.token)] = c
+	return c
+}
+
+func TestNormalizeRoom(t *testing.T) {
+	for in, want := range map[string]string{"#Go": "go", " dev-ops ": "dev-ops", "a_1": "a_1"} {
+		if got, err := normalizeRoom(in); err != nil || got != want {
+			t.Errorf("normalizeRoom(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "#", "two words", "ünïcode", "x23456789012345678901234567890123"} {
+		if _, err := normalizeRoom(bad); err == nil {
+			t.Errorf("normalizeRoom(%q) accepted", bad)
+		}
+	}
+}
+
+func TestRoomsAreDeletedWhenEmpty(t *testing.T) {
+	s := newServer()
+	alice, bob := testClient(s, "alice"), testClient(s, "bob")
+	s.enterRoom(alice, defaultRoom)
+	s.enterRoom(bob, defaultRoom)
+
+	s.enterRoom(alice, "go")
+	s.enterRoom(bob, "go")
+	if s.members("go") != 2 || s.members(defaultRoom) != 0 {
+		t.Fatalf("members: go=%d lobby=%d, want 2 and 0", s.members("go"), s.members(defaultRoom))
+	}
+	if s.rooms[defaultRoom] == nil {
+		t.Fatal("empty lobby was deleted")
+	}
+
+	s.enterRoom(alice, defaultRoom)
+	if s.rooms["go"] == nil {
+		t.Fatal("#go deleted while bob is still in it")
+	}
+	s.leaveRoom(bob, leaveQuit, "")
+	if s.rooms["go"] != nil {
+		t.Error("empty #go was not deleted")
+	}
+}
+
+func TestRoomMessagesStayInRoom(t *testing.T) {
+	s := newServer()
+	alice, bob := testClient(s, "alice"), testClient(s, "bob")
+	s.enterRoom(alice, "go")
+	s.enterRoom(bob, defaultRoom)
+	s.outbox = nil // Join notices
+
+	s.dispatch("alice", alice, newPacket(msgChat, "hello gophers"))
+	if len(s.outbox) != 1 || s.outbox[0].ev.Room != "go" {
+		t.Errorf("chat from #go queued as %+v", s.outbox)
+	}
+
+	s.outbox = nil
+	alice.role = roleOwner
+	s.dispatch("alice", alice, newPacket(msgBroadcast, "hi all"))
+	if len(s.outbox) != 1 || s.outbox[0].ev.Room != "" {
+		t.Errorf("admin announcement queued as %+v, want it for everyone", s.outbox)
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"           // For reading known_hosts
+	"bytes"           // For checking tokens
+	"crypto/aes"      // Block cipher for the session AEAD
+	"crypto/cipher"   // For AES-GCM
+	"crypto/ecdh"     // For the X25519 key exchange
+	"crypto/ed25519"  // For the server's long-term identity key
+	"crypto/hkdf"     // For deriving session keys
+	"crypto/rand"     // For ephemeral keys
+	"crypto/sha256"   // For key derivation and fingerprints
+	"encoding/base64" // For printable fingerprints
+	"encoding/binary" // For nonce counters
+	"encoding/hex"    // For key files
+	"errors"          // For handshake errors
+	"fmt"             // For error details
+	"log"             // For logging dropped handshakes
+	"net"             // For handshake I/O
+	"os"              // For key files
+	"path/filepath"   // For the known_hosts location
+	"strings"         // For parsing key files
+	"sync"            // For guarding channel state
+	"time"            // For handshake retries
+)
+
+// Every packet after the handshake travels inside a msgSealed packet:
+//
+//	msgSealed [token] fields: counter (8 B), AES-256-GCM(encoded inner packet)
+//
+// Each direction has its own key and a counter that starts at 1 and is used as
+// the GCM nonce, so nonces never repeat; the receiver rejects counters it has
+// already seen (or that fall behind a sliding window) to stop replays. The
+// session token is authenticated as additional data.
+const (
+	defaultIdentityFile = "server_key"           // Server's ed25519 seed, hex-encoded
+	x25519KeySize       = 32                     // Ephemeral public key size
+	counterSize         = 8                      // Per-packet nonce counter
+	gcmTagSize          = 16                     // AES-GCM authentication tag
+	replayWindow        = 64                     // Counters this far behind the newest are still accepted once
+	handshakeRetry      = 500 * time.Millisecond // Hello is resent this often until answered
+	handshakeTimeout    = 10 * time.Second       // Give up on an unresponsive server
+	maxHandshakes       = 1024                   // Sessions that may be waiting to log in at once
+	maxHostHandshakes   = 8                      // Of those, how many may come from one host
+	maxHelloResends     = 3                      // Answers to a retransmitted hello per session
+
+	// sealedOverhead is what sealing adds to an encoded packet (outer header,
+	// token, counter, tag), plus the token stamped on the inner packet
+	sealedOverhead = headerSize + tokenSize + 2 + counterSize + 2 + gcmTagSize + tokenSize
+)
+
+var (
+	errBadSeal         = errors.New("sealed packet failed authentication")
+	errReplayed        = errors.New("replayed or stale sealed packet")
+	errBadServerHello  = errors.New("invalid server hello")
+	errHostKeyChanged  = errors.New("server key changed")
+	errHandshakeFailed = errors.New("no response to key exchange")
+)
+
+// secureChannel encrypts and authenticates one session's packets
+type secureChannel struct {
+	mu    sync.Mutex
+	token []byte      // Session token (additional authenticated data)
+	send  cipher.AEAD // Key for packets we send
+	recv  cipher.AEAD // Key for packets we receive
+
+	sendCounter uint64 // Last counter used for sending
+	recvMax     uint64 // Highest counter received
+	recvSeen    uint64 // Bitmap of received counters below recvMax (bit i = recvMax-i)
+}
+
+// newSecureChannel derives the session keys from our ephemeral X25519 key and
+// the peer's public key. Both sides pass the same clientPub and serverPub.
+func newSecureChannel(priv *ecdh.PrivateKey, clientPub, serverPub, token []byte, isServer bool) (*secureChannel, error) {
+	peerPub := clientPub
+	if !isServer {
+		peerPub = serverPub
+	}
+	peer, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, err // e.g. a low-order peer key
+	}
+	info := "gochat session keys" + string(clientPub) + string(serverPub)
+	keys, err := hkdf.Key(sha256.New, shared, token, info, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	toServer, err := newGCM(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	toClient, err := newGCM(keys[32:])
+	if err != nil {
+		return nil, err
+	}
+	c := &secureChannel{token: token, send: toServer, recv: toClient}
+	if isServer {
+		c.send, c.recv = toClient, toServer
+	}
+	return c, nil
+}
+
+// newGCM creates an AES-256-GCM AEAD for key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// counterNonce expands a packet counter into a GCM nonce
+func counterNonce(counter []byte) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce[12-counterSize:], counter)
+	return nonce
+}
+
+// seal encrypts an encoded packet into an encoded msgSealed packet
+func (c *secureChannel) seal(inner []byte) ([]byte, error) {
+	c.mu.Lock()
+	c.sendCounter++
+	counter := binary.BigEndian.AppendUint64(nil, c.sendCounter)
+	ciphertext := c.send.Seal(nil, counterNonce(counter), inner, c.token)
+	c.mu.Unlock()
+
+	return encodePacket(Packet{kind: msgSealed, fields: [][]byte{counter, ciphertext}}.withToken(c.token))
+}
+
+// open authenticates and decrypts a msgSealed packet, returning the encoded inner
+// packet and whether it is the newest packet received so far
+func (c *secureChannel) open(pkt Packet) ([]byte, bool, error) {
+	if len(pkt.fields) != 2 || len(pkt.fields[0]) != counterSize || !bytes.Equal(pkt.token, c.token) {
+		return nil, false, errBadSeal
+	}
+	counter := binary.BigEndian.Uint64(pkt.fields[0])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.unseen(counter) {
+		return nil, false, errReplayed // Cheap check before decrypting
+	}
+	inner, err := c.recv.Open(nil, counterNonce(pkt.fields[0]), pkt.fields[1], c.token)
+	if err != nil {
+		return nil, false, errBadSeal
+	}
+	// Only authentic packets may advance the replay window
+	newest := counter > c.recvMax
+	if newest {
+		if shift := counter - c.recvMax; shift >= replayWindow {
+			c.recvSeen = 0
+		} else {
+			c.recvSeen <<= shift
+		}
+		c.recvSeen |= 1
+		c.recvMax = counter
+	} else {
+		c.recvSeen |= 1 << (c.recvMax - counter)
+	}
+	return inner, newest, nil
+}
+
+// unseen reports whether counter is acceptable: new and not too old (caller holds c.mu)
+func (c *secureChannel) unseen(counter uint64) bool {
+	if counter == 0 {
+		return false
+	}
+	if counter > c.recvMax {
+		return true
+	}
+	age := c.recvMax - counter
+	return age < replayWindow && c.recvSeen&(1<<age) == 0
+}
+
+// handshakeTranscript is what the server signs to prove it owns its identity key
+func handshakeTranscript(clientPub, serverPub, token []byte) []byte {
+	t := []byte("gochat handshake")
+	t = append(t, clientPub...)
+	t = append(t, serverPub...)
+	return append(t, token...)
+}
+
+// fingerprint renders a public key the way it is shown to users
+func fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// loadIdentity reads the server's identity key from path, creating it on first start
+func loadIdentity(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(priv.Seed())+"\n"), 0o600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated new server key in %s", path)
+		return priv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: not a hex-encoded ed25519 seed", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// handshake answers a client hello: it opens a session with fresh keys and
+// proves the server's identity by signing the exchange (caller holds s.mu)
+func (s *Server) handshake(peer Peer, pkt Packet) {
+	if len(pkt.fields) != 1 || len(pkt.fields[0]) != x25519KeySize {
+		log.Printf("Dropped malformed hello from %s", peer.Addr())
+		return
+	}
+	clientPub := pkt.fields[0]
+	key, host := hex.EncodeToString(clientPub), hostOf(peer.Addr())
+	if c, ok := s.handshakes.byKey[key]; ok {
+		// Our reply was lost: send the same one again, but only a few times
+		// and only to where the hello first came from, as sources are spoofable
+		if s.pendingLogin(c) && sameAddr(c.peer.Addr(), peer.Addr()) && c.resends < maxHelloResends {
+			c.resends++
+			peer.Send(c.helloReply)
+		}
+		return // Clients never reuse an ephemeral key, so anything else is a replay
+	}
+	if !s.handshakes.room(host) {
+		s.handshakes.prune(s.pendingLogin)
+		if !s.handshakes.room(host) {
+			log.Printf("Dropped hello from %s: too many sessions waiting to log in", peer.Addr())
+			return
+		}
+	}
+
+	token, channel, serverHello, err := acceptHello(s.identity, clientPub)
+	if err != nil {
+		log.Printf("Key exchange with %s failed: %v", peer.Addr(), err)
+		return
+	}
+
+	// The session exists from now on but stays anonymous until it registers
+	client := &Client{
+		peer:       peer,
+		token:      token,
+		lastSeen:   time.Now(),
+		lastHeard:  time.Now(),
+		presence:   presenceOnline,
+		joinedAt:   time.Now(),
+		channel:    channel,
+		helloReply: serverHello,
+		reasm:      newReassembler(s.maxMessageSize, s.maxBuffered),
+	}
+	client.link = newReliableLink(func(data []byte) error {
+		sealed, err := client.channel.seal(data)
+		if err != nil {
+			return err
+		}
+		return client.peer.Send(sealed) // Follows the session if it migrates
+	})
+	s.clients[sessionKey(token)] = client
+	s.handshakes.add(key, host, client)
+	peer.Send(serverHello)
+}
+
+// handshakes tracks sessions that have said hello but not logged in yet, so
+// retransmitted hellos are found without a scan and floods of spoofed hellos
+// cannot pile up state or replies (guarded by the server's mu)
+type handshakes struct {
+	byKey  map[string]*Client // Session by the client's ephemeral key (hex)
+	host   map[string]string  // Host each session's hello came from, by the same key
+	byHost map[string]int     // Sessions per host
+}
+
+func newHandshakes() *handshakes {
+	return &handshakes{byKey: make(map[string]*Client), host: make(map[string]string), byHost: make(map[string]int)}
+}
+
+// room reports whether another session from host may start
+func (h *handshakes) room(host string) bool {
+	return len(h.byKey) < maxHandshakes && h.byHost[host] < maxHostHandshakes
+}
+
+// add records a new session started by the hello with the given key
+func (h *handshakes) add(key, host string, c *Client) {
+	h.byKey[key], h.host[key] = c, host
+	h.byHost[host]++
+}
+
+// prune forgets sessions for which pending is false
+func (h *handshakes) prune(pending func(*Client) bool) {
+	for key, c := range h.byKey {
+		if pending(c) {
+			continue
+		}
+		host := h.host[key]
+		delete(h.byKey, key)
+		delete(h.host, key)
+		if h.byHost[host]--; h.byHost[host] <= 0 {
+			delete(h.byHost, host)
+		}
+	}
+}
+
+// pendingLogin reports whether c is a live session that has not logged in yet
+// (caller holds s.mu)
+func (s *Server) pendingLogin(c *Client) bool {
+	return !c.authed && s.clients[sessionKey(c.token)] == c
+}
+
+// acceptHello runs the server side of the key exchange for a client's ephemeral
+// key, returning the new session token, its channel and the encoded server hello
+func acceptHello(identity ed25519.PrivateKey, clientPub []byte) ([]byte, *secureChannel, []byte, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serverPub := eph.PublicKey().Bytes()
+	token := newSessionToken()
+	channel, err := newSecureChannel(eph, clientPub, serverPub, token, true)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sig := ed25519.Sign(identity, handshakeTranscript(clientPub, serverPub, token))
+	reply, err := encodePacket(Packet{kind: msgServerHello, fields: [][]byte{
+		token, serverPub, identity.Public().(ed25519.PublicKey), sig,
+	}})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return token, channel, reply, nil
+}
+
+// clientHello starts a key exchange: it returns our ephemeral key and the hello packet
+func clientHello() (*ecdh.PrivateKey, []byte, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	hello, err := encodePacket(Packet{kind: msgHello, fields: [][]byte{eph.PublicKey().Bytes()}})
+	return eph, hello, err
+}
+
+// finishHandshake verifies a server hello, pins the server key for host and
+// derives the session's secure channel
+func finishHandshake(eph *ecdh.PrivateKey, reply Packet, host string, hosts *knownHosts) (*secureChannel, error) {
+	if len(reply.fields) != 4 || len(reply.fields[0]) != tokenSize || len(reply.fields[1]) != x25519KeySize ||
+		len(reply.fields[2]) != ed25519.PublicKeySize || len(reply.fields[3]) != ed25519.SignatureSize {
+		return nil, errBadServerHello
+	}
+	token, serverPub := reply.fields[0], reply.fields[1]
+	identity := ed25519.PublicKey(reply.fields[2])
+	clientPub := eph.PublicKey().Bytes()
+	if !ed25519.Verify(identity, handshakeTranscript(clientPub, serverPub, token), reply.fields[3]) {
+		return nil, fmt.Errorf("%w: bad signature", errBadServerHello)
+	}
+	if hosts != nil {
+		if err := hosts.verify(host, identity); err != nil {
+			return nil, err
+		}
+	}
+	return newSecureChannel(eph, clientPub, serverPub, token, false)
+}
+
+// clientHandshake runs the key exchange with the server behind conn, resending
+// the hello until the server answers
+func clientHandshake(conn net.Conn, host string, hosts *knownHosts) (*secureChannel, error) {
+	eph, hello, err := clientHello()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, maxDatagramSize)
+	deadline := time.Now().Add(handshakeTimeout)
+	for time.Now().Before(deadline) {
+		conn.Write(hello)
+		conn.SetReadDeadline(time.Now().Add(handshakeRetry))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break // Resend the hello
+				}
+				return nil, err
+			}
+			pkt, err := decodePacket(append([]byte(nil), buf[:n]...))
+			switch {
+			case errors.Is(err, errUnsupportedVersion):
+				return nil, err
+			case err != nil:
+				continue
+			case pkt.kind == msgServerHello:
+				return finishHandshake(eph, pkt, host, hosts)
+			case pkt.kind == msgError:
+				return nil, errors.New(pkt.field(0))
+			}
+		}
+	}
+	return nil, errHandshakeFailed
+}
+
+// knownHosts pins server identity keys, trusting each server's key on first use
+type knownHosts struct {
+	path     string       // File of "host fingerprint" lines
+	announce func(string) // Tells the user about a newly trusted key (nil prints it)
+}
+
+// configDir is where the client keeps its keys and pins: $GOCHAT_HOME or ~/.gochat
+func configDir() string {
+	if dir := os.Getenv("GOCHAT_HOME"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".gochat")
+}
+
+// defaultKnownHosts returns $GOCHAT_KNOWN_HOSTS or known_hosts in configDir
+func defaultKnownHosts() *knownHosts {
+	if path := os.Getenv("GOCHAT_KNOWN_HOSTS"); path != "" {
+		return &knownHosts{path: path}
+	}
+	return &knownHosts{path: filepath.Join(configDir(), "known_hosts")}
+}
+
+// lookup returns the fingerprint pinned for host, if any
+func (k *knownHosts) lookup(host string) (string, error) {
+	f, err := os.Open(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == host {
+			return fields[1], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// verify checks key against the one pinned for host, pinning it if host is new
+func (k *knownHosts) verify(host string, key ed25519.PublicKey) error {
+	pinned, err := k.lookup(host)
+	if err != nil {
+		return err
+	}
+	got := fingerprint(key)
+	if pinned == got {
+		return nil
+	}
+	if pinned != "" {
+		return fmt.Errorf("%w for %s: expected %s, got %s. Someone may be intercepting the "+
+			"connection; if the server key was replaced on purpose, remove the %s line from %s",
+			errHostKeyChanged, host, pinned, got, host, k.path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(k.path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(k.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %s\n", host, got); err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("Trusting new server key for %s: %s", host, got)
+	if k.announce == nil {
+		fmt.Println(msg)
+		return nil
+	}
+	k.announce(msg)
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testHandshake runs both sides of the key exchange in memory
+func testHandshake(t *testing.T, identity ed25519.PrivateKey, hosts *knownHosts) (client, server *secureChannel, err error) {
+	t.Helper()
+	eph, hello, err := clientHello()
+	if err != nil {
+		t.Fatalf("clientHello: %v", err)
+	}
+	pkt, _ := decodePacket(hello)
+	_, server, reply, err := acceptHello(identity, pkt.fields[0])
+	if err != nil {
+		t.Fatalf("acceptHello: %v", err)
+	}
+	replyPkt, _ := decodePacket(reply)
+	client, err = finishHandshake(eph, replyPkt, "chat.example:8080", hosts)
+	return client, server, err
+}
+
+func TestSecureChannelRoundTrip(t *testing.T) {
+	_, identity, _ := ed25519.GenerateKey(rand.Reader)
+	client, server, err := testHandshake(t, identity, nil)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+
+	inner, _ := encodePacket(newPacket(msgChat, "secret plans"))
+	sealed, err := client.seal(inner)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	outer, _ := decodePacket(sealed)
+	got, newest, err := server.open(outer)
+	if err != nil || !newest || string(got) != string(inner) {
+		t.Fatalf("open = %q, %v, %v; want the inner packet", got, newest, err)
+	}
+	if _, _, err := server.open(outer); !errors.Is(err, errReplayed) {
+		t.Errorf("replay: got %v, want errReplayed", err)
+	}
+
+	// Keys differ per direction: the client must not accept its own packets
+	if _, _, err := client.open(outer); err == nil {
+		t.Error("client opened a packet it sealed itself")
+	}
+
+	sealed, _ = client.seal(inner)
+	sealed[len(sealed)-1] ^= 1
+	tampered, _ := decodePacket(sealed)
+	if _, _, err := server.open(tampered); !errors.Is(err, errBadSeal) {
+		t.Errorf("tampered: got %v, want errBadSeal", err)
+	}
+}
+
+func TestSecureChannelReplayWindow(t *testing.T) {
+	_, identity, _ := ed25519.GenerateKey(rand.Reader)
+	client, server, _ := testHandshake(t, identity, nil)
+	inner, _ := encodePacket(newPacket(msgTyping))
+
+	var packets []Packet
+	for i := 0; i < replayWindow+2; i++ {
+		sealed, _ := client.seal(inner)
+		pkt, _ := decodePacket(sealed)
+		packets = append(packets, pkt)
+	}
+
+	// The newest arrives first; older ones inside the window are still accepted once
+	if _, newest, err := server.open(packets[len(packets)-1]); err != nil || !newest {
+		t.Fatalf("newest: %v, %v", newest, err)
+	}
+	if _, newest, err := server.open(packets[5]); err != nil || newest {
+		t.Fatalf("late packet in window: newest=%v, err=%v", newest, err)
+	}
+	if _, _, err := server.open(packets[5]); !errors.Is(err, errReplayed) {
+		t.Errorf("late packet replayed: got %v, want errReplayed", err)
+	}
+	if _, _, err := server.open(packets[0]); !errors.Is(err, errReplayed) {
+		t.Errorf("packet behind the window: got %v, want errReplayed", err)
+	}
+}
+
+func TestKnownHostsTrustOnFirstUse(t *testing.T) {
+	hosts := &knownHosts{path: filepath.Join(t.TempDir(), "known_hosts")}
+	_, identity, _ := ed25519.GenerateKey(rand.Reader)
+
+	if _, _, err := testHandshake(t, identity, hosts); err != nil {
+		t.Fatalf("first connect: %v", err)
+	}
+	if _, _, err := testHandshake(t, identity, hosts); err != nil {
+		t.Fatalf("reconnect with the pinned key: %v", err)
+	}
+
+	_, impostor, _ := ed25519.GenerateKey(rand.Reader)
+	if _, _, err := testHandshake(t, impostor, hosts); !errors.Is(err, errHostKeyChanged) {
+		t.Fatalf("changed key: got %v, want errHostKeyChanged", err)
+	}
+}
+
+func TestFinishHandshakeRejectsBadSignature(t *testing.T) {
+	_, identity, _ := ed25519.GenerateKey(rand.Reader)
+	eph, hello, _ := clientHello()
+	pkt, _ := decodePacket(hello)
+	_, _, reply, _ := acceptHello(identity, pkt.fields[0])
+	replyPkt, _ := decodePacket(reply)
+	replyPkt.fields[0][0] ^= 1 // Swap in a different token after signing
+
+	if _, err := finishHandshake(eph, replyPkt, "chat.example:8080", nil); !errors.Is(err, errBadServerHello) {
+		t.Fatalf("got %v, want errBadServerHello", err)
+	}
+}
+
+// testReplies counts the packets conn receives until it goes quiet
+func testReplies(conn net.Conn) int {
+	buf := make([]byte, maxDatagramSize)
+	n := 0
+	for {
+		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		if _, err := conn.Read(buf); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+func TestHellosAreCapped(t *testing.T) {
+	s := newServer()
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	// One host cannot keep more than a few sessions waiting to log in,
+	// whichever ports its hellos claim to come from
+	flood, other := mem.dial("203.0.113.9:4000"), mem.dial("203.0.113.9:4001")
+	for i := 0; i < maxHostHandshakes+4; i++ {
+		_, hello, _ := clientHello()
+		[]net.Conn{flood, other}[i%2].Write(hello)
+	}
+	if n := testReplies(flood) + testReplies(other); n != maxHostHandshakes {
+		t.Errorf("flooding host got %d server hellos, want %d", n, maxHostHandshakes)
+	}
+
+	// A retransmitted hello is answered again, but not without end
+	_, hello, _ := clientHello()
+	retry := mem.dial("198.51.100.7:4000")
+	for i := 0; i < maxHelloResends+3; i++ {
+		retry.Write(hello)
+	}
+	if n := testReplies(retry); n != 1+maxHelloResends {
+		t.Errorf("retransmitted hello answered %d times, want %d", n, 1+maxHelloResends)
+	}
+
+	// Everyone else can still log in
+	testRegister(t, mem.dial("elsewhere"), "alice")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.clients) != maxHostHandshakes+2 {
+		t.Errorf("%d sessions, want %d", len(s.clients), maxHostHandshakes+2)
+	}
+}
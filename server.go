@@ -1,315 +1,907 @@
 package main
 
 import (
-	"bufio"   // For reading input from console
-	"fmt"     // For formatted I/O
-	"log"     // For logging errors
-	"net"     // For network operations
-	"os"      // For OS operations
-	"strings" // For string manipulation
-	"sync"    // For synchronization
-	"time"    // For time operations
+	"crypto/ed25519" // For the server identity key
+	"crypto/rand"    // For generating a throwaway identity
+	"crypto/subtle"  // For comparing session tokens
+	"encoding/hex"   // For account salts
+	"errors"         // For matching decode errors
+	"flag"           // For recognizing -h
+	"fmt"            // For formatted I/O
+	"log"            // For logging errors
+	"net"            // For network operations
+	"net/http"       // For the web gateway
+	"os"             // For OS operations
+	"os/signal"      // For reload and shutdown signals
+	"strconv"        // For challenge parameters
+	"strings"        // For checking usernames
+	"sync"           // For synchronization
+	"sync/atomic"    // For event IDs
+	"syscall"        // For SIGHUP and SIGTERM
+	"time"           // For time operations
+	"unicode"        // For checking usernames
+)
+
+const (
+	versionReplyInterval = time.Minute // How often one host is told its client is too old
+	maxReplyHosts        = 4096        // Hosts remembered for that, at most
 )
 
 // Client represents a connected chat client
 type Client struct {
-	addr     *net.UDPAddr // Network address of client
-	name     string       // Username
-	lastSeen time.Time    // Last activity timestamp
-	isAdmin  bool         // Admin privileges flag
+	peer      Peer          // Where the client is now (may migrate, even across transports)
+	token     []byte        // Session token the client includes on every packet
+	name      string        // Username ("" until REGISTER arrives)
+	lastSeen  time.Time     // Last activity timestamp (chat and commands, not heartbeats)
+	lastHeard time.Time     // Last packet of any kind, heartbeats included (liveness)
+	heartbeat time.Duration // Heartbeat interval the client was told in its welcome
+	role      string        // Role granting permissions (from the user store)
+	muted     bool          // Muted clients cannot chat, whisper or rename
+	account   string        // Account the client logged in as ("" for guests)
+	authed    bool          // False until registered and past any password challenge
+	ticket    []byte        // Resumes the session; unlike token it is only ever sent sealed
+	nonce     []byte        // Outstanding password challenge
+	joinedAt  time.Time     // When the session started (for login timeouts)
+	link      *reliableLink // Sequencing/ACK state for this client
+	reasm     *reassembler  // Partial fragmented messages from this client
+
+	channel    *secureChannel // Session keys and replay window
+	helloReply []byte         // Encoded server hello, resent if the client asks again
+	resends    int            // Times helloReply was resent
+
+	room string // Current room ("" until logged in)
+
+	whisperEnc  []byte // Published X25519 key others encrypt whispers to
+	whisperSign []byte // Published ed25519 key others verify whispers with
+
+	jsonEvents bool // Registered in JSON mode: gets msgEvent packets instead of text
+
+	presence    string // presenceOnline, presenceAway or presenceBusy
+	awayMessage string // Told to whoever whispers while away or busy
+	status      string // Free text shown in /users
+	autoAway    bool   // Set away by the server for idling; back with the next activity
 }
 
 // Server manages the chat server state
 type Server struct {
-	clients   map[string]*Client // Map of connected clients (key: address string)
+	clients   map[string]*Client // Map of connected clients (key: hex session token)
+	rooms     map[string]*room   // Rooms with members, plus the lobby (guarded by mu)
 	mu        sync.RWMutex       // Mutex for thread-safe client access
-	messages  chan string        // Channel for broadcasting messages
+	messages  chan outbatch      // Queued events on their way to the broadcaster
+	outbox    []outgoing         // Events queued under mu, passed to messages by unlock
+	outSeq    uint64             // Number of the last batch passed on (guarded by mu)
+	delivered atomic.Uint64      // Number of the last batch sent
 	startTime time.Time          // Server start time
 	shutdown  chan struct{}      // Channel for graceful shutdown
+	stopOnce  sync.Once          // Closes shutdown once (see stop)
+	draining  bool               // Counting down to shutdown: no new logins (guarded by mu)
+
+	users           *userStore         // Registered accounts
+	roles           roleTable          // Permissions granted by each role
+	frag            *fragmenter        // Splits packets larger than the MTU
+	maxMessageSize  int                // Largest message a client may send
+	maxBuffered     int                // Bytes of partial messages kept per client
+	maxUsers        int                // Logged-in users at once (0: no limit)
+	loginTimeout    time.Duration      // Time a client has to answer the password challenge
+	motd            string             // Message of the day, shown on login ("" for none)
+	config          serverConfig       // Settings in effect, compared against on reload
+	configArgs      []string           // Command line flags, applied again on reload
+	logFile         *os.File           // Log destination opened by openLog (nil: stderr)
+	rolesFile       string             // Where roles were loaded from, reread on reload ("" for none)
+	shutdownDrain   time.Duration      // Warning given before shutting down
+	heartbeat       time.Duration      // How often clients are asked to send a heartbeat
+	heartbeatMisses int                // Heartbeats a client may miss before its session is dropped
+	awayAfter       time.Duration      // Idle time before a client is marked away (0: never)
+	identity        ed25519.PrivateKey // Long-term key clients pin the server by
+	history         *historyLog        // Chat log and per-room scrollback
+	versionReplies  *replyLimiter      // Rations the version errors sent to old clients
+	handshakes      *handshakes        // Sessions that said hello but have not logged in (guarded by mu)
+	eventID         atomic.Uint64      // ID of the last event created
 }
 
 // newServer creates and initializes a new Server instance
 func newServer() *Server {
-	return &Server{
+	_, identity, _ := ed25519.GenerateKey(rand.Reader) // Replaced by the key file in startServer
+	s := &Server{
 		clients:   make(map[string]*Client), // Initialize empty client map
-		messages:  make(chan string, 100),   // Buffered message channel
-		startTime: time.Now(),               // Set current time as start time
-		shutdown:  make(chan struct{}),      // Initialize shutdown channel
+		rooms:     map[string]*room{defaultRoom: {name: defaultRoom}},
+		startTime: time.Now(),          // Set current time as start time
+		shutdown:  make(chan struct{}), // Initialize shutdown channel
+
+		users:    newUserStore(),
+		roles:    defaultRoles(),
+		frag:     newFragmenter(defaultMTU - sealedOverhead),
+		identity: identity,
+		history:  newHistory(),
+
+		versionReplies: newReplyLimiter(versionReplyInterval),
+		handshakes:     newHandshakes(),
 	}
+	s.configure(defaultServerConfig())               // Limits, timeouts and the message channel
+	s.eventID.Store(uint64(s.startTime.UnixMicro())) // IDs keep growing across restarts
+	return s
 }
 
-// formatMessage formats a chat message with timestamp and username
-func (s *Server) formatMessage(client *Client, msg string) string {
-	timestamp := time.Now().Format("15:04") // Format time as HH:MM
-	username := client.name
-	if client.isAdmin {
-		username = "👑 " + username // Add crown emoji for admins
+// start runs the server on the given transports until shutdown. They share
+// one client registry, so users of every transport chat in the same rooms.
+// The error says what state could not be saved on the way out.
+func (s *Server) start(transports []Transport) error {
+	for _, t := range transports {
+		go s.serve(t)
 	}
 
-	// Format: [time] username │ message (with colors)
-	return fmt.Sprintf(
-		"\033[90m%s\033[0m \033[36m%-15s\033[0m │ %s",
-		timestamp,
-		username,
-		msg,
-	)
+	// Start message broadcaster goroutine
+	go s.broadcastMessages()
+	// Start client cleanup goroutine
+	go s.cleanupClients()
+	// Start retransmit goroutine
+	go s.retransmitLoop()
+
+	<-s.shutdown // Shutdown signal received
+	log.Println("Shutting down server...")
+	s.flush()    // What was said before the shutdown still goes out
+	s.mu.RLock() // Read lock for clients map
+	// Notify all clients of shutdown
+	goodbye := s.newEvent(eventError)
+	goodbye.Text = "Server is shutting down. Goodbye!"
+	for _, client := range s.clients {
+		s.deliver(client, goodbye) // After everything queued, and nothing is sent after it
+	}
+	s.mu.RUnlock()
+	s.awaitAcks() // The goodbye is reliable too
+	err := s.persist()
+	for _, t := range transports {
+		t.Close() // Stops the receive loops
+	}
+	return err
 }
 
-// start begins the UDP server on specified port
-func (s *Server) start(port string) {
-	// Resolve UDP address
-	addr, err := net.ResolveUDPAddr("udp", port)
-	if err != nil {
-		log.Fatal("Resolve address error:", err)
+// serve handles the packets of one transport until it is closed
+func (s *Server) serve(t Transport) {
+	for {
+		data, peer, err := t.Receive()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Receive error: %v", err)
+			}
+			return
+		}
+		if data == nil { // Stream closed by the client
+			go s.disconnect(peer)
+			continue
+		}
+		// Handle message in new goroutine
+		go s.handleMessage(peer, data)
+	}
+}
+
+// replyLimiter lets each host have one unrequested reply per interval, so
+// packets with a spoofed source cannot turn the server on someone else
+type replyLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time // Host to time of its last reply
+}
+
+// newReplyLimiter allows one reply per host every interval
+func newReplyLimiter(interval time.Duration) *replyLimiter {
+	return &replyLimiter{interval: interval, last: make(map[string]time.Time)}
+}
+
+// allow reports whether addr may have a reply now, and counts it if so
+func (l *replyLimiter) allow(addr net.Addr, now time.Time) bool {
+	host := hostOf(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t, ok := l.last[host]; ok && now.Sub(t) < l.interval {
+		return false
+	}
+	if len(l.last) >= maxReplyHosts {
+		for h, t := range l.last {
+			if now.Sub(t) >= l.interval {
+				delete(l.last, h)
+			}
+		}
+		if len(l.last) >= maxReplyHosts {
+			return false // Under attack from many addresses: stay quiet
+		}
 	}
+	l.last[host] = now
+	return true
+}
 
-	// Create UDP listener
-	conn, err := net.ListenUDP("udp", addr)
+// hostOf names the host addr belongs to: every port of a host counts together
+func hostOf(addr net.Addr) string {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// handleMessage decodes and processes an incoming packet from a client
+func (s *Server) handleMessage(peer Peer, data []byte) {
+	pkt, err := decodePacket(data)
 	if err != nil {
-		log.Fatal("Listen error:", err)
+		if fromOldClient(data, err) {
+			// Tell incompatible clients why they are being ignored, in plain text they
+			// can print. Packets are easily spoofed, so each address hears it rarely.
+			if s.versionReplies.allow(peer.Addr(), time.Now()) {
+				peer.Send([]byte(versionErrorText(err)))
+			}
+		} else {
+			log.Printf("Dropped malformed packet from %s: %v", peer.Addr(), err)
+		}
+		return
 	}
-	defer conn.Close() // Ensure connection closes when function exits
 
-	log.Printf("Server started on %s", port)
+	s.mu.Lock()      // Acquire write lock
+	defer s.unlock() // Release it, then broadcast what the packet caused
 
-	// Start message broadcaster goroutine
-	go s.broadcastMessages(conn)
-	// Start client cleanup goroutine
-	go s.cleanupClients()
+	if pkt.kind == msgHello { // New client: agree on session keys first
+		s.handshake(peer, pkt)
+		return
+	}
 
-	buf := make([]byte, 1024) // Buffer for incoming messages
-	for {
-		select {
-		case <-s.shutdown: // Shutdown signal received
-			log.Println("Shutting down server...")
-			s.mu.RLock() // Read lock for clients map
-			// Notify all clients of shutdown
-			for _, client := range s.clients {
-				conn.WriteToUDP([]byte("\033[31mServer is shutting down. Goodbye!\033[0m\n"), client.addr)
-			}
-			s.mu.RUnlock()
-			return // Exit server loop
-
-		default: // Normal operation
-			// Set read timeout to 1 minute
-			conn.SetReadDeadline(time.Now().Add(1 * time.Minute))
-			// Read incoming UDP packet
-			n, clientAddr, err := conn.ReadFromUDP(buf)
-			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					continue // Timeout is normal, continue waiting
-				}
-				log.Printf("Read error: %v", err)
-				continue
+	// Everything else must be sealed with the keys of an existing session
+	client, clientKey, pkt, ok := s.lookupSession(peer, pkt)
+	if !ok {
+		return
+	}
+	client.lastHeard = time.Now() // Alive, whatever it sent
+
+	if pkt.kind == msgAck { // Acknowledgement of something we sent
+		client.link.handleAck(pkt)
+		return
+	}
+	if pkt.kind == msgHeartbeat { // The client checking we are still here; not activity
+		s.sendUnreliable(client, newPacket(msgHeartbeat))
+		return
+	}
+
+	// Update last activity time for existing client
+	s.noteActivity(client, pkt.kind)
+
+	if pkt.flags&flagReliable == 0 {
+		s.dispatch(clientKey, client, pkt) // Fire-and-forget packet (e.g. typing)
+		return
+	}
+	// Acknowledge, drop duplicates and restore the sender's order
+	for _, ready := range client.link.receive(pkt) {
+		if _, still := s.clients[clientKey]; !still {
+			return // Quit or shut down earlier in this batch
+		}
+		if ready.kind == msgFragment {
+			var ok bool
+			if ready, ok = s.reassemble(client, ready); !ok {
+				continue // Waiting for more fragments (or rejected)
 			}
-			// Handle message in new goroutine
-			go s.handleMessage(conn, clientAddr, string(buf[:n]))
 		}
+		s.dispatch(clientKey, client, ready)
 	}
 }
 
-// handleMessage processes incoming messages from clients
-func (s *Server) handleMessage(conn *net.UDPConn, addr *net.UDPAddr, msg string) {
-	s.mu.Lock()         // Acquire write lock
-	defer s.mu.Unlock() // Ensure lock is released
+// reassemble adds a fragment from client and returns the inner packet once complete (caller holds s.mu)
+func (s *Server) reassemble(client *Client, frag Packet) (Packet, bool) {
+	data, err := client.reasm.add(frag, time.Now())
+	if err != nil {
+		if errors.Is(err, errMessageTooLarge) {
+			s.sendError(client, fmt.Sprintf("Message rejected: %v", err))
+		} else {
+			log.Printf("Dropped fragment from %s: %v", client.name, err)
+		}
+		return Packet{}, false
+	}
+	if data == nil {
+		return Packet{}, false
+	}
+	pkt, err := decodePacket(data)
+	if err != nil || pkt.kind == msgFragment {
+		log.Printf("Dropped reassembled packet from %s: %v", client.name, err)
+		return Packet{}, false
+	}
+	return pkt, true
+}
+
+// nameProblem says what is wrong with a username, or "" if nothing is. Names
+// are used as command arguments and in IRC prefixes, where spaces and colons
+// would split them.
+func nameProblem(name string) string {
+	switch {
+	case name == "":
+		return "Username cannot be empty"
+	case strings.ContainsFunc(name, func(r rune) bool { return r == ':' || unicode.IsSpace(r) || unicode.IsControl(r) }):
+		return "Username cannot contain spaces, colons or control characters"
+	}
+	return ""
+}
 
-	// Handle typing indicator
-	if strings.HasPrefix(msg, "TYPING:") {
-		name := strings.TrimPrefix(msg, "TYPING:")
-		s.messages <- fmt.Sprintf("\033[2m%s is typing...\033[0m", name)
+// register names a fresh session and either logs it in as a guest or sends a
+// password challenge for account names (caller holds s.mu)
+func (s *Server) register(clientKey string, client *Client, pkt Packet) {
+	name := pkt.field(0)
+	client.jsonEvents = pkt.field(3) == eventFormatJSON // Errors below are events too
+	if problem := nameProblem(name); problem != "" {
+		s.sendError(client, problem)
+		delete(s.clients, clientKey)
+		return
+	}
+	// Check for duplicate usernames
+	for key, c := range s.clients {
+		if c.name != name {
+			continue
+		}
+		if prev := pkt.field(4); c.authed && len(prev) == tokenSize && subtle.ConstantTimeCompare([]byte(prev), c.ticket) == 1 {
+			s.resume(client, key, c, pkt) // Our own session, from before the connection dropped
+			return
+		}
+		s.sendError(client, "Username already taken. Please choose another.")
+		delete(s.clients, clientKey)
+		return
+	}
+	if s.draining {
+		s.sendError(client, "Server is shutting down. Please try again later.")
+		delete(s.clients, clientKey)
+		return
+	}
+	if s.maxUsers > 0 && s.loggedIn() >= s.maxUsers { // Resumed sessions were counted already
+		s.sendError(client, "Server is full. Please try again later.")
+		delete(s.clients, clientKey)
 		return
 	}
 
-	clientKey := addr.String() // Use address string as client key
-	client, exists := s.clients[clientKey]
+	client.name = name
+	if len(pkt.fields) >= 3 && len(pkt.fields[1]) == x25519KeySize && len(pkt.fields[2]) == ed25519.PublicKeySize {
+		client.whisperEnc, client.whisperSign = pkt.fields[1], pkt.fields[2] // Published for whispers
+	}
+	acct, hasAccount := s.users.lookup(name)
+	if !hasAccount { // Guests join straight away
+		s.login(client)
+		return
+	}
 
-	if !exists { // New client registration
-		if strings.HasPrefix(msg, "REGISTER:") {
-			name := strings.TrimPrefix(msg, "REGISTER:")
-			// Check for duplicate usernames
-			for _, c := range s.clients {
-				if c.name == name {
-					conn.WriteToUDP([]byte("\033[31mUsername already taken. Please choose another.\033[0m\n"), addr)
-					return
-				}
-			}
+	// Registered name: the client must prove it knows the password
+	salt, _ := hex.DecodeString(acct.Salt)
+	client.nonce = newChallenge()
+	s.sendReliable(client, Packet{kind: msgChallenge, fields: [][]byte{
+		client.token,
+		salt,
+		[]byte(strconv.Itoa(acct.Iterations)),
+		client.nonce,
+	}})
+}
 
-			isAdmin := (name == "admin") // "admin" gets special privileges
-			newClient := &Client{
-				addr:     addr,
-				name:     name,
-				lastSeen: time.Now(),
-				isAdmin:  isAdmin,
-			}
-			s.clients[clientKey] = newClient // Add new client
-
-			// Format and broadcast join notification
-			welcome := s.formatMessage(newClient, "joined the chat")
-			s.messages <- "\033[32m" + welcome + "\033[0m"
-
-			if isAdmin { // Send admin menu if admin
-				adminMsg := "\n\033[33mADMIN MENU:\n" +
-					"1. /users - List all users\n" +
-					"2. /kick <username> - Kick a user\n" +
-					"3. /broadcast <msg> - Server announcement\n" +
-					"4. /stats - Server statistics\n" +
-					"5. /shutdown - Shutdown server\033[0m\n"
-				conn.WriteToUDP([]byte(adminMsg), addr)
-			}
+// resume hands the session old over to client, a new session of the same
+// user who proved it by registering with old's resume ticket. Room, role and mute
+// carry over, and since the user never left nobody is told (caller holds s.mu).
+func (s *Server) resume(client *Client, oldKey string, old *Client, pkt Packet) {
+	delete(s.clients, oldKey)
+	client.name, client.account, client.role, client.muted = old.name, old.account, old.role, old.muted
+	client.whisperEnc, client.whisperSign = old.whisperEnc, old.whisperSign
+	if len(pkt.fields) >= 3 && len(pkt.fields[1]) == x25519KeySize && len(pkt.fields[2]) == ed25519.PublicKeySize {
+		client.whisperEnc, client.whisperSign = pkt.fields[1], pkt.fields[2]
+	}
+	client.jsonEvents = pkt.field(3) == eventFormatJSON
+	client.authed = true
+	client.room = old.room
+	client.presence, client.awayMessage, client.status, client.autoAway = old.presence, old.awayMessage, old.status, old.autoAway
+
+	perms := encodePermissions(s.roles.permissions(client.role))
+	client.heartbeat = s.heartbeat // Kept if a reload changes s.heartbeat
+	client.ticket = newSessionToken()
+	s.sendReliable(client, Packet{kind: msgWelcome, fields: [][]byte{
+		client.token, []byte(client.name), []byte(client.role), []byte(perms), s.heartbeatField(), client.ticket,
+		[]byte(client.room), []byte(strconv.FormatUint(uint64(old.link.delivered()), 10)),
+	}})
+	r := s.rooms[client.room]
+	s.sendReliable(client, newPacket(msgRoom, r.name, r.topic))
+	s.sendText(client, fmt.Sprintf("Session resumed in #%s", r.name))
+	for _, p := range old.link.unacked() { // What the old connection never got
+		if p.kind != msgFragment { // Its other fragments may have arrived on the old one
+			client.link.send(p)
 		}
+	}
+	log.Printf("Session of %s resumed from %s", client.name, client.peer.Addr())
+}
+
+// authenticate handles packets from a client that is not logged in yet:
+// its registration and its challenge response (caller holds s.mu)
+func (s *Server) authenticate(clientKey string, client *Client, pkt Packet) {
+	switch {
+	case pkt.kind == msgRegister && client.name == "":
+		s.register(clientKey, client, pkt)
+
+	case pkt.kind == msgAuth:
+		acct, ok := s.users.lookup(client.name)
+		if !ok || client.nonce == nil || len(pkt.fields) != 1 || !acct.verifyResponse(client.nonce, pkt.fields[0]) {
+			log.Printf("Failed login for %s from %s", client.name, client.peer.Addr())
+			s.sendError(client, "Login failed: wrong password")
+			delete(s.clients, clientKey)
+			return
+		}
+		client.nonce = nil
+		client.account = acct.Name
+		client.role = acct.Role // Privileges come from the store, never from the name
+		s.login(client)
+
+	case pkt.kind == msgQuit:
+		delete(s.clients, clientKey) // Gave up at the password prompt
+	}
+}
+
+// loggedIn counts the clients that completed login (caller holds s.mu)
+func (s *Server) loggedIn() int {
+	n := 0
+	for _, c := range s.clients {
+		if c.authed {
+			n++
+		}
+	}
+	return n
+}
+
+// heartbeatField is the welcome field telling clients how often to send heartbeats (milliseconds)
+func (s *Server) heartbeatField() []byte {
+	return []byte(strconv.FormatInt(s.heartbeat.Milliseconds(), 10))
+}
+
+// login completes registration: welcome the client and announce it (caller holds s.mu)
+func (s *Server) login(client *Client) {
+	client.authed = true
+	if client.role == "" {
+		client.role = roleGuest
+	}
+	// The token is the client's proof of identity from now on. It travels in
+	// every packet's cleartext header, so resuming takes the ticket instead.
+	perms := encodePermissions(s.roles.permissions(client.role))
+	client.heartbeat = s.heartbeat // Kept if a reload changes s.heartbeat
+	client.ticket = newSessionToken()
+	s.sendReliable(client, Packet{kind: msgWelcome, fields: [][]byte{
+		client.token, []byte(client.name), []byte(client.role), []byte(perms), s.heartbeatField(), client.ticket,
+	}})
+
+	// Everyone starts in the lobby; this announces the join there
+	s.enterRoom(client, defaultRoom)
+
+	if s.motd != "" {
+		s.sendText(client, s.motd)
+	}
+	if s.roles.privileged(client.role) { // Send admin menu to privileged roles
+		s.sendSystem(client, systemList, s.roles.menu(client.role))
+	}
+}
+
+// dispatch executes a single in-order packet from a registered client (caller holds s.mu)
+func (s *Server) dispatch(clientKey string, client *Client, pkt Packet) {
+	if !client.authed {
+		s.authenticate(clientKey, client, pkt)
 		return
 	}
 
-	// Update last seen time for existing client
-	client.lastSeen = time.Now()
+	// Central permission check for privileged commands
+	if perm, ok := commandPermissions[pkt.kind]; ok && !s.roles.allows(client.role, perm) {
+		s.sendError(client, fmt.Sprintf("Permission denied: your role (%s) lacks %q", client.role, perm))
+		return
+	}
+	if client.muted && (pkt.kind == msgChat || pkt.kind == msgWhisper || pkt.kind == msgTyping || pkt.kind == msgRename ||
+		(pkt.kind == msgTopic && pkt.field(0) != "") || (pkt.kind == msgStatus && pkt.field(0) != "") ||
+		(pkt.kind == msgPresence && pkt.field(1) != "")) {
+		if pkt.kind != msgTyping {
+			s.sendError(client, "You are muted")
+		}
+		return
+	}
 
-	// Handle different command types
+	// Handle different message types
 	switch {
-	case msg == "/menu" && client.isAdmin:
-		// Show admin menu
-		adminMenu := "\n\033[33mADMIN MENU:\n" +
-			"1. /users - List all users\n" +
-			"2. /kick <username> - Kick a user\n" +
-			"3. /broadcast <msg> - Server announcement\n" +
-			"4. /stats - Server statistics\n" +
-			"5. /shutdown - Shutdown server\033[0m\n"
-		conn.WriteToUDP([]byte(adminMenu), addr)
-
-	case msg == "/users":
+	case pkt.kind == msgTyping:
+		// Typing indicator always uses the registered name, never a client-supplied one
+		ev := s.newEvent(eventTyping)
+		ev.Room, ev.Sender = client.room, client.name
+		s.broadcast(ev)
+
+	case pkt.kind == msgMenu:
+		// Show admin menu for the client's role
+		s.sendSystem(client, systemList, s.roles.menu(client.role))
+
+	case pkt.kind == msgUsers:
 		// List all connected users
-		userList := "\033[1mConnected users:\033[0m\n"
+		ev := s.newEvent(eventUserList)
 		for _, c := range s.clients {
-			adminTag := ""
-			if c.isAdmin {
-				adminTag = " (admin)"
+			if c.authed {
+				ev.Users = append(ev.Users, userInfo{
+					Name: c.name, Room: c.room, Role: c.role, Muted: c.muted,
+					Presence: c.presence, Away: c.awayMessage, Status: c.status,
+				})
 			}
-			userList += fmt.Sprintf("- %s%s\n", c.name, adminTag)
 		}
-		conn.WriteToUDP([]byte(userList), addr)
+		s.sendEvent(client, ev)
 
-	case msg == "/help":
+	case pkt.kind == msgHelp:
 		// Show help message
-		help := "\033[1mCommands:\033[0m\n" +
+		help := "Commands:\n" +
 			"/users - List online users\n" +
 			"/help - Show this help\n" +
 			"/stats - Show server statistics\n" +
+			"/join <room> - Join or create a room\n" +
+			"/leave - Go back to #" + defaultRoom + "\n" +
+			"/rooms - List rooms\n" +
+			"/topic [text] - Show or set the room topic\n" +
+			"/history <n> - Show the last n messages of the room\n" +
+			"/away [message] - Mark yourself away\n" +
+			"/busy [message] - Mark yourself busy\n" +
+			"/back - Mark yourself back\n" +
+			"/status [text] - Set (or clear) your status\n" +
 			"/quit - Disconnect from server\n"
-		conn.WriteToUDP([]byte(help), addr)
+		s.sendSystem(client, systemList, help)
 
-	case msg == "/stats":
+	case pkt.kind == msgStats:
 		// Show server statistics
-		uptime := time.Since(s.startTime).Round(time.Second)
-		stats := fmt.Sprintf("\033[1mServer Stats:\033[0m\n"+
-			"Uptime: %s\n"+
-			"Users connected: %d\n"+
-			"Timeout: 10 minutes (except admins)\n", uptime, len(s.clients))
-		conn.WriteToUDP([]byte(stats), addr)
-
-	case strings.HasPrefix(msg, "RENAME:"):
+		ev := s.newEvent(eventStats)
+		ev.Stats = &statsInfo{
+			Uptime:  int64(time.Since(s.startTime).Round(time.Second) / time.Second),
+			Users:   len(s.clients),
+			Rooms:   len(s.rooms),
+			Timeout: int64(s.heartbeat * time.Duration(s.heartbeatMisses) / time.Second),
+		}
+		s.sendEvent(client, ev)
+
+	case pkt.kind == msgRename:
 		// Handle username change
-		newName := strings.TrimPrefix(msg, "RENAME:")
+		newName := pkt.field(0)
+		if problem := nameProblem(newName); problem != "" {
+			s.sendError(client, problem)
+			return
+		}
 		// Check for duplicate names
 		for _, c := range s.clients {
 			if c.name == newName {
-				conn.WriteToUDP([]byte("\033[31mUsername already taken\033[0m\n"), addr)
+				s.sendError(client, "Username already taken")
 				return
 			}
 		}
+		// Account names are reserved for their owners
+		if _, ok := s.users.lookup(newName); ok && newName != client.account {
+			s.sendError(client, "That name belongs to a registered account. Log in as it instead.")
+			return
+		}
 		oldName := client.name
-		client.name = newName
-		client.isAdmin = (newName == "admin") // Update admin status if name changed to "admin"
+		client.name = newName // Privileges stay with the logged-in account, not the name
 		// Broadcast name change notification
-		s.messages <- fmt.Sprintf("\033[33m[%s] %s changed name to %s\033[0m",
-			time.Now().Format("3:04 PM"), oldName, newName)
-
-	case strings.HasPrefix(msg, "WHISPER:"):
-		// Handle private messages
-		parts := strings.SplitN(strings.TrimPrefix(msg, "WHISPER:"), ":", 2)
-		if len(parts) == 2 {
-			targetName := parts[0]
-			whisperMsg := parts[1]
-			// Find target user
-			for _, c := range s.clients {
-				if c.name == targetName {
-					// Send private message to target
-					privateMsg := fmt.Sprintf("\033[35m[WHISPER from %s] %s\033[0m",
-						client.name, whisperMsg)
-					conn.WriteToUDP([]byte(privateMsg), c.addr)
-					// Send confirmation to sender
-					conn.WriteToUDP([]byte(fmt.Sprintf("\033[36m[Whisper sent to %s]\033[0m",
-						targetName)), addr)
-					return
-				}
-			}
-			// Target not found
-			conn.WriteToUDP([]byte(fmt.Sprintf("\033[31mUser %s not found\033[0m",
-				targetName)), addr)
+		ev := s.newEvent(eventRename)
+		ev.Room, ev.Sender, ev.Target = client.room, oldName, newName
+		s.broadcast(ev)
+
+	case pkt.kind == msgKeyRequest:
+		// Hand out a user's published whisper keys
+		target := s.findClient(pkt.field(0))
+		switch {
+		case target == nil:
+			s.sendError(client, fmt.Sprintf("User %s not found", pkt.field(0)))
+			s.sendReliable(client, newPacket(msgKey, pkt.field(0))) // No key: drop what waits for it
+		case target.whisperEnc == nil:
+			s.sendError(client, fmt.Sprintf("%s cannot receive encrypted whispers", target.name))
+			s.sendReliable(client, newPacket(msgKey, target.name))
+		default:
+			s.sendReliable(client, Packet{kind: msgKey, fields: [][]byte{
+				[]byte(target.name), target.whisperEnc, target.whisperSign,
+			}})
+		}
+
+	case pkt.kind == msgKeys:
+		// Whisper keys sent after login by bridges, which only hand out a user's
+		// stored keys once the account's password is known to be right
+		switch {
+		case client.whisperEnc != nil:
+			s.sendError(client, "Your whisper keys are already published")
+		case len(pkt.fields) != 2 || len(pkt.fields[0]) != x25519KeySize || len(pkt.fields[1]) != ed25519.PublicKeySize:
+			s.sendError(client, "Malformed whisper keys")
+		default:
+			client.whisperEnc, client.whisperSign = pkt.fields[0], pkt.fields[1]
 		}
 
-	case strings.HasPrefix(msg, "QUIT:"):
+	case pkt.kind == msgWhisper:
+		// Relay an encrypted private message; only the recipient can read it
+		targetName := pkt.field(0)
+		target := s.findClient(targetName)
+		if target == nil || len(pkt.fields) != 2 {
+			s.sendError(client, fmt.Sprintf("User %s not found", targetName))
+			return
+		}
+		if client.whisperSign == nil {
+			s.sendError(client, "Your client did not publish a whisper key")
+			return
+		}
+		ev := s.newEvent(eventWhisper)
+		ev.Sender, ev.Key, ev.Envelope = client.name, client.whisperSign, pkt.fields[1]
+		if !s.fits(client, ev) {
+			return
+		}
+		s.sendEvent(target, ev)
+		// Send confirmation to sender
+		s.sendSystem(client, systemDone, fmt.Sprintf("[Whisper sent to %s]", targetName))
+		if target.presence != presenceOnline { // Tell them not to wait for an answer
+			reply := s.presenceEvent(target)
+			reply.Reason = presenceReply
+			s.sendEvent(client, reply)
+		}
+
+	case pkt.kind == msgQuit:
 		// Handle client disconnection
-		name := strings.TrimPrefix(msg, "QUIT:")
 		delete(s.clients, clientKey) // Remove client from map
-		// Broadcast leave notification
-		s.messages <- fmt.Sprintf("\033[31m[%s] %s left the chat\033[0m",
-			time.Now().Format("3:04 PM"), name)
+		// Broadcast leave notification to the room
+		s.leaveRoom(client, leaveQuit, "")
 
-	case strings.HasPrefix(msg, "KICK:") && client.isAdmin:
+	case pkt.kind == msgKick:
 		// Admin kick command
-		targetName := strings.TrimPrefix(msg, "KICK:")
-		// Find and kick target user
-		for key, c := range s.clients {
-			if c.name == targetName {
-				delete(s.clients, key) // Remove client
-				// Notify kicked user
-				conn.WriteToUDP([]byte("\033[31mYou have been kicked by admin\033[0m\n"), c.addr)
-				// Broadcast kick notification
-				s.messages <- fmt.Sprintf("\033[31m[%s] %s was kicked by admin\033[0m",
-					time.Now().Format("3:04 PM"), targetName)
-				break
-			}
-		}
+		s.kick(client, pkt.field(0))
 
-	case strings.HasPrefix(msg, "BROADCAST:") && client.isAdmin:
+	case pkt.kind == msgBroadcast:
 		// Admin broadcast message
-		message := strings.TrimPrefix(msg, "BROADCAST:")
-		s.messages <- fmt.Sprintf("\033[33m[ADMIN ANNOUNCEMENT] %s\033[0m", message)
+		ev := s.newEvent(eventAnnouncement)
+		ev.Sender, ev.Text = client.name, pkt.field(0) // No room: everyone gets it
+		if s.fits(client, ev) {
+			s.broadcast(ev)
+		}
+
+	case pkt.kind == msgShutdown:
+		// Admin shutdown command: count down, or stop now if already counting
+		s.beginShutdown(client.name)
 
-	case strings.HasPrefix(msg, "SHUTDOWN:") && client.isAdmin:
-		// Admin shutdown command
-		close(s.shutdown) // Trigger shutdown
+	case pkt.kind == msgMute || pkt.kind == msgUnmute:
+		// Silence or unsilence a user for the rest of their session
+		s.setMuted(client, pkt.field(0), pkt.kind == msgMute)
+
+	case pkt.kind == msgGrant:
+		// Give a registered user a new role (persisted)
+		s.setRole(client, pkt.field(0), pkt.field(1))
+
+	case pkt.kind == msgRevoke:
+		// Return a registered user to the default member role (persisted)
+		s.setRole(client, pkt.field(0), roleMember)
+
+	case pkt.kind == msgReload:
+		// Reread the config file, roles and accounts
+		changes, err := s.reload(client.name)
+		if err != nil {
+			s.sendError(client, "Reload rejected: "+err.Error())
+			return
+		}
+		s.sendText(client, reloadSummary(changes))
+
+	case pkt.kind == msgJoin:
+		// Move to another room, creating it if needed
+		name, err := normalizeRoom(pkt.field(0))
+		if err != nil {
+			s.sendError(client, err.Error())
+			return
+		}
+		s.enterRoom(client, name)
+
+	case pkt.kind == msgLeave:
+		// Go back to the lobby
+		if client.room == defaultRoom {
+			s.sendError(client, fmt.Sprintf("You are in #%s already. Use /quit to disconnect.", defaultRoom))
+			return
+		}
+		s.enterRoom(client, defaultRoom)
+
+	case pkt.kind == msgRooms:
+		// List rooms with member counts and topics
+		s.sendEvent(client, s.listRooms(client.room))
+
+	case pkt.kind == msgTopic:
+		// Show or change the current room's topic
+		s.setTopic(client, pkt.field(0))
+
+	case pkt.kind == msgHistory:
+		// Show more of the room's history than the scrollback sent on join
+		n, err := strconv.Atoi(pkt.field(0))
+		if err != nil || n <= 0 {
+			s.sendError(client, "Usage: /history <number of messages>")
+			return
+		}
+		s.sendEvent(client, s.historyEvent(client.room, min(n, historyKeep)))
+
+	case pkt.kind == msgPresence:
+		// Away, busy or back
+		s.setPresence(client, pkt.field(0), pkt.field(1), false)
+
+	case pkt.kind == msgStatus:
+		// Free text shown next to the name in /users
+		s.setStatus(client, pkt.field(0))
+
+	case pkt.kind == msgChat:
+		// Broadcast regular message to the sender's room, and log it
+		ev := s.newEvent(eventChat)
+		ev.Room, ev.Sender, ev.Role, ev.Text = client.room, client.name, client.role, pkt.field(0)
+		if !s.fits(client, ev) {
+			return
+		}
+		s.broadcast(ev)
+		if err := s.history.add(historyEntry{ID: ev.ID, Time: ev.Time, Room: ev.Room, Sender: ev.Sender, Role: ev.Role, Text: ev.Text}); err != nil {
+			log.Printf("History error: %v", err)
+		}
+
+	default: // Unknown type or missing privileges
+		s.sendError(client, "Invalid command. Type /help for available commands")
+	}
+}
+
+// sendText reliably sends a system notice to a client
+func (s *Server) sendText(c *Client, text string) {
+	s.sendSystem(c, "", text)
+}
+
+// sendSystem reliably sends a system notice that the client styles by reason
+func (s *Server) sendSystem(c *Client, reason, text string) {
+	ev := s.newEvent(eventSystem)
+	ev.Reason, ev.Text = reason, text
+	s.sendEvent(c, ev)
+}
+
+// sendError reliably sends an error to a client
+func (s *Server) sendError(c *Client, text string) {
+	ev := s.newEvent(eventError)
+	ev.Text = text
+	s.sendEvent(c, ev)
+}
+
+// sendReliable queues a packet on the client's reliable link, fragmenting it if needed
+func (s *Server) sendReliable(c *Client, pkt Packet) {
+	frags, err := s.frag.split(pkt)
+	if err != nil {
+		log.Printf("Error sending to %s: %v", c.name, err)
 		return
+	}
+	for _, f := range frags {
+		if _, err := c.link.send(f); err != nil {
+			log.Printf("Error sending to %s: %v", c.name, err)
+			return
+		}
+	}
+}
 
-	default: // Regular chat message or invalid command
-		if strings.HasPrefix(msg, "/") {
-			// Invalid command
-			conn.WriteToUDP([]byte("\033[31mInvalid command. Type /help for available commands\033[0m\n"), addr)
-		} else {
-			// Format and broadcast regular message
-			fullMsg := s.formatMessage(client, msg)
-			s.messages <- fullMsg
+// sendPacket encodes and sends an unsequenced packet to a single peer
+func (s *Server) sendPacket(peer Peer, pkt Packet) {
+	data, err := encodePacket(pkt)
+	if err != nil {
+		log.Printf("Encode error for %s: %v", peer.Addr(), err)
+		return
+	}
+	if err := peer.Send(data); err != nil {
+		log.Printf("Error sending to %s: %v", peer.Addr(), err)
+	}
+}
+
+// sendUnreliable seals and sends a packet outside the client's reliable link (caller holds s.mu)
+func (s *Server) sendUnreliable(c *Client, pkt Packet) {
+	data, err := encodePacket(pkt)
+	if err != nil {
+		log.Printf("Encode error for %s: %v", c.name, err)
+		return
+	}
+	sealed, err := c.channel.seal(data)
+	if err != nil {
+		log.Printf("Error sending to %s: %v", c.name, err)
+		return
+	}
+	if err := c.peer.Send(sealed); err != nil {
+		log.Printf("Error sending to %s: %v", c.name, err)
+	}
+}
+
+// outgoing is a queued event and who gets it
+type outgoing struct {
+	to *Client // nil: the members of ev.Room (everyone if it has none)
+	ev event
+}
+
+// outbatch is what one holder of s.mu queued, numbered in the order they held it
+type outbatch struct {
+	seq uint64
+	out []outgoing
+}
+
+// broadcast queues ev for the members of its room. Broadcasts and events for
+// single clients share one queue, so they arrive in the order they were queued.
+// It goes to the broadcaster once s.mu is released (see unlock): the broadcaster
+// needs the lock too, so sending while holding it would hang once the channel
+// is full (caller holds s.mu).
+func (s *Server) broadcast(ev event) {
+	s.outbox = append(s.outbox, outgoing{ev: ev})
+}
+
+// unlock releases s.mu, then passes the events queued meanwhile to the
+// broadcaster, numbered so that it sends them in the order they were queued
+// even if another holder of the lock gets to the channel first
+func (s *Server) unlock() {
+	queued := s.outbox
+	s.outbox = nil
+	if len(queued) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	s.outSeq++
+	b := outbatch{seq: s.outSeq, out: queued}
+	s.mu.Unlock()
+	s.messages <- b
+}
+
+// broadcastMessages sends the queued events, one batch after the other in the
+// order they were queued
+func (s *Server) broadcastMessages() {
+	early := make(map[uint64][]outgoing) // Batches whose predecessors are still on the way
+	next := s.delivered.Load() + 1
+	for b := range s.messages {
+		early[b.seq] = b.out
+		for out, ok := early[next]; ok; out, ok = early[next] {
+			delete(early, next)
+			s.sendBatch(out)
+			s.delivered.Store(next)
+			next++
 		}
 	}
 }
 
-// broadcastMessages sends messages to all connected clients
-func (s *Server) broadcastMessages(conn *net.UDPConn) {
-	for msg := range s.messages { // Read from messages channel
-		s.mu.RLock() // Read lock for clients map
-		// Send to all clients
+// sendBatch delivers a batch of queued events
+func (s *Server) sendBatch(out []outgoing) {
+	s.mu.RLock() // Read lock for clients map
+	defer s.mu.RUnlock()
+	for _, o := range out {
+		if o.to != nil {
+			s.deliver(o.to, o.ev)
+			continue
+		}
 		for _, client := range s.clients {
-			_, err := conn.WriteToUDP([]byte(msg+"\n"), client.addr)
-			if err != nil {
-				log.Printf("Error sending to %s: %v", client.name, err)
+			// Nothing leaks to sessions still at the password prompt
+			if client.authed && (o.ev.Room == "" || client.room == o.ev.Room) {
+				s.deliver(client, o.ev)
+			}
+		}
+	}
+}
+
+// retransmitLoop periodically resends unacknowledged packets to every client
+func (s *Server) retransmitLoop() {
+	ticker := time.NewTicker(retransmitTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown: // Stop on shutdown
+			return
+		case now := <-ticker.C:
+			s.retransmit(now)
+		}
+	}
+}
+
+// retransmit resends what clients have not acknowledged by now, dropping the
+// sessions whose links stalled
+func (s *Server) retransmit(now time.Time) {
+	s.mu.Lock()
+	defer s.unlock()
+	for key, client := range s.clients {
+		if n := client.link.retransmit(now); n > 0 {
+			// Everything sent after the lost packets would wait for them forever
+			log.Printf("Gave up delivering %d packet(s) to %s: dropping the session", n, client.name)
+			delete(s.clients, key)
+			if client.authed {
+				s.leaveRoom(client, leaveTimeout, "")
 			}
 		}
-		s.mu.RUnlock()
 	}
 }
 
-// cleanupClients periodically removes inactive clients
+// cleanupClients periodically removes clients that stopped sending heartbeats,
+// and sessions that never finished logging in. Idle readers stay: their
+// clients keep sending heartbeats.
 func (s *Server) cleanupClients() {
-	ticker := time.NewTicker(1 * time.Minute) // Check every minute
+	s.mu.RLock()
+	interval := s.heartbeat // Reloads may change it
+	s.mu.RUnlock()
+	ticker := time.NewTicker(interval) // Check once per heartbeat interval
 	defer ticker.Stop()
 
 	for {
@@ -319,44 +911,128 @@ func (s *Server) cleanupClients() {
 		case <-ticker.C: // Every tick
 			s.mu.Lock() // Acquire write lock
 			now := time.Now()
+			if interval != s.heartbeat { // Reloaded
+				interval = s.heartbeat
+				ticker.Reset(interval)
+			}
 			timedOutUsers := make([]string, 0)
 
-			// Find inactive clients (skip admins)
+			s.markIdle(now)
+			s.handshakes.prune(s.pendingLogin)
+
+			// Find clients that went quiet
 			for key, client := range s.clients {
-				if client.isAdmin {
+				if !client.authed && now.Sub(client.joinedAt) >= s.loginTimeout {
+					delete(s.clients, key) // Never answered the password challenge
 					continue
 				}
-
-				if now.Sub(client.lastSeen) >= 10*time.Minute {
+				if client.authed && now.Sub(client.lastHeard) >= client.heartbeat*time.Duration(s.heartbeatMisses) {
 					timedOutUsers = append(timedOutUsers, key)
 				}
 			}
 
-			// Remove inactive clients
+			// Remove them
 			for _, key := range timedOutUsers {
-				name := s.clients[key].name
+				client := s.clients[key]
 				delete(s.clients, key)
-				// Broadcast timeout notification
-				msg := fmt.Sprintf("\033[33m[%s] %s timed out (inactive for 10 minutes)\033[0m",
-					now.Format("3:04 PM"), name)
-				s.messages <- msg
-				log.Printf("User %s timed out due to inactivity", name)
+				// Broadcast timeout notification to the client's room
+				s.leaveRoom(client, leaveTimeout, "")
+				log.Printf("User %s timed out: no heartbeat for %v", client.name, now.Sub(client.lastHeard).Round(time.Second))
 			}
-			s.mu.Unlock()
+			s.unlock()
 		}
 	}
 }
 
-// startServer initializes and starts the chat server
-func startServer() {
+// startServer initializes and starts the chat server with the command line flags in args
+func startServer(args []string) {
+	cfg, err := parseServerConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Config error:\n%v", err)
+	}
+
 	s := newServer() // Create server instance
+	s.configure(cfg)
+	s.configArgs = args // Reloads read the same file and flags again
+	if err := s.openLog(cfg.LogFile); err != nil {
+		log.Fatal("Log file error:", err)
+	}
+
+	// Load registered accounts (create them with "go run . useradd <name>")
+	users, err := loadUserStore(defaultUserStore)
+	if err != nil {
+		log.Fatal("User store error:", err)
+	}
+	s.users = users
+
+	// Load role permissions (optional overrides in roles.json)
+	roles, err := loadRoles(defaultRolesFile)
+	if err != nil {
+		log.Fatal("Roles error:", err)
+	}
+	s.roles, s.rolesFile = roles, defaultRolesFile
+
+	// Load the identity key clients pin on first connect
+	identity, err := loadIdentity(defaultIdentityFile)
+	if err != nil {
+		log.Fatal("Server key error:", err)
+	}
+	s.identity = identity
+
+	// Load chat history for scrollback and keep appending to it
+	history, err := openHistory(defaultHistoryFile)
+	if err != nil {
+		log.Fatal("History error:", err)
+	}
+	s.history = history
+	log.Printf("Server key fingerprint: %s", fingerprint(identity.Public().(ed25519.PublicKey)))
 
-	// Shutdown on Enter key press
+	// Reread the config file, roles and accounts on SIGHUP. SIGINT (Ctrl+C)
+	// and SIGTERM count down to shutdown; a second one stops at once.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		fmt.Println("Press Enter to shutdown server...")
-		bufio.NewReader(os.Stdin).ReadString('\n')
-		close(s.shutdown) // Trigger shutdown
+		for sig := range signals {
+			s.mu.Lock()
+			if sig == syscall.SIGHUP {
+				s.reload("SIGHUP")
+			} else {
+				s.beginShutdown("signal " + sig.String())
+			}
+			s.unlock()
+		}
 	}()
+	fmt.Println("Press Ctrl+C to shut down the server...")
 
-	s.start(":8080") // Start server on port 8080
+	transports, err := listen(cfg.UDP, cfg.TCP) // UDP on :8080 unless told otherwise
+	if err != nil {
+		log.Fatal("Listen error:", err)
+	}
+	if cfg.WS != "" || cfg.IRC != "" {
+		// Browsers and IRC users join as in-process clients of the same server
+		mem := newMemTransport()
+		transports = append(transports, mem)
+		if cfg.WS != "" {
+			gw := newGateway(mem, defaultWebIdentities)
+			go func() {
+				log.Fatal("Web gateway error: ", http.ListenAndServe(cfg.WS, gw.handler()))
+			}()
+			log.Printf("Web chat on http://localhost%s/", cfg.WS)
+		}
+		if cfg.IRC != "" {
+			ln, err := net.Listen("tcp", cfg.IRC)
+			if err != nil {
+				log.Fatal("IRC listen error:", err)
+			}
+			go newIRCBridge(mem, defaultIRCIdentities).serve(ln)
+			log.Printf("IRC bridge on %s", cfg.IRC)
+		}
+	}
+	if err := s.start(transports); err != nil {
+		log.Fatal("Saving state failed: ", err) // Exit status 1 tells service managers
+	}
+	log.Println("Server stopped")
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/rand"  // For unguessable session tokens
+	"encoding/hex" // For printable client map keys
+	"log"          // For logging session migrations
+)
+
+// newSessionToken returns a random token identifying one client session
+func newSessionToken() []byte {
+	token := make([]byte, tokenSize)
+	rand.Read(token) // Never fails on supported platforms
+	return token
+}
+
+// sessionKey converts a session token into a Server.clients map key
+func sessionKey(token []byte) string {
+	return hex.EncodeToString(token)
+}
+
+// lookupSession finds the client that owns a sealed packet's session token and
+// returns the decrypted inner packet, migrating the session to peer when the
+// packet is the newest one received (caller holds s.mu). Forged, tampered and
+// replayed packets fail to open, so only the holder of the session keys can act
+// on the session or move it to another address.
+func (s *Server) lookupSession(peer Peer, pkt Packet) (*Client, string, Packet, bool) {
+	if pkt.kind != msgSealed {
+		if pkt.kind != msgAck { // Nothing useful to say about a stray ACK
+			s.sendPacket(peer, newPacket(msgError, "Unencrypted packets are not accepted. Please reconnect."))
+		}
+		return nil, "", Packet{}, false
+	}
+	if pkt.flags&flagSession == 0 {
+		s.sendPacket(peer, newPacket(msgError, "Missing session token. Please reconnect."))
+		return nil, "", Packet{}, false
+	}
+
+	key := sessionKey(pkt.token)
+	client, exists := s.clients[key]
+	if !exists {
+		s.sendPacket(peer, newPacket(msgError, "Unknown or expired session. Please reconnect."))
+		return nil, "", Packet{}, false
+	}
+
+	data, newest, err := client.channel.open(pkt)
+	if err != nil {
+		return nil, "", Packet{}, false // Silently ignore: answering would help probing
+	}
+	inner, err := decodePacket(data)
+	if err != nil || inner.kind == msgSealed || inner.kind == msgHello {
+		log.Printf("Dropped malformed sealed packet from %s: %v", client.name, err)
+		return nil, "", Packet{}, false
+	}
+
+	if !sameAddr(client.peer.Addr(), peer.Addr()) {
+		if !newest {
+			return nil, "", Packet{}, false // Delayed packet from an old address
+		}
+		log.Printf("Session of %s moved from %s to %s", client.name, client.peer.Addr(), peer.Addr())
+		client.peer = peer // May also switch transports, e.g. from UDP to TCP
+	}
+	return client, key, inner, true
+}
+
+// disconnect ends the sessions still bound to a closed connection, since
+// nothing sent to them can arrive any more
+func (s *Server) disconnect(peer Peer) {
+	s.mu.Lock()
+	defer s.unlock()
+	for key, c := range s.clients {
+		if !sameAddr(c.peer.Addr(), peer.Addr()) {
+			continue // Never connected here, or moved on to another connection
+		}
+		delete(s.clients, key)
+		if c.authed {
+			s.leaveRoom(c, leaveDisconnected, "")
+		}
+	}
+}
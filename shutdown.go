@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"  // For countdown notices
+	"log"  // For logging the shutdown
+	"time" // For the drain countdown
+)
+
+const (
+	defaultShutdownDrain = 10 * time.Second // Warning given before the server stops
+	flushTimeout         = time.Second      // Longest wait for queued events, and then for their ACKs, at shutdown
+)
+
+// shutdownNotices are the times left at which a draining server warns again
+var shutdownNotices = []time.Duration{5 * time.Minute, 2 * time.Minute, time.Minute, 30 * time.Second,
+	10 * time.Second, 5 * time.Second, 3 * time.Second, 2 * time.Second, time.Second}
+
+// beginShutdown refuses new logins and stops the server after s.shutdownDrain,
+// counting down to everyone meanwhile. Asking again during the countdown stops
+// it right away. by says who asked, for the log (caller holds s.mu).
+func (s *Server) beginShutdown(by string) {
+	if s.draining {
+		log.Printf("Shutdown requested again by %s: stopping now", by)
+		s.stop()
+		return
+	}
+	s.draining = true
+	log.Printf("Shutdown requested by %s: stopping in %v", by, s.shutdownDrain)
+	go s.countdown(s.shutdownDrain)
+}
+
+// countdown announces the coming shutdown at each of shutdownNotices, then stops the server
+func (s *Server) countdown(drain time.Duration) {
+	deadline := time.Now().Add(drain)
+	for left := drain; left > 0; left = time.Until(deadline) {
+		ev := s.newEvent(eventAnnouncement)
+		ev.Text = fmt.Sprintf("Server shutting down in %v. Clients reconnect once it is back.", left.Round(time.Second))
+		s.mu.Lock()
+		s.broadcast(ev)
+		s.unlock()
+
+		wait := left // Until the next notice, or the end
+		for _, at := range shutdownNotices {
+			if at < left { // Timers fire late, so not the notice just given
+				wait = left - at
+				break
+			}
+		}
+		select {
+		case <-s.shutdown: // Stopped early
+			return
+		case <-time.After(wait):
+		}
+	}
+	s.stop()
+}
+
+// stop triggers shutdown; it is safe to call more than once
+func (s *Server) stop() {
+	s.stopOnce.Do(func() { close(s.shutdown) })
+}
+
+// flush waits until the queued events have been sent, giving up after flushTimeout
+func (s *Server) flush() {
+	deadline := time.Now().Add(flushTimeout)
+	for time.Now().Before(deadline) {
+		s.mu.RLock()
+		queued := s.outSeq
+		s.mu.RUnlock()
+		if s.delivered.Load() >= queued {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// awaitAcks waits until every client has acknowledged what it was sent,
+// resending what goes missing, giving up after flushTimeout
+func (s *Server) awaitAcks() {
+	for deadline := time.Now().Add(flushTimeout); time.Now().Before(deadline); {
+		s.mu.RLock()
+		pending := 0
+		for _, client := range s.clients {
+			pending += client.link.pending()
+		}
+		s.mu.RUnlock()
+		if pending == 0 {
+			return
+		}
+		time.Sleep(retransmitTick)
+		s.retransmit(time.Now()) // The retransmit loop has stopped
+	}
+}
+
+// persist writes out what must survive a restart. Accounts and roles are
+// saved as they change, which leaves the chat history.
+func (s *Server) persist() error {
+	if err := s.history.close(); err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsWithCountdown(t *testing.T) {
+	s := newServer()
+	s.shutdownDrain = 1500 * time.Millisecond
+	mem := newMemTransport()
+	done := make(chan error)
+	go func() { done <- s.start([]Transport{mem}) }()
+
+	bob := mem.dial("bob")
+	bobChannel := testRegisterJSON(t, bob, "bob")
+	s.mu.Lock()
+	s.beginShutdown("test")
+	s.mu.Unlock()
+
+	if ev := waitForEvent(t, bob, bobChannel, eventAnnouncement); !strings.Contains(ev.Text, "in 2s") {
+		t.Errorf("first notice = %q, want 2s left", ev.Text)
+	}
+	for ev := waitForEvent(t, bob, bobChannel, eventAnnouncement); !strings.Contains(ev.Text, "in 1s"); {
+		ev = waitForEvent(t, bob, bobChannel, eventAnnouncement) // Unacknowledged notices come again
+	}
+
+	// Nobody new gets in while draining
+	carol := mem.dial("carol")
+	channel, err := clientHandshake(carol, "localhost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSend(t, carol, channel, Packet{kind: msgRegister, fields: [][]byte{[]byte("carol"), nil, nil, []byte(eventFormatJSON)}}, 1)
+	if ev := waitForEvent(t, carol, channel, eventError); !strings.Contains(ev.Text, "shutting down") {
+		t.Errorf("login while draining: %q", ev.Text)
+	}
+
+	if ev := waitForEvent(t, bob, bobChannel, eventError); ev.Text != "Server is shutting down. Goodbye!" {
+		t.Errorf("goodbye = %q", ev.Text)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("start: %v", err)
+		}
+	case <-time.After(2 * flushTimeout):
+		t.Fatal("server still running after the drain")
+	}
+}
+
+func TestSecondShutdownStopsAtOnce(t *testing.T) {
+	s := newServer()
+	s.shutdownDrain = time.Hour
+	s.mu.Lock()
+	s.beginShutdown("test")
+	s.beginShutdown("test")
+	s.mu.Unlock()
+	select {
+	case <-s.shutdown:
+	case <-time.After(time.Second):
+		t.Fatal("second shutdown request did not stop the server")
+	}
+}
+
+func TestTCPClientsGetTheGoodbye(t *testing.T) {
+	s := newServer()
+	tcp, err := listenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- s.start([]Transport{tcp}) }()
+
+	conn, err := net.Dial("tcp", tcp.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bob := newFramedConn(conn)
+	channel := testRegisterJSON(t, bob, "bob")
+	s.stop() // At once: the goodbye is the last thing queued before the connection closes
+
+	if ev := waitForEvent(t, bob, channel, eventError); ev.Text != "Server is shutting down. Goodbye!" {
+		t.Errorf("goodbye = %q", ev.Text)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("start: %v", err)
+		}
+	case <-time.After(2*flushTimeout + tcpCloseTimeout):
+		t.Fatal("server still running after shutdown")
+	}
+}
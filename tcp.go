@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/binary" // For frame lengths
+	"errors"          // For framing errors
+	"log"             // For logging connection errors
+	"net"             // For TCP connections
+	"sync"            // For serializing frame writes
+	"time"            // For write deadlines and notices
+)
+
+// Over TCP every packet travels as one frame: a 4-byte big-endian length
+// followed by exactly the bytes a UDP datagram would carry. Handshake,
+// sealing, sequencing and ACKs are unchanged, so both transports share the
+// same session code and client registry.
+const (
+	frameHeaderSize = 4
+	tcpWriteTimeout = 5 * time.Second // A client that takes longer to read a frame is disconnected
+	tcpSendQueue    = 256             // Frames waiting for a slow client before it is disconnected
+	tcpCloseTimeout = time.Second     // Longest wait on close for queued frames to be written
+)
+
+var (
+	errFrameTooLarge = errors.New("frame too large")
+	errSendBacklog   = errors.New("client is not reading: too many frames waiting")
+)
+
+// framedConn turns a stream into a datagram-like net.Conn: each Write sends
+// one frame and each Read returns one. A Read that times out mid-frame keeps
+// the partial frame, so read deadlines are as safe as on UDP.
+type framedConn struct {
+	net.Conn
+	wmu  sync.Mutex // One frame at a time
+	buf  []byte     // Received bytes not yet returned
+	rbuf []byte     // Scratch space for reads from the stream
+}
+
+// newFramedConn wraps a stream connection
+func newFramedConn(c net.Conn) *framedConn {
+	return &framedConn{Conn: c, rbuf: make([]byte, maxDatagramSize+frameHeaderSize)}
+}
+
+// Read returns the next frame, truncated to len(p) like a UDP read
+func (c *framedConn) Read(p []byte) (int, error) {
+	for {
+		if len(c.buf) >= frameHeaderSize {
+			size := int(binary.BigEndian.Uint32(c.buf))
+			if size > maxDatagramSize {
+				return 0, errFrameTooLarge // The stream is out of sync; give up on it
+			}
+			if end := frameHeaderSize + size; len(c.buf) >= end {
+				n := copy(p, c.buf[frameHeaderSize:end])
+				c.buf = append(c.buf[:0], c.buf[end:]...)
+				return n, nil
+			}
+		}
+		n, err := c.Conn.Read(c.rbuf)
+		c.buf = append(c.buf, c.rbuf[:n]...)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends p as one frame
+func (c *framedConn) Write(p []byte) (int, error) {
+	if len(p) > maxDatagramSize {
+		return 0, errFrameTooLarge
+	}
+	frame := make([]byte, frameHeaderSize+len(p))
+	binary.BigEndian.PutUint32(frame, uint32(len(p)))
+	copy(frame[frameHeaderSize:], p)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// received is a packet (or, with nil data, a disconnect) waiting for Receive
+type received struct {
+	data []byte
+	from Peer
+}
+
+// tcpTransport accepts TCP clients and merges the frames of all their
+// connections into one stream of packets
+type tcpTransport struct {
+	ln      net.Listener
+	packets chan received
+	done    chan struct{}
+	once    sync.Once
+
+	mu    sync.Mutex
+	conns map[*tcpPeer]struct{} // Open connections, closed on shutdown
+}
+
+// tcpPeer is one client connection. Frames are written by a goroutine of its
+// own, so a client that stops reading never holds up the server.
+type tcpPeer struct {
+	conn   *framedConn
+	addr   net.Addr
+	out    chan []byte   // Frames waiting to be written
+	closed chan struct{} // Closed with the connection
+	once   sync.Once
+}
+
+// newTCPPeer starts the writer of a new connection
+func newTCPPeer(conn net.Conn) *tcpPeer {
+	p := &tcpPeer{
+		conn:   newFramedConn(conn),
+		addr:   conn.RemoteAddr(),
+		out:    make(chan []byte, tcpSendQueue),
+		closed: make(chan struct{}),
+	}
+	go p.write()
+	return p
+}
+
+// listenTCP starts accepting TCP clients on port
+func listenTCP(port string) (*tcpTransport, error) {
+	ln, err := net.Listen("tcp", port)
+	if err != nil {
+		return nil, err
+	}
+	t := &tcpTransport{
+		ln:      ln,
+		packets: make(chan received, 64),
+		done:    make(chan struct{}),
+		conns:   make(map[*tcpPeer]struct{}),
+	}
+	go t.accept()
+	return t, nil
+}
+
+// accept starts a reader for every new connection until the listener closes
+func (t *tcpTransport) accept() {
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return // Shut down
+			}
+			log.Printf("Accept error: %v", err)
+			continue
+		}
+		p := newTCPPeer(conn)
+		t.mu.Lock()
+		t.conns[p] = struct{}{}
+		t.mu.Unlock()
+		go t.read(p)
+	}
+}
+
+// read queues the frames of one connection in order, then its disconnect
+func (t *tcpTransport) read(p *tcpPeer) {
+	defer func() {
+		t.mu.Lock()
+		delete(t.conns, p)
+		t.mu.Unlock()
+		p.close()
+	}()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			t.deliver(received{nil, p})
+			return
+		}
+		if !t.deliver(received{append([]byte(nil), buf[:n]...), p}) {
+			return
+		}
+	}
+}
+
+// deliver hands r to Receive, reporting false once the transport is closed
+func (t *tcpTransport) deliver(r received) bool {
+	select {
+	case t.packets <- r:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+// Receive returns the next frame from any connection
+func (t *tcpTransport) Receive() ([]byte, Peer, error) {
+	select {
+	case r := <-t.packets:
+		return r.data, r.from, nil
+	case <-t.done:
+		return nil, nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting and closes every open connection once the frames
+// queued for it are written (the goodbye, at shutdown)
+func (t *tcpTransport) Close() error {
+	t.once.Do(func() { close(t.done) })
+	err := t.ln.Close()
+	t.mu.Lock()
+	var wg sync.WaitGroup
+	for p := range t.conns {
+		wg.Add(1)
+		go func(p *tcpPeer) {
+			defer wg.Done()
+			p.closeWhenSent(tcpCloseTimeout)
+		}(p)
+	}
+	t.mu.Unlock() // Readers take it to leave t.conns as their connections close
+	wg.Wait()
+	return err
+}
+
+// Addr returns the client's end of the connection
+func (p *tcpPeer) Addr() net.Addr {
+	return p.addr
+}
+
+// Send queues one frame without waiting. A client too far behind is
+// disconnected, which its reader reports like any other disconnect.
+func (p *tcpPeer) Send(data []byte) error {
+	select {
+	case <-p.closed:
+		return net.ErrClosed
+	case p.out <- data:
+		return nil
+	default:
+		p.close()
+		return errSendBacklog
+	}
+}
+
+// write sends queued frames until the connection closes. A write that times
+// out may have sent part of a frame, so the connection is closed rather than
+// left out of sync.
+func (p *tcpPeer) write() {
+	for {
+		select {
+		case <-p.closed:
+			return
+		case data := <-p.out:
+			if data == nil { // Queued by closeWhenSent after the last frame
+				p.close()
+				return
+			}
+			p.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+			if _, err := p.conn.Write(data); err != nil {
+				p.close()
+				return
+			}
+		}
+	}
+}
+
+// closeWhenSent closes the connection once the frames queued so far are
+// written, or after timeout
+func (p *tcpPeer) closeWhenSent(timeout time.Duration) {
+	select {
+	case p.out <- nil:
+	default: // Too far behind to catch up
+		p.close()
+		return
+	}
+	select {
+	case <-p.closed:
+	case <-time.After(timeout):
+		p.close()
+	}
+}
+
+// close closes the connection and stops its writer; it is safe to call more than once
+func (p *tcpPeer) close() {
+	p.once.Do(func() {
+		close(p.closed)
+		p.conn.Close()
+	})
+}
+
+// dialServer connects to a chat server over UDP or, if useTCP is set, TCP.
+// Either way the connection reads and writes whole packets.
+func dialServer(serverAddr string, useTCP bool) (net.Conn, error) {
+	if useTCP {
+		conn, err := net.Dial("tcp", serverAddr)
+		if err != nil {
+			return nil, err
+		}
+		return newFramedConn(conn), nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialUDP("udp", nil, addr)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFramedConnSurvivesTimeoutMidFrame(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	reader := newFramedConn(b)
+
+	// First half of a frame, then nothing until the read deadline passes
+	frame := []byte{0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o', 0, 0, 0, 2, 'h', 'i'}
+	go a.Write(frame[:6])
+	reader.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, maxDatagramSize)
+	if _, err := reader.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read = %v, want a timeout", err)
+	}
+
+	go a.Write(frame[6:])
+	reader.SetReadDeadline(time.Time{})
+	for _, want := range []string{"hello", "hi"} {
+		n, err := reader.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("Read = %q, %v; want %q", buf[:n], err, want)
+		}
+	}
+}
+
+func TestFramedConnRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	writer, reader := newFramedConn(a), newFramedConn(b)
+
+	big := bytes.Repeat([]byte("x"), maxDatagramSize)
+	go func() {
+		writer.Write([]byte("first"))
+		writer.Write(big)
+	}()
+	buf := make([]byte, maxDatagramSize)
+	if n, err := reader.Read(buf); err != nil || string(buf[:n]) != "first" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+	if n, err := reader.Read(buf); err != nil || !bytes.Equal(buf[:n], big) {
+		t.Fatalf("Read returned %d bytes, %v; want %d", n, err, len(big))
+	}
+	if _, err := writer.Write(append(big, 'x')); !errors.Is(err, errFrameTooLarge) {
+		t.Errorf("oversized Write = %v, want errFrameTooLarge", err)
+	}
+}
+
+func TestDisconnectEndsOnlyThatConnectionsSessions(t *testing.T) {
+	s := newServer()
+	tcpAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	udpAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000} // Same host:port, other transport
+	alice, bob := testClient(s, "alice"), testClient(s, "bob")
+	alice.peer, bob.peer = &tcpPeer{addr: tcpAddr}, &udpPeer{addr: udpAddr}
+	s.enterRoom(alice, defaultRoom)
+	s.enterRoom(bob, defaultRoom)
+
+	s.disconnect(&tcpPeer{addr: tcpAddr})
+	if _, ok := s.clients[sessionKey(alice.token)]; ok {
+		t.Error("TCP session survived its connection closing")
+	}
+	if _, ok := s.clients[sessionKey(bob.token)]; !ok {
+		t.Error("UDP session with the same host:port was dropped")
+	}
+	if s.members(defaultRoom) != 1 {
+		t.Errorf("lobby has %d members, want 1", s.members(defaultRoom))
+	}
+}
+
+func TestTCPPeerDropsClientThatStopsReading(t *testing.T) {
+	a, b := net.Pipe() // Nobody reads b
+	defer b.Close()
+	p := newTCPPeer(a)
+
+	start := time.Now()
+	var err error
+	for i := 0; i < tcpSendQueue+2 && err == nil; i++ {
+		err = p.Send([]byte("frame"))
+	}
+	if !errors.Is(err, errSendBacklog) {
+		t.Fatalf("Send = %v, want errSendBacklog once the queue is full", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Send blocked for %v", time.Since(start))
+	}
+	if err := p.Send([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Send after overflow = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestTCPCloseWritesQueuedFrames(t *testing.T) {
+	a, b := net.Pipe() // Each write waits for the reader
+	defer b.Close()
+	p := newTCPPeer(a)
+	for i := 0; i < 5; i++ {
+		p.Send([]byte{byte(i)})
+	}
+	closed := make(chan struct{})
+	go func() {
+		p.closeWhenSent(tcpCloseTimeout)
+		close(closed)
+	}()
+
+	client := newFramedConn(b)
+	buf := make([]byte, maxDatagramSize)
+	for i := 0; i < 5; i++ {
+		time.Sleep(10 * time.Millisecond) // A slow reader
+		if n, err := client.Read(buf); err != nil || n != 1 || buf[0] != byte(i) {
+			t.Fatalf("frame %d: %v %v, want it before the connection closes", i, buf[:n], err)
+		}
+	}
+	<-closed
+	if _, err := client.Read(buf); err == nil {
+		t.Error("connection still open after its queued frames")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors" // For matching closed sockets
+	"log"    // For logging listeners
+	"net"    // For UDP sockets and addresses
+)
+
+// Transport delivers whole packets to the server from its peers. The server
+// neither knows nor cares whether they arrive as UDP datagrams, TCP frames or
+// (in tests) Go values; sessions, sealing and reliability sit on top.
+type Transport interface {
+	// Receive blocks until a packet arrives and returns it with its sender.
+	// The data belongs to the caller. A nil packet from a non-nil peer means
+	// the peer disconnected (stream transports only). After Close, Receive
+	// returns net.ErrClosed.
+	Receive() (data []byte, from Peer, err error)
+
+	// Close stops the transport and releases its sockets
+	Close() error
+}
+
+// Peer is one remote endpoint of a Transport
+type Peer interface {
+	// Addr identifies the peer; two peers are the same if sameAddr says so
+	Addr() net.Addr
+
+	// Send delivers one packet to the peer. Like UDP it may silently lose it;
+	// the reliable link retransmits what matters.
+	Send(data []byte) error
+}
+
+// sameAddr reports whether a and b are the same endpoint on the same transport
+func sameAddr(a, b net.Addr) bool {
+	return a.Network() == b.Network() && a.String() == b.String()
+}
+
+// listen opens a UDP transport on udpPort and a TCP transport on tcpPort ("" skips either)
+func listen(udpPort, tcpPort string) ([]Transport, error) {
+	var transports []Transport
+	if udpPort != "" {
+		t, err := listenUDP(udpPort)
+		if err != nil {
+			return nil, err
+		}
+		transports = append(transports, t)
+		log.Printf("Server started on %s (UDP)", udpPort)
+	}
+	if tcpPort != "" {
+		t, err := listenTCP(tcpPort)
+		if err != nil {
+			for _, open := range transports {
+				open.Close()
+			}
+			return nil, err
+		}
+		transports = append(transports, t)
+		log.Printf("Server started on %s (TCP)", tcpPort)
+	}
+	return transports, nil
+}
+
+// udpTransport receives datagrams on one UDP socket
+type udpTransport struct {
+	conn *net.UDPConn
+	buf  []byte // Large enough to never truncate a datagram
+}
+
+// udpPeer is a UDP client address, answered through the server's socket
+type udpPeer struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+}
+
+// listenUDP opens the UDP socket for port
+func listenUDP(port string) (*udpTransport, error) {
+	addr, err := net.ResolveUDPAddr("udp", port)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTransport{conn: conn, buf: make([]byte, maxDatagramSize)}, nil
+}
+
+// Receive reads the next datagram (not safe for concurrent use)
+func (t *udpTransport) Receive() ([]byte, Peer, error) {
+	for {
+		n, addr, err := t.conn.ReadFromUDP(t.buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil, nil, err
+			}
+			log.Printf("Read error: %v", err)
+			continue // e.g. ICMP unreachable from a vanished client
+		}
+		return append([]byte(nil), t.buf[:n]...), &udpPeer{conn: t.conn, addr: addr}, nil
+	}
+}
+
+// Close closes the socket, ending any blocked Receive
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
+
+// Addr returns the client's UDP address
+func (p *udpPeer) Addr() net.Addr {
+	return p.addr
+}
+
+// Send writes one datagram to the client
+func (p *udpPeer) Send(data []byte) error {
+	_, err := p.conn.WriteToUDP(data, p.addr)
+	return err
+}
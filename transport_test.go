@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSend seals pkt as a reliable packet numbered seq and sends it over conn
+func testSend(t *testing.T, conn net.Conn, channel *secureChannel, pkt Packet, seq uint32) {
+	conn.Write(testSeal(t, channel, pkt, seq))
+}
+
+// testSeal seals pkt as a reliable packet numbered seq, to be sent later
+func testSeal(t *testing.T, channel *secureChannel, pkt Packet, seq uint32) []byte {
+	pkt = pkt.withToken(channel.token)
+	pkt.flags |= flagReliable
+	pkt.seq = seq
+	data, _ := encodePacket(pkt)
+	sealed, err := channel.seal(data)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	return sealed
+}
+
+// waitForText reads text packets from conn until one contains want
+func waitForText(t *testing.T, conn net.Conn, channel *secureChannel, want string) {
+	buf := make([]byte, maxDatagramSize)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("no %q from server: %v", want, err)
+		}
+		outer, err := decodePacket(buf[:n])
+		if err != nil || outer.kind != msgSealed {
+			continue
+		}
+		inner, _, err := channel.open(outer)
+		if err != nil {
+			continue
+		}
+		if pkt, err := decodePacket(inner); err == nil && pkt.kind == msgText && strings.Contains(pkt.field(0), want) {
+			return
+		}
+	}
+}
+
+func TestMemTransportSession(t *testing.T) {
+	s := newServer()
+	mem := newMemTransport()
+	done := make(chan struct{})
+	go func() {
+		s.start([]Transport{mem})
+		close(done)
+	}()
+
+	alice, bob := mem.dial("alice"), mem.dial("bob")
+	aliceChannel := testRegister(t, alice, "alice")
+	bobChannel := testRegister(t, bob, "bob")
+
+	testSend(t, alice, aliceChannel, newPacket(msgChat, "hello over channels"), 2)
+	waitForText(t, bob, bobChannel, "hello over channels")
+
+	alice.Close() // Seen by the server as a dropped connection
+	waitForText(t, bob, bobChannel, "alice left the chat (connection closed)")
+
+	close(s.shutdown)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	if _, err := bob.Write([]byte("late")); err == nil {
+		t.Error("write after shutdown succeeded")
+	}
+}
+
+func TestSessionMovesOnlyForItsNewestPacket(t *testing.T) {
+	s := newServer()
+	mem := newMemTransport()
+	go s.start([]Transport{mem})
+	defer close(s.shutdown)
+
+	bob := mem.dial("bob")
+	bobChannel := testRegister(t, bob, "bob")
+	home := mem.dial("home")
+	channel := testRegister(t, home, "alice")
+	alice := func() (addr string, opened uint64) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		c := s.findClient("alice")
+		c.channel.mu.Lock()
+		defer c.channel.mu.Unlock()
+		return c.peer.Addr().String(), c.channel.recvSeen
+	}
+
+	// Sealed in this order, so the second is the newer one
+	delayed := testSeal(t, channel, newPacket(msgChat, "stuck in the old network"), 3)
+	roamed := testSeal(t, channel, newPacket(msgChat, "sent from the train"), 2)
+
+	train := mem.dial("train")
+	train.Write(roamed)
+	waitForText(t, bob, bobChannel, "sent from the train")
+	if addr, _ := alice(); addr != "train" {
+		t.Fatalf("session at %q after its newest packet came from train", addr)
+	}
+
+	// The older packet turns up late from the old address: it opens (so it is
+	// authentic), but neither moves the session back nor gets handled
+	home.Write(delayed)
+	deadline := time.Now().Add(2 * time.Second)
+	for _, seen := alice(); seen&2 == 0; _, seen = alice() {
+		if time.Now().After(deadline) {
+			t.Fatal("delayed packet never arrived")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if addr, _ := alice(); addr != "train" {
+		t.Errorf("delayed packet moved the session back to %q", addr)
+	}
+	testSend(t, train, channel, newPacket(msgChat, "seq 3 is still free"), 3)
+	waitForText(t, bob, bobChannel, "seq 3 is still free")
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"        // For reading keys
+	"fmt"          // For drawing
+	"io"           // For the terminal output
+	"os"           // For the terminal
+	"os/exec"      // For stty
+	"slices"       // For sorting the user list and typists
+	"strings"      // For building the screen
+	"sync"         // For guarding the screen state
+	"time"         // For typing indicators and the refresh tick
+	"unicode"      // For character widths and control keys
+	"unicode/utf8" // For walking lines by character
+)
+
+const (
+	tuiScrollback   = 2000            // Lines kept in the message pane
+	tuiSidebarWidth = 22              // Columns of the user list, separator included
+	tuiMinPaneWidth = 30              // Narrower terminals get no user list
+	tuiRefresh      = time.Second     // Status bar refresh and resize check
+	tuiTypingShown  = 5 * time.Second // How long "x is typing" stays in the status bar
+	tuiTypingEvery  = 3 * time.Second // Min gap between our own typing indicators
+)
+
+// tuiStatus is what the status bar shows about the connection
+type tuiStatus struct {
+	state   string        // e.g. "connected"
+	latency time.Duration // Round trip time, 0 if unknown
+	pending int           // Sent packets not yet acknowledged
+}
+
+// tui is the full-screen client: a scrollable message pane, a user list, a
+// status bar and an input line that incoming messages never overwrite. It
+// draws with ANSI sequences on the alternate screen and puts the terminal in
+// raw mode with stty.
+type tui struct {
+	mu     sync.Mutex
+	out    io.Writer
+	in     *bufio.Reader
+	theme  theme
+	saved  string // stty settings restored on close
+	width  int
+	height int
+
+	lines  []string   // Message pane, oldest first, unwrapped
+	scroll int        // Rows scrolled back from the bottom
+	name   string     // Our username
+	room   string     // Current room
+	users  []userInfo // Everyone online, from the last user list
+	typing map[string]time.Time
+	status func() tuiStatus
+
+	ed         *lineEditor // The input line
+	onTyping   func()      // Called as the user starts typing a message
+	lastTyping time.Time   // When onTyping was last called
+
+	done chan struct{}
+}
+
+// startTUI switches the terminal to the full-screen interface
+func startTUI(t theme, name string, ed *lineEditor, status func() tuiStatus) (*tui, error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("terminal settings: %w", err)
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, fmt.Errorf("raw mode: %w", err)
+	}
+	u := &tui{
+		out:    os.Stdout,
+		in:     bufio.NewReader(os.Stdin),
+		theme:  t,
+		saved:  saved,
+		name:   name,
+		ed:     ed,
+		typing: make(map[string]time.Time),
+		status: status,
+		done:   make(chan struct{}),
+	}
+	fmt.Fprint(u.out, "\033[?1049h") // Alternate screen, so the shell's is back on exit
+	u.mu.Lock()
+	u.resize()
+	u.draw()
+	u.mu.Unlock()
+	go u.refresh()
+	return u, nil
+}
+
+// close restores the terminal
+func (u *tui) close() {
+	close(u.done)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	fmt.Fprint(u.out, "\033[0m\033[?25h\033[?1049l")
+	stty(u.saved)
+}
+
+// stty runs stty on the terminal and returns what it printed
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// refresh redraws every tick, so latency stays current, typing indicators
+// expire and a resized terminal is noticed
+func (u *tui) refresh() {
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-ticker.C:
+			u.mu.Lock()
+			u.resize()
+			u.draw()
+			u.mu.Unlock()
+		}
+	}
+}
+
+// resize reads the terminal size (caller holds u.mu)
+func (u *tui) resize() {
+	u.height, u.width = terminalSize()
+}
+
+// print adds text to the message pane, one line per line of text
+func (u *tui) print(text string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		if u.scroll > 0 { // Keep what the user scrolled back to in place
+			u.scroll += len(wrap(line, u.paneWidth()))
+		}
+		u.lines = append(u.lines, line)
+	}
+	if len(u.lines) > tuiScrollback {
+		u.lines = append([]string(nil), u.lines[len(u.lines)-tuiScrollback:]...)
+	}
+	u.draw()
+}
+
+// Write lets the log package print into the message pane
+func (u *tui) Write(p []byte) (int, error) {
+	u.print(string(p))
+	return len(p), nil
+}
+
+// setRoom changes the room shown in the status bar and user list
+func (u *tui) setRoom(room string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.room = room
+	u.draw()
+}
+
+// renamed follows a rename, in case it was ours
+func (u *tui) renamed(from, to string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.name == from {
+		u.name = to
+		u.draw()
+	}
+}
+
+// setUsers replaces the user list
+func (u *tui) setUsers(users []userInfo) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.users = slices.SortedFunc(slices.Values(users), func(a, b userInfo) int { return strings.Compare(a.Name, b.Name) })
+	u.draw()
+}
+
+// typingFrom shows that name is typing for a few seconds
+func (u *tui) typingFrom(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if name == u.name {
+		return // The server tells the whole room, us included
+	}
+	u.typing[name] = time.Now().Add(tuiTypingShown)
+	u.draw()
+}
+
+// paneWidth is the width of the message pane (caller holds u.mu)
+func (u *tui) paneWidth() int {
+	if u.width-tuiSidebarWidth < tuiMinPaneWidth {
+		return u.width
+	}
+	return u.width - tuiSidebarWidth
+}
+
+// draw repaints the whole screen (caller holds u.mu)
+func (u *tui) draw() {
+	paneW, rows := u.paneWidth(), u.height-2
+	var b strings.Builder
+	b.WriteString("\033[?25l") // Hide the cursor while drawing
+
+	// Message pane: wrap lines from the bottom up until the screen is full
+	need := rows + u.scroll
+	var visual []string
+	for i := len(u.lines) - 1; i >= 0 && len(visual) < need; i-- {
+		visual = append(wrap(u.lines[i], paneW), visual...)
+	}
+	u.scroll = max(0, min(u.scroll, len(visual)-rows))
+	shown := visual[max(0, len(visual)-u.scroll-rows) : len(visual)-u.scroll]
+
+	sidebar := u.sidebar()
+	for row := 0; row < rows; row++ {
+		fmt.Fprintf(&b, "\033[%d;1H", row+1)
+		line := ""
+		if row < len(shown) {
+			line = shown[row]
+		}
+		b.WriteString(pad(line, paneW) + "\033[0m")
+		if paneW < u.width {
+			entry := ""
+			if row < len(sidebar) {
+				entry = sidebar[row]
+			}
+			b.WriteString(paint(u.theme.dim, "│") + pad(entry, tuiSidebarWidth-1) + "\033[0m")
+		}
+	}
+
+	fmt.Fprintf(&b, "\033[%d;1H\033[7m%s\033[0m", rows+1, pad(u.statusLine(), u.width))
+
+	// Input line, scrolled sideways to keep the cursor in view
+	prompt := "› "
+	avail := u.width - textWidth(prompt)
+	visible, col := u.ed.window(avail)
+	fmt.Fprintf(&b, "\033[%d;1H%s%s", rows+2, paint(u.theme.prompt, prompt), pad(visible, avail))
+	fmt.Fprintf(&b, "\033[%d;%dH\033[?25h", rows+2, 1+textWidth(prompt)+col)
+	io.WriteString(u.out, b.String())
+}
+
+// sidebar lists the people in our room (caller holds u.mu)
+func (u *tui) sidebar() []string {
+	var here []string
+	elsewhere := 0
+	for _, p := range u.users {
+		if p.Room != u.room {
+			elsewhere++
+			continue
+		}
+		name := p.Name
+		switch p.Role {
+		case roleOwner:
+			name = u.theme.owner + name
+		case roleModerator:
+			name = u.theme.moderator + name
+		}
+		if p.Muted {
+			name += paint(u.theme.dim, " (muted)")
+		}
+		if p.Presence == presenceAway || p.Presence == presenceBusy {
+			name += paint(u.theme.dim, " ("+p.Presence+")")
+		}
+		here = append(here, " "+name)
+	}
+	entries := []string{paint(u.theme.header, fmt.Sprintf(" #%s (%d)", u.room, len(here)))}
+	entries = append(entries, here...)
+	if elsewhere > 0 {
+		entries = append(entries, paint(u.theme.dim, fmt.Sprintf(" +%d in other rooms", elsewhere)))
+	}
+	return entries
+}
+
+// statusLine describes the connection, who is typing and the scroll position (caller holds u.mu)
+func (u *tui) statusLine() string {
+	parts := []string{u.name}
+	if u.room != "" {
+		parts = append(parts, "#"+u.room)
+	}
+	st := u.status()
+	conn := st.state
+	switch {
+	case st.latency >= time.Millisecond:
+		conn += fmt.Sprintf(" %dms", st.latency.Milliseconds())
+	case st.latency > 0:
+		conn += " <1ms"
+	}
+	if st.pending > 0 {
+		conn += fmt.Sprintf(", sending %d", st.pending)
+	}
+	parts = append(parts, conn)
+
+	now := time.Now()
+	var typers []string
+	for name, until := range u.typing {
+		if now.After(until) {
+			delete(u.typing, name)
+			continue
+		}
+		typers = append(typers, name)
+	}
+	if len(typers) > 0 {
+		slices.Sort(typers)
+		parts = append(parts, strings.Join(typers, ", ")+" typing…")
+	}
+	if u.scroll > 0 {
+		parts = append(parts, fmt.Sprintf("↑ %d more (PgDn)", u.scroll))
+	}
+	return " " + strings.Join(parts, " │ ")
+}
+
+// readLine edits the input line until Enter and returns it. It returns false
+// when the user quits with Ctrl-C, with Ctrl-D on an empty line or input ends.
+func (u *tui) readLine() (string, bool) {
+	for {
+		k, err := readKey(u.in)
+		if err != nil {
+			return "", false
+		}
+		u.mu.Lock()
+		line, submit, quit := u.key(k)
+		input := u.ed.input
+		typing := u.onTyping != nil && len(input) > 0 && input[0] != '/' && time.Since(u.lastTyping) > tuiTypingEvery
+		if typing {
+			u.lastTyping = time.Now()
+		}
+		u.draw()
+		u.mu.Unlock()
+		switch {
+		case quit:
+			return "", false
+		case submit:
+			return line, true
+		case typing:
+			u.onTyping() // Outside the lock: it sends a packet
+		}
+	}
+}
+
+// key applies one key: scrolling keys move the message pane, the rest edit
+// the input line (caller holds u.mu)
+func (u *tui) key(k string) (line string, submit, quit bool) {
+	switch k {
+	case keyPageUp:
+		u.scroll += max(1, (u.height-2)/2)
+	case keyPageDown:
+		u.scroll = max(0, u.scroll-max(1, (u.height-2)/2))
+	case keyRedraw:
+		fmt.Fprint(u.out, "\033[2J")
+	default:
+		line, submit, quit = u.ed.key(k)
+		if submit {
+			u.scroll = 0 // Back to the bottom to see it
+			u.lastTyping = time.Time{}
+		}
+	}
+	return line, submit, quit
+}
+
+// wrap splits a line into rows of at most width columns. Colors carry over
+// to the next row; other escape sequences and control characters, which
+// would move the cursor, are dropped.
+func wrap(line string, width int) []string {
+	var rows []string
+	var row strings.Builder
+	cols, color := 0, ""
+	for i := 0; i < len(line); {
+		if line[i] == '\033' {
+			if loc := ansiEscape.FindStringIndex(line[i:]); loc != nil && loc[0] == 0 {
+				if seq := line[i : i+loc[1]]; strings.HasSuffix(seq, "m") {
+					row.WriteString(seq)
+					color = seq
+					if seq == "\033[0m" || seq == "\033[m" {
+						color = ""
+					}
+				}
+				i += loc[1]
+				continue
+			}
+		}
+		r, size := utf8.DecodeRuneInString(line[i:])
+		i += size
+		if r == '\t' {
+			r = ' '
+		}
+		if unicode.IsControl(r) {
+			continue
+		}
+		w := runeWidth(r)
+		if cols+w > width && cols > 0 {
+			rows = append(rows, row.String())
+			row.Reset()
+			row.WriteString(color)
+			cols = 0
+		}
+		row.WriteRune(r)
+		cols += w
+	}
+	return append(rows, row.String())
+}
+
+// pad cuts s to width columns, or fills it up with spaces
+func pad(s string, width int) string {
+	s = wrap(s, width)[0]
+	return s + strings.Repeat(" ", max(0, width-textWidth(s)))
+}
+
+// textWidth is the number of columns s takes up on screen
+func textWidth(s string) int {
+	n := 0
+	for _, r := range ansiEscape.ReplaceAllString(s, "") {
+		n += runeWidth(r)
+	}
+	return n
+}
+
+// runeWidth is the number of columns r takes up: 2 for East Asian wide
+// characters and most emoji, 0 for combining marks
+func runeWidth(r rune) int {
+	switch {
+	case unicode.Is(unicode.Mn, r), r == 0x200d, r >= 0xfe00 && r <= 0xfe0f:
+		return 0
+	case r >= 0x1100 && r <= 0x115f, r >= 0x2e80 && r <= 0xa4cf, r >= 0xac00 && r <= 0xd7a3,
+		r >= 0xf900 && r <= 0xfaff, r >= 0xfe30 && r <= 0xfe4f, r >= 0xff00 && r <= 0xff60,
+		r >= 0xffe0 && r <= 0xffe6, r >= 0x1f300 && r <= 0x1f64f, r >= 0x1f900 && r <= 0x1f9ff,
+		r >= 0x20000 && r <= 0x3fffd:
+		return 2
+	}
+	return 1
+}
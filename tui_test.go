@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTUI returns a screen of the given size that draws into a buffer
+func newTestTUI(width, height int, keys string) (*tui, *strings.Builder) {
+	var screen strings.Builder
+	return &tui{
+		out:    &screen,
+		in:     bufio.NewReader(strings.NewReader(keys)),
+		theme:  themes["none"],
+		width:  width,
+		height: height,
+		name:   "alice",
+		room:   "lobby",
+		ed:     newLineEditor("", nil),
+		typing: make(map[string]time.Time),
+		status: func() tuiStatus { return tuiStatus{state: "connected", latency: 42 * time.Millisecond} },
+		done:   make(chan struct{}),
+	}, &screen
+}
+
+func TestWrap(t *testing.T) {
+	rows := wrap("\033[31mabcdef\033[0m\033[2Jgh", 4)
+	if len(rows) != 2 || rows[0] != "\033[31mabcd" || rows[1] != "\033[31mef\033[0mgh" {
+		t.Errorf("rows = %q, want the color carried over and the screen clear dropped", rows)
+	}
+	if got := pad("日本語", 5); got != "日本 " {
+		t.Errorf("pad = %q, want wide characters counted twice", got)
+	}
+}
+
+func TestTUIReadLine(t *testing.T) {
+	typed := 0
+	u, _ := newTestTUI(60, 10, "hi\033[D!\x7f\x7f\x01>\rmore\x15bye\r\x03")
+	u.onTyping = func() { typed++ }
+	if line, ok := u.readLine(); !ok || line != ">i" {
+		t.Errorf("first line = %q, %v; want \">i\"", line, ok)
+	}
+	if line, ok := u.readLine(); !ok || line != "bye" {
+		t.Errorf("second line = %q, %v; want \"bye\" after Ctrl-U", line, ok)
+	}
+	if _, ok := u.readLine(); ok {
+		t.Error("Ctrl-C did not quit")
+	}
+	if typed != 2 {
+		t.Errorf("sent %d typing indicators, want one per message", typed)
+	}
+}
+
+func TestTUIDraw(t *testing.T) {
+	u, screen := newTestTUI(60, 6, "")
+	u.setUsers([]userInfo{{Name: "bob", Room: "lobby"}, {Name: "alice", Room: "lobby", Role: roleOwner}, {Name: "carol", Room: "games"}})
+	u.typingFrom("bob")
+	u.typingFrom("alice") // The server echoes our own
+	for i := 1; i <= 6; i++ {
+		u.print("line " + string(rune('0'+i)))
+	}
+	screen.Reset()
+	u.mu.Lock()
+	u.draw()
+	u.mu.Unlock()
+	out := screen.String()
+	for _, want := range []string{"line 6", "#lobby (2)", "~alice", "+1 in other rooms", "alice │ #lobby │ connected 42ms │ bob typing…"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("screen lacks %q:\n%q", want, out)
+		}
+	}
+	if strings.Contains(out, "line 2") { // 4 rows for messages
+		t.Error("screen shows a line that should have scrolled off")
+	}
+
+	u.key(keyPageUp)
+	screen.Reset()
+	u.print("line 7") // Scrolled back: the view stays put
+	if out := screen.String(); !strings.Contains(out, "line 1") || strings.Contains(out, "line 7") || !strings.Contains(out, "↑ 3 more") {
+		t.Errorf("scrolled screen = %q", out)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"           // For buffered frame reads
+	"crypto/sha1"     // For the handshake accept key (required by RFC 6455)
+	"encoding/base64" // For the handshake accept key
+	"encoding/binary" // For frame lengths
+	"errors"          // For protocol errors
+	"io"              // For reading frames
+	"net"             // For the hijacked connection
+	"net/http"        // For the upgrade request
+	"strings"         // For header checks
+	"sync"            // For serializing writes
+	"time"            // For write deadlines
+)
+
+// A minimal server side of RFC 6455: text messages (possibly fragmented),
+// ping/pong and close. No extensions or subprotocols.
+const (
+	wsGUID         = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" // Fixed by the RFC
+	wsMaxMessage   = 64 * 1024                              // Longest message accepted from a browser
+	wsWriteTimeout = 5 * time.Second
+
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+var (
+	errNotWebSocket     = errors.New("not a websocket upgrade request")
+	errWSProtocol       = errors.New("websocket protocol error")
+	errWSMessageTooLong = errors.New("websocket message too long")
+)
+
+// wsConn is an upgraded WebSocket connection
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	wmu  sync.Mutex // One frame at a time
+}
+
+// wsAccept computes the Sec-WebSocket-Accept value for a client key
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerContains reports whether a comma-separated header has token (case-insensitive)
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket completes the opening handshake and takes over the connection
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return nil, errNotWebSocket
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errNotWebSocket
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "upgrade not supported", http.StatusInternalServerError)
+		return nil, errNotWebSocket
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// readFrame reads one frame and unmasks its payload
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+	fin, opcode = head[0]&0x80 != 0, head[0]&0x0F
+	if head[0]&0x70 != 0 || head[1]&0x80 == 0 { // No extensions; browsers must mask
+		return false, 0, nil, errWSProtocol
+	}
+	size := uint64(head[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > wsMaxMessage {
+		return false, 0, nil, errWSMessageTooLong
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// ReadMessage returns the next text message, answering pings on the way.
+// It returns io.EOF when the browser closes the connection.
+func (c *wsConn) ReadMessage() (string, error) {
+	var msg []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return "", err
+		}
+		switch opcode {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeFrame(wsClose, nil)
+			return "", io.EOF
+		case wsText, wsBinary:
+			if started {
+				return "", errWSProtocol // New message inside a fragmented one
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return "", errWSProtocol
+			}
+		default:
+			return "", errWSProtocol
+		}
+		if len(msg)+len(payload) > wsMaxMessage {
+			return "", errWSMessageTooLong
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return string(msg), nil
+		}
+	}
+}
+
+// WriteText sends one unfragmented text message
+func (c *wsConn) WriteText(text string) error {
+	return c.writeFrame(wsText, []byte(text))
+}
+
+// writeFrame sends one unmasked frame (servers never mask)
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	head := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		head[1] = byte(n)
+	case n <= 0xFFFF:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := c.conn.Write(append(head, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close sends a close frame and closes the connection
+func (c *wsConn) Close() error {
+	c.writeFrame(wsClose, nil)
+	return c.conn.Close()
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/ecdh"    // For per-message key agreement
+	"crypto/ed25519" // For signing whispers
+	"crypto/hkdf"    // For deriving keys from seeds and shared secrets
+	"crypto/rand"    // For seeds and ephemeral keys
+	"crypto/sha256"  // Hash for HKDF
+	"encoding/hex"   // For the identity file
+	"encoding/json"  // For the identity and contact files
+	"errors"         // For whisper errors
+	"fmt"            // For error details
+	"os"             // For key files
+	"path/filepath"  // For key file locations
+	"sync"           // For guarding the contact pins
+	"time"           // For expiring queued whispers
+)
+
+// Whispers are end-to-end encrypted: each user has a long-term key pair published
+// at registration, and the server only relays envelopes it cannot open:
+//
+//	envelope = ephemeral X25519 key (32 B) | ed25519 signature (64 B) | AES-256-GCM ciphertext
+//
+// The sender agrees a one-off key between a fresh ephemeral key and the
+// recipient's X25519 key, and signs the ephemeral key and ciphertext (bound to
+// the recipient's key) with its ed25519 key so the recipient knows who wrote it.
+const (
+	whisperHeaderSize = x25519KeySize + ed25519.SignatureSize
+	identitiesFile    = "identities.json"  // Whisper key seeds by username
+	knownUsersFile    = "known_users.json" // Pinned whisper keys of other users
+	whisperKeyWait    = 30 * time.Second   // Queued whispers are dropped if their key takes longer
+)
+
+var (
+	errBadWhisper        = errors.New("malformed whisper")
+	errWhisperForged     = errors.New("whisper signature does not match the sender's key")
+	errWhisperUnreadable = errors.New("whisper could not be decrypted")
+)
+
+// userKeys is a user's long-term whisper identity, derived from a single seed
+type userKeys struct {
+	sign ed25519.PrivateKey // Signs outgoing whispers
+	enc  *ecdh.PrivateKey   // Receives incoming whispers
+}
+
+// newUserKeys derives both key pairs from seed
+func newUserKeys(seed []byte) (*userKeys, error) {
+	encSeed, err := hkdf.Key(sha256.New, seed, nil, "gochat whisper x25519", x25519KeySize)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := ecdh.X25519().NewPrivateKey(encSeed)
+	if err != nil {
+		return nil, err
+	}
+	return &userKeys{sign: ed25519.NewKeyFromSeed(seed), enc: enc}, nil
+}
+
+// encPublic is the key others encrypt whispers to
+func (k *userKeys) encPublic() []byte {
+	return k.enc.PublicKey().Bytes()
+}
+
+// signPublic is the key others verify our whispers with
+func (k *userKeys) signPublic() ed25519.PublicKey {
+	return k.sign.Public().(ed25519.PublicKey)
+}
+
+// publish is the msgKeys packet that hands our public keys to the server
+func (k *userKeys) publish() Packet {
+	return Packet{kind: msgKeys, fields: [][]byte{k.encPublic(), k.signPublic()}}
+}
+
+// sessionKeys returns the whisper keys a bridge uses for name: those stored at
+// path once name has logged in to its account, and fresh, unsaved ones for a
+// guest, so that typing a name is not enough to sign with its stored key
+func sessionKeys(path, name string, authed bool) (*userKeys, error) {
+	if authed {
+		return loadUserKeys(path, name)
+	}
+	seed := make([]byte, ed25519.SeedSize)
+	rand.Read(seed)
+	return newUserKeys(seed)
+}
+
+// loadUserKeys returns name's whisper keys from the identity file at path,
+// creating and saving a new seed the first time name is used
+func loadUserKeys(path, name string) (*userKeys, error) {
+	seeds, err := readJSONMap(path)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := seeds[name]; ok {
+		seed, err := hex.DecodeString(s)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s: bad seed for %s", path, name)
+		}
+		return newUserKeys(seed)
+	}
+
+	seed := make([]byte, ed25519.SeedSize)
+	rand.Read(seed)
+	seeds[name] = hex.EncodeToString(seed)
+	if err := writeJSONMap(path, seeds); err != nil {
+		return nil, err
+	}
+	return newUserKeys(seed)
+}
+
+// whisperKey derives the one-off key for a whisper
+func whisperKey(shared, ephPub, toEnc []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, shared, nil, "gochat whisper"+string(ephPub)+string(toEnc), 32)
+}
+
+// whisperSigned is the data a whisper's signature covers
+func whisperSigned(toEnc, ephPub, ciphertext []byte) []byte {
+	d := []byte("gochat whisper")
+	d = append(d, toEnc...)
+	d = append(d, ephPub...)
+	return append(d, ciphertext...)
+}
+
+// sealWhisper encrypts text to the recipient's X25519 key and signs it with from's key
+func sealWhisper(from *userKeys, toEnc []byte, text string) ([]byte, error) {
+	to, err := ecdh.X25519().NewPublicKey(toEnc)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(to)
+	if err != nil {
+		return nil, err
+	}
+	ephPub := eph.PublicKey().Bytes()
+	key, err := whisperKey(shared, ephPub, toEnc)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	// The key is used for this message only, so a zero nonce is safe
+	ciphertext := aead.Seal(nil, make([]byte, aead.NonceSize()), []byte(text), ephPub)
+
+	envelope := append([]byte(nil), ephPub...)
+	envelope = append(envelope, ed25519.Sign(from.sign, whisperSigned(toEnc, ephPub, ciphertext))...)
+	return append(envelope, ciphertext...), nil
+}
+
+// openWhisper verifies a whisper against the sender's signing key and decrypts it
+func openWhisper(to *userKeys, fromSign ed25519.PublicKey, envelope []byte) (string, error) {
+	if len(envelope) < whisperHeaderSize || len(fromSign) != ed25519.PublicKeySize {
+		return "", errBadWhisper
+	}
+	ephPub := envelope[:x25519KeySize]
+	sig := envelope[x25519KeySize:whisperHeaderSize]
+	ciphertext := envelope[whisperHeaderSize:]
+	if !ed25519.Verify(fromSign, whisperSigned(to.encPublic(), ephPub, ciphertext), sig) {
+		return "", errWhisperForged
+	}
+
+	eph, err := ecdh.X25519().NewPublicKey(ephPub)
+	if err != nil {
+		return "", errBadWhisper
+	}
+	shared, err := to.enc.ECDH(eph)
+	if err != nil {
+		return "", errBadWhisper
+	}
+	key, err := whisperKey(shared, ephPub, to.encPublic())
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	text, err := aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext, ephPub)
+	if err != nil {
+		return "", errWhisperUnreadable
+	}
+	return string(text), nil
+}
+
+// whisperer is the client side of encrypted whispers: it holds outgoing
+// whispers until the recipient's key arrives and opens incoming ones
+type whisperer struct {
+	keys     *userKeys
+	contacts *knownUsers
+
+	mu      sync.Mutex
+	pending map[string][]queuedWhisper // Whispers waiting for the recipient's key, by recipient
+}
+
+// queuedWhisper is a whisper waiting for its recipient's key
+type queuedWhisper struct {
+	text string
+	at   time.Time // When it was queued
+}
+
+// newWhisperer creates a whisperer for our keys and contact pins
+func newWhisperer(keys *userKeys, contacts *knownUsers) *whisperer {
+	return &whisperer{keys: keys, contacts: contacts, pending: make(map[string][]queuedWhisper)}
+}
+
+// queue holds text for target and returns the key request to send for it
+func (w *whisperer) queue(target, text string) Packet {
+	now := time.Now()
+	w.mu.Lock()
+	for name, queued := range w.pending {
+		if now.Sub(queued[len(queued)-1].at) >= whisperKeyWait {
+			delete(w.pending, name) // Never answered: don't hand them to a later namesake
+		}
+	}
+	w.pending[target] = append(w.pending[target], queuedWhisper{text: text, at: now})
+	w.mu.Unlock()
+	return newPacket(msgKeyRequest, target)
+}
+
+// keyArrived encrypts the whispers waiting for a msgKey packet's user and
+// returns them, or an error notice if they were held back (e.g. because the key changed).
+// A msgKey with only a name means the user has no key: their whispers are dropped.
+func (w *whisperer) keyArrived(pkt Packet) ([]Packet, string) {
+	name := pkt.field(0)
+	if len(pkt.fields) == 1 {
+		w.mu.Lock()
+		delete(w.pending, name) // The server already said why
+		w.mu.Unlock()
+		return nil, ""
+	}
+	if len(pkt.fields) != 3 || len(pkt.fields[1]) != x25519KeySize || len(pkt.fields[2]) != ed25519.PublicKeySize {
+		return nil, "Ignored malformed key from server"
+	}
+	w.mu.Lock()
+	var texts []string
+	expired := 0
+	for _, q := range w.pending[name] {
+		if time.Since(q.at) >= whisperKeyWait {
+			expired++
+			continue
+		}
+		texts = append(texts, q.text)
+	}
+	delete(w.pending, name)
+	w.mu.Unlock()
+
+	changedFrom, err := w.contacts.check(name, pkt.fields[2])
+	if err != nil {
+		return nil, fmt.Sprintf("Cannot check %s's key: %v", name, err)
+	}
+	if changedFrom != "" {
+		return nil, fmt.Sprintf("WARNING: %s's whisper key changed (was %s, now %s). "+
+			"%d whisper(s) not sent; send again to trust the new key.",
+			name, changedFrom, fingerprint(pkt.fields[2]), len(texts))
+	}
+
+	var out []Packet
+	for _, text := range texts {
+		envelope, err := sealWhisper(w.keys, pkt.fields[1], text)
+		if err != nil {
+			return out, fmt.Sprintf("Cannot encrypt whisper to %s: %v", name, err)
+		}
+		out = append(out, Packet{kind: msgWhisper, fields: [][]byte{[]byte(name), envelope}})
+	}
+	if expired > 0 {
+		return out, fmt.Sprintf("%d whisper(s) to %s not sent: the key took too long to arrive", expired, name)
+	}
+	return out, ""
+}
+
+// openEvent decrypts a whisper event into its text, preceded by a system
+// event for any key warning. Other events come back as they are.
+func (w *whisperer) openEvent(ev event) []event {
+	if ev.Type != eventWhisper {
+		return []event{ev}
+	}
+	sender, text, warning, err := w.read(Packet{kind: msgWhisperFrom, fields: [][]byte{[]byte(ev.Sender), ev.Key, ev.Envelope}})
+	if err != nil {
+		if sender == "" {
+			return []event{{Type: eventError, Time: ev.Time, Text: "Ignored malformed whisper"}}
+		}
+		return []event{{Type: eventError, Time: ev.Time, Text: fmt.Sprintf("Dropped whisper from %s: %v", sender, err)}}
+	}
+	var out []event
+	if warning != "" {
+		out = append(out, event{Type: eventSystem, Time: ev.Time, Text: warning})
+	}
+	ev.Key, ev.Envelope, ev.Text = nil, nil, text
+	return append(out, ev)
+}
+
+// read verifies and decrypts a msgWhisperFrom packet, returning a warning
+// (without colors) if the sender's key is new to us or could not be checked
+func (w *whisperer) read(pkt Packet) (sender, text, warning string, err error) {
+	if len(pkt.fields) != 3 || len(pkt.fields[1]) != ed25519.PublicKeySize {
+		return "", "", "", errBadWhisper
+	}
+	sender = pkt.field(0)
+	text, err = openWhisper(w.keys, pkt.fields[1], pkt.fields[2])
+	if err != nil {
+		return sender, "", "", err
+	}
+
+	changedFrom, err := w.contacts.check(sender, pkt.fields[1])
+	if err != nil {
+		warning = fmt.Sprintf("Cannot check %s's key: %v", sender, err)
+	} else if changedFrom != "" {
+		warning = fmt.Sprintf("WARNING: %s's whisper key changed (was %s, now %s). "+
+			"Make sure it is really them.", sender, changedFrom, fingerprint(pkt.fields[1]))
+	}
+	return sender, text, warning, nil
+}
+
+// knownUsers pins other users' whisper keys, trusting each name's key on first use
+type knownUsers struct {
+	mu   sync.Mutex
+	path string // JSON map of username to signing key fingerprint ("" pins nothing)
+}
+
+// defaultKnownUsers returns the contact pins in configDir
+func defaultKnownUsers() *knownUsers {
+	return &knownUsers{path: filepath.Join(configDir(), knownUsersFile)}
+}
+
+// check pins key for name if it is new. If name was pinned to a different key it
+// re-pins the new one and returns the old fingerprint, so the caller can warn once.
+func (k *knownUsers) check(name string, key ed25519.PublicKey) (changedFrom string, err error) {
+	if k.path == "" {
+		return "", nil // Pinning disabled
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	pins, err := readJSONMap(k.path)
+	if err != nil {
+		return "", err
+	}
+	got := fingerprint(key)
+	old, ok := pins[name]
+	if ok && old == got {
+		return "", nil
+	}
+	pins[name] = got
+	if err := writeJSONMap(k.path, pins); err != nil {
+		return "", err
+	}
+	return old, nil
+}
+
+// readJSONMap reads a JSON object of strings; a missing file is an empty map
+func readJSONMap(path string) (map[string]string, error) {
+	m := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// writeJSONMap atomically replaces path with m, readable by the owner only
+func writeJSONMap(path string, m map[string]string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".gochat-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after a successful rename
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
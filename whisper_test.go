@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeys loads (creating) whisper keys for name in dir
+func testKeys(t *testing.T, dir, name string) *userKeys {
+	t.Helper()
+	keys, err := loadUserKeys(filepath.Join(dir, identitiesFile), name)
+	if err != nil {
+		t.Fatalf("loadUserKeys(%s): %v", name, err)
+	}
+	return keys
+}
+
+func TestWhisperRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	alice, bob, eve := testKeys(t, dir, "alice"), testKeys(t, dir, "bob"), testKeys(t, dir, "eve")
+
+	envelope, err := sealWhisper(alice, bob.encPublic(), "meet at noon")
+	if err != nil {
+		t.Fatalf("sealWhisper: %v", err)
+	}
+	if strings.Contains(string(envelope), "noon") {
+		t.Fatal("envelope contains the plaintext")
+	}
+	if text, err := openWhisper(bob, alice.signPublic(), envelope); err != nil || text != "meet at noon" {
+		t.Fatalf("openWhisper = %q, %v", text, err)
+	}
+
+	// Only the recipient can read it, and only the real sender's key verifies it
+	if _, err := openWhisper(eve, alice.signPublic(), envelope); err == nil {
+		t.Error("eve opened a whisper meant for bob")
+	}
+	if _, err := openWhisper(bob, eve.signPublic(), envelope); !errors.Is(err, errWhisperForged) {
+		t.Errorf("wrong sender key: got %v, want errWhisperForged", err)
+	}
+	envelope[len(envelope)-1] ^= 1
+	if _, err := openWhisper(bob, alice.signPublic(), envelope); !errors.Is(err, errWhisperForged) {
+		t.Errorf("tampered ciphertext: got %v, want errWhisperForged", err)
+	}
+}
+
+func TestUserKeysPersist(t *testing.T) {
+	dir := t.TempDir()
+	first, second := testKeys(t, dir, "alice"), testKeys(t, dir, "alice")
+	if !first.signPublic().Equal(second.signPublic()) || string(first.encPublic()) != string(second.encPublic()) {
+		t.Fatal("reloading the identity file produced different keys")
+	}
+}
+
+func TestWhispererHoldsBackOnKeyChange(t *testing.T) {
+	dir := t.TempDir()
+	contacts := &knownUsers{path: filepath.Join(dir, knownUsersFile)}
+	w := newWhisperer(testKeys(t, dir, "alice"), contacts)
+	keyPacket := func(k *userKeys) Packet {
+		return Packet{kind: msgKey, fields: [][]byte{[]byte("bob"), k.encPublic(), k.signPublic()}}
+	}
+
+	bob := testKeys(t, dir, "bob")
+	w.queue("bob", "one")
+	w.queue("bob", "two")
+	out, notice := w.keyArrived(keyPacket(bob))
+	if len(out) != 2 || notice != "" {
+		t.Fatalf("first key: got %d whispers, notice %q; want 2 whispers", len(out), notice)
+	}
+
+	impostor := testKeys(t, dir, "mallory")
+	w.queue("bob", "three")
+	out, notice = w.keyArrived(keyPacket(impostor))
+	if len(out) != 0 || !strings.Contains(notice, "changed") {
+		t.Fatalf("changed key: got %d whispers, notice %q; want none and a warning", len(out), notice)
+	}
+
+	// Sending again trusts the new key
+	w.queue("bob", "three")
+	if out, notice = w.keyArrived(keyPacket(impostor)); len(out) != 1 || notice != "" {
+		t.Fatalf("after warning: got %d whispers, notice %q", len(out), notice)
+	}
+}
+
+func TestWhispererDropsUnanswered(t *testing.T) {
+	dir := t.TempDir()
+	w := newWhisperer(testKeys(t, dir, "alice"), &knownUsers{path: filepath.Join(dir, knownUsersFile)})
+	bob := testKeys(t, dir, "bob")
+	keyPacket := Packet{kind: msgKey, fields: [][]byte{[]byte("bob"), bob.encPublic(), bob.signPublic()}}
+
+	// The server had no key for bob: whoever takes the name next must not get this
+	w.queue("bob", "for the old bob")
+	if out, _ := w.keyArrived(newPacket(msgKey, "bob")); len(out) != 0 {
+		t.Fatalf("missing key sent %d whispers", len(out))
+	}
+	if out, _ := w.keyArrived(keyPacket); len(out) != 0 {
+		t.Fatalf("%d whispers sent to the next bob", len(out))
+	}
+
+	// Whispers whose key never came expire
+	w.queue("bob", "stale")
+	w.queue("bob", "fresh")
+	w.pending["bob"][0].at = time.Now().Add(-whisperKeyWait)
+	out, notice := w.keyArrived(keyPacket)
+	if len(out) != 1 || !strings.Contains(notice, "1 whisper(s) to bob not sent") {
+		t.Fatalf("got %d whispers, notice %q; want only the fresh one and a notice", len(out), notice)
+	}
+	w.queue("carol", "stale")
+	w.pending["carol"][0].at = time.Now().Add(-whisperKeyWait)
+	w.queue("bob", "prunes carol")
+	if _, ok := w.pending["carol"]; ok {
+		t.Error("expired whispers to carol still queued")
+	}
+}